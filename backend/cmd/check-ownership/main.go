@@ -0,0 +1,74 @@
+// Command check-ownership compares every product's stored current owner and
+// co-owner shares with those its event chain ends with. It exits with status 1 when they
+// disagree anywhere. With -fix, the stored owners are rewritten from the
+// chain.
+package main
+
+import (
+	"backend/utils"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "overwrite mismatched owners with the owner derived from the chain")
+	flag.Parse()
+
+	if err := godotenv.Load("../.env"); err != nil {
+		fmt.Println("Warning: .env file not found, using system environment variables")
+	}
+
+	db, err := utils.ConnectDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect database:", err)
+		os.Exit(2)
+	}
+
+	mismatches, err := utils.CheckOwnership(db, *fix)
+	unresolved := 0
+	for _, m := range mismatches {
+		if m.Err != nil {
+			unresolved++
+			fmt.Printf("product %d: stored owner %d, chain unresolvable: %v\n", m.ProductID, m.StoredOwner, m.Err)
+			continue
+		}
+		status := ""
+		if *fix {
+			status = " (fixed)"
+		}
+		fmt.Printf("product %d: stored owner %d [%s], chain owner %d [%s]%s\n", m.ProductID,
+			m.StoredOwner, formatShares(m.StoredShares), m.ChainOwner, formatShares(m.ChainShares), status)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if len(mismatches) == 0 {
+		fmt.Println("All products match their chains")
+		return
+	}
+	if !*fix || unresolved > 0 {
+		os.Exit(1)
+	}
+}
+
+// formatShares lists shares as "user:percent" in user ID order
+func formatShares(shares map[uint]int) string {
+	userIDs := make([]uint, 0, len(shares))
+	for userID := range shares {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+	parts := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		parts[i] = fmt.Sprintf("%d:%s%%", userID, utils.FormatShare(shares[userID]))
+	}
+	return strings.Join(parts, " ")
+}
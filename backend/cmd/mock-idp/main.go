@@ -0,0 +1,274 @@
+// Command mock-idp is a minimal OpenID Connect provider for trying brand
+// single sign-on locally. It signs in whoever types an email address, marks
+// the address as verified and supports only the authorization code flow with
+// PKCE. It keeps everything in memory and must never face the internet.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const keyID = "mock"
+
+// authorization is an issued code waiting to be exchanged
+type authorization struct {
+	clientID      string
+	redirectURI   string
+	email         string
+	nonce         string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	email        string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock identity provider</title>
+<h1>Mock identity provider</h1>
+<form method="post">
+  <input type="hidden" name="query" value="{{.Query}}">
+  <label>Email <input type="email" name="email" value="{{.Email}}" required autofocus></label>
+  <button type="submit">Sign in</button>
+</form>
+`))
+
+func main() {
+	addr := flag.String("addr", ":9998", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9998", "issuer URL the backend is configured with")
+	clientID := flag.String("client-id", "veriown", "client ID the backend uses")
+	clientSecret := flag.String("client-secret", "", "client secret the backend uses; empty accepts public clients")
+	email := flag.String("email", "", "email address prefilled on the sign-in form")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &provider{
+		issuer:       strings.TrimSuffix(*issuer, "/"),
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		email:        *email,
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	http.HandleFunc("/authorize", p.authorize)
+	http.HandleFunc("/token", p.token)
+	http.HandleFunc("/jwks", p.jwks)
+
+	log.Printf("mock identity provider %s listening on %s", p.issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// authorize shows the sign-in form and, once an email is submitted, sends
+// the browser back to the client with a code
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	rawQuery := r.URL.RawQuery
+	if r.Method == http.MethodPost {
+		rawQuery = r.PostFormValue("query")
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("response_type") != "code" {
+		redirectError(w, r, redirectURI, query.Get("state"), "unsupported_response_type")
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		redirectError(w, r, redirectURI, query.Get("state"), "invalid_request")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		loginPage.Execute(w, map[string]string{"Query": rawQuery, "Email": p.email})
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if !strings.Contains(email, "@") {
+		http.Error(w, "an email address is required", http.StatusBadRequest)
+		return
+	}
+	code := randomID()
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		clientID:      query.Get("client_id"),
+		redirectURI:   redirectURI.String(),
+		email:         email,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	values := redirectURI.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token after checking the client and the
+// PKCE verifier
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Basic")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// Codes are single use, whether or not the exchange succeeds
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(auth.expiresAt) || auth.clientID != clientID ||
+		auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	subject := sha256.Sum256([]byte(strings.ToLower(auth.email)))
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"aud":            clientID,
+		"sub":            hex.EncodeToString(subject[:16]),
+		"email":          auth.email,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomID(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func redirectError(w http.ResponseWriter, r *http.Request, redirectURI *url.URL, state, code string) {
+	values := redirectURI.Query()
+	values.Set("error", code)
+	values.Set("state", state)
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
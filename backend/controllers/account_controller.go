@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"backend/models"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// account is what a request needs to know about the user behind its token.
+// Only the user ID is taken from the token; role, verification and
+// suspension are read from the database so that changing them takes effect
+// on tokens already issued.
+type account struct {
+	role               string
+	principalID        uint
+	organizationID     *uint
+	organizationRole   string
+	verificationStatus string
+	suspended          bool
+	loadedAt           time.Time
+}
+
+var accountCache = struct {
+	sync.Mutex
+	entries map[uint]account
+}{entries: make(map[uint]account)}
+
+// accountCacheTTL is how long an account is served from the cache. Changes
+// made through this server drop the entry at once; the TTL bounds how long
+// other instances keep acting on the old state.
+func accountCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("ACCOUNT_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		return 30 * time.Second
+	}
+	return ttl
+}
+
+// loadAccount returns the current state of a user's account
+func loadAccount(userID uint) (account, error) {
+	accountCache.Lock()
+	cached, ok := accountCache.entries[userID]
+	accountCache.Unlock()
+	if ok && time.Since(cached.loadedAt) < accountCacheTTL() {
+		return cached, nil
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return account{}, err
+	}
+
+	acct := account{
+		role:             user.Role,
+		principalID:      user.ID,
+		organizationID:   user.OrganizationID,
+		organizationRole: user.OrganizationRole,
+		suspended:        user.SuspendedAt != nil,
+		loadedAt:         time.Now(),
+	}
+	if user.OrganizationID != nil {
+		var org models.Organization
+		if err := db.Select("id", "account_user_id", "verification_status").First(&org, *user.OrganizationID).Error; err != nil {
+			return account{}, err
+		}
+		acct.principalID = org.AccountUserID
+		acct.verificationStatus = org.VerificationStatus
+	} else {
+		acct.verificationStatus = user.VerificationStatus
+	}
+
+	accountCache.Lock()
+	accountCache.entries[userID] = acct
+	accountCache.Unlock()
+	return acct, nil
+}
+
+// forgetAccount drops a user from the cache after their account changed
+func forgetAccount(userID uint) {
+	accountCache.Lock()
+	delete(accountCache.entries, userID)
+	accountCache.Unlock()
+}
+
+// forgetAccounts empties the cache after a change that affects several
+// users, such as an organization's verification
+func forgetAccounts() {
+	accountCache.Lock()
+	accountCache.entries = make(map[uint]account)
+	accountCache.Unlock()
+}
+
+// needsVerification reports whether a role may only act once an admin has
+// verified it
+func needsVerification(role string) bool {
+	return role == "brand" || role == "repair_shop"
+}
+
+// accountStatusError explains why an account may not be used, or returns ""
+// when it may
+func accountStatusError(role, verificationStatus string, suspended bool) string {
+	switch {
+	case suspended:
+		return "Your account has been suspended"
+	case !needsVerification(role) || verificationStatus == "verified":
+		return ""
+	case verificationStatus == "pending":
+		return "Your account is pending verification"
+	default:
+		return "Your account verification was rejected"
+	}
+}
+
+type SuspensionInput struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// SuspendUser blocks an account at once, including tokens already issued
+func SuspendUser(c *gin.Context) {
+	adminID := c.MustGet("user_id").(uint)
+
+	var input SuspensionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.ID == adminID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot suspend your own account"})
+		return
+	}
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already suspended"})
+		return
+	}
+
+	now := time.Now()
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"suspended_at":      now,
+		"suspended_by":      adminID,
+		"suspension_reason": input.Reason,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to suspend user"})
+		return
+	}
+	forgetAccount(user.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "User suspended",
+		"user_id":      user.ID,
+		"suspended_at": now,
+	})
+}
+
+// ReinstateUser lifts a suspension
+func ReinstateUser(c *gin.Context) {
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.SuspendedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is not suspended"})
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"suspended_at":      nil,
+		"suspended_by":      0,
+		"suspension_reason": "",
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reinstate user"})
+		return
+	}
+	forgetAccount(user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User reinstated", "user_id": user.ID})
+}
+
+// respondAccountError answers a request whose account could not be loaded
+func respondAccountError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load account"})
+	}
+}
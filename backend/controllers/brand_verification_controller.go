@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// How long an email confirmation link works
+	emailConfirmationTTL = 48 * time.Hour
+	// An organization is sent at most one confirmation link in this time
+	emailConfirmationInterval = time.Minute
+	// An organization's domain is looked up at most once in this time
+	domainCheckInterval = 10 * time.Second
+)
+
+var errEmailConfirmationInvalid = errors.New("invalid email confirmation token")
+
+// BrandEvidence is what an admin has to go on when verifying a brand: whether
+// the registrant proved they receive mail at the contact address and
+// control the official domain
+type BrandEvidence struct {
+	EmailConfirmed   bool       `json:"email_confirmed"`
+	EmailConfirmedAt *time.Time `json:"email_confirmed_at"`
+	DomainVerified   bool       `json:"domain_verified"`
+	DomainVerifiedAt *time.Time `json:"domain_verified_at"`
+	DomainRecordName string     `json:"domain_record_name"`
+	DomainCheckedAt  *time.Time `json:"domain_checked_at"`
+	DomainCheckError string     `json:"domain_check_error,omitempty"`
+}
+
+func brandEvidence(org *models.Organization) *BrandEvidence {
+	return &BrandEvidence{
+		EmailConfirmed:   org.EmailConfirmedAt != nil,
+		EmailConfirmedAt: org.EmailConfirmedAt,
+		DomainVerified:   org.DomainVerifiedAt != nil,
+		DomainVerifiedAt: org.DomainVerifiedAt,
+		DomainRecordName: utils.DomainChallengeName(org.OfficialDomain),
+		DomainCheckedAt:  org.DomainCheckedAt,
+		DomainCheckError: org.DomainCheckError,
+	}
+}
+
+// domainChallengeInstructions tells the registrant which DNS record to add
+func domainChallengeInstructions(org *models.Organization) gin.H {
+	return gin.H{
+		"record_type":  "TXT",
+		"record_name":  utils.DomainChallengeName(org.OfficialDomain),
+		"record_value": utils.DomainChallengeValue(org.DomainChallenge),
+	}
+}
+
+// emailConfirmationURL is the page of the frontend a confirmation link opens
+func emailConfirmationURL(token string) string {
+	base := os.Getenv("EMAIL_CONFIRMATION_URL")
+	if base == "" {
+		base = "http://localhost:5173/confirm-email"
+	}
+	return base + "?token=" + url.QueryEscape(token)
+}
+
+// sendEmailConfirmation mails a confirmation link to the organization's
+// contact email. It reports false when one was sent moments ago.
+func sendEmailConfirmation(org *models.Organization) (bool, error) {
+	var recent int64
+	if err := db.Model(&models.EmailConfirmation{}).
+		Where("organization_id = ? AND created_at > ?", org.ID, time.Now().Add(-emailConfirmationInterval)).
+		Count(&recent).Error; err != nil {
+		return false, err
+	}
+	if recent > 0 {
+		return false, nil
+	}
+
+	mailer, err := utils.Mail()
+	if err != nil {
+		return false, err
+	}
+	token, err := utils.NewTokenID()
+	if err != nil {
+		return false, err
+	}
+	confirmation := models.EmailConfirmation{
+		OrganizationID: org.ID,
+		Email:          org.ContactEmail,
+		TokenHash:      utils.HashRefreshToken(token),
+		ExpiresAt:      time.Now().Add(emailConfirmationTTL),
+	}
+
+	// Links that were never used are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.EmailConfirmation{})
+	if err := db.Create(&confirmation).Error; err != nil {
+		return false, err
+	}
+	return true, mailer.Send(utils.MailMessage{
+		To:      org.ContactEmail,
+		Subject: "Confirm the contact email of " + org.CompanyName + " on VeriOwn",
+		Body: fmt.Sprintf("Hello,\n\n"+
+			"%s was registered as a brand on VeriOwn with this address as its contact email. To confirm it, open this link within %d hours:\n\n"+
+			"%s\n\n"+
+			"If you did not register this brand, ignore this email.\n",
+			org.CompanyName, int(emailConfirmationTTL.Hours()), emailConfirmationURL(token)),
+	})
+}
+
+type EmailConfirmationInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ConfirmEmail records that the organization's contact email received the
+// confirmation link
+func ConfirmEmail(c *gin.Context) {
+	var input EmailConfirmationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var org models.Organization
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var confirmation models.EmailConfirmation
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", utils.HashRefreshToken(input.Token), time.Now()).
+			First(&confirmation).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errEmailConfirmationInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		// Claim the link so it works only once, even for concurrent requests
+		claim := tx.Model(&models.EmailConfirmation{}).Where("id = ? AND used_at IS NULL", confirmation.ID).Update("used_at", time.Now())
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			return errEmailConfirmationInvalid
+		}
+
+		if err := tx.First(&org, confirmation.OrganizationID).Error; err != nil {
+			return err
+		}
+		// A link sent to an earlier contact email proves nothing about the
+		// current one
+		if org.ContactEmail != confirmation.Email {
+			return errEmailConfirmationInvalid
+		}
+		if org.EmailConfirmedAt != nil {
+			return nil
+		}
+		return tx.Model(&org).Update("email_confirmed_at", time.Now()).Error
+	})
+	if errors.Is(err, errEmailConfirmationInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired confirmation link"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Email confirmed",
+		"organization_id": org.ID,
+	})
+}
+
+// findPendingOrganization loads the organization of the :id route parameter
+// while it awaits verification
+func findPendingOrganization(c *gin.Context) (*models.Organization, bool) {
+	var org models.Organization
+	if err := db.Where("verification_status = ?", "pending").First(&org, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found or not awaiting verification"})
+		return nil, false
+	}
+	return &org, true
+}
+
+// ResendEmailConfirmation sends a new confirmation link to a pending
+// organization's contact email. The brand cannot log in before it is
+// verified, so this needs no session.
+func ResendEmailConfirmation(c *gin.Context) {
+	org, ok := findPendingOrganization(c)
+	if !ok {
+		return
+	}
+	if org.EmailConfirmedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already confirmed"})
+		return
+	}
+
+	sent, err := sendEmailConfirmation(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send confirmation email"})
+		return
+	}
+	if !sent {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "A confirmation email was just sent, please wait a minute"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Confirmation email sent to the contact address"})
+}
+
+// CheckDomainVerification looks up the DNS TXT record that proves a pending
+// organization controls its official domain, and records the outcome. It
+// needs no session: the record is the proof, whoever asks for the check.
+func CheckDomainVerification(c *gin.Context) {
+	org, ok := findPendingOrganization(c)
+	if !ok {
+		return
+	}
+
+	// Organizations registered before domain checks get their challenge here
+	if org.DomainChallenge == "" {
+		token, err := utils.NewTokenID()
+		if err == nil {
+			err = db.Model(org).Update("domain_challenge", token).Error
+		}
+		org.DomainChallenge = token
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create domain challenge"})
+			return
+		}
+	}
+
+	response := gin.H{"domain_verification": domainChallengeInstructions(org)}
+	if org.DomainVerifiedAt != nil {
+		response["domain_verified"] = true
+		response["domain_verified_at"] = org.DomainVerifiedAt
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if org.DomainCheckedAt != nil && time.Since(*org.DomainCheckedAt) < domainCheckInterval {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "The domain was just checked, please wait a few seconds"})
+		return
+	}
+
+	now := time.Now()
+	verified, err := utils.CheckDomainChallenge(org.OfficialDomain, org.DomainChallenge)
+	updates := map[string]interface{}{"domain_checked_at": now, "domain_check_error": ""}
+	switch {
+	case err != nil:
+		updates["domain_check_error"] = "DNS lookup failed: " + err.Error()
+	case verified:
+		updates["domain_verified_at"] = now
+	default:
+		updates["domain_check_error"] = "TXT record not found"
+	}
+	if err := db.Model(org).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record domain check"})
+		return
+	}
+
+	response["domain_verified"] = verified
+	response["domain_checked_at"] = now
+	if msg := updates["domain_check_error"]; msg != "" {
+		response["domain_check_error"] = msg
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Chain events for co-ownership changes that are not offer states
+const (
+	transferConsentEvent = "transfer_consent"
+	consentRuleEvent     = "consent_rule_changed"
+)
+
+var (
+	errAlreadyAnswered = errors.New("consent already given")
+	errNotSoleOwner    = errors.New("only a sole owner can change the consent rule")
+)
+
+type ConsentInput struct {
+	Approve *bool `json:"approve" binding:"required"`
+}
+
+type ConsentRuleInput struct {
+	ConsentRule string `json:"consent_rule" binding:"required"`
+}
+
+// consentOutcome tallies the co-owners' answers to an offer. The sender
+// counts as approving. Under "all" a single refusal sinks the offer; under
+// "majority" it fails once approval of more than half is out of reach.
+func consentOutcome(rule string, shares map[uint]int, senderID uint, consents []models.TransferConsent) (approved, refused bool) {
+	approvedShare := shares[senderID]
+	refusedShare := 0
+	for _, consent := range consents {
+		if consent.Approved {
+			approvedShare += shares[consent.UserID]
+		} else {
+			refusedShare += shares[consent.UserID]
+		}
+	}
+
+	if rule == utils.ConsentMajority {
+		return approvedShare*2 > utils.FullShare, refusedShare*2 >= utils.FullShare
+	}
+	return approvedShare == utils.FullShare, refusedShare > 0
+}
+
+// settleConsent opens an offer awaiting consent once the product's consent
+// rule is met, or rejects it once the rule can no longer be met
+func settleConsent(tx *gorm.DB, rule string, transfer *models.PendingTransfer, actorID uint) error {
+	shares, err := utils.ProductShares(tx, transfer.ProductID)
+	if err != nil {
+		return err
+	}
+
+	var consents []models.TransferConsent
+	if err := tx.Where("transfer_id = ?", transfer.ID).Find(&consents).Error; err != nil {
+		return err
+	}
+
+	approved, refused := consentOutcome(rule, shares, transfer.InitiatedBy, consents)
+	switch {
+	case refused:
+		return closeTransfer(tx, transfer, TransferRejected, actorID)
+	case approved:
+		return openTransfer(tx, transfer)
+	}
+	return nil
+}
+
+// openTransfer hands a consented offer to its recipient: escrow offers wait
+// for payment, others can be accepted straight away
+func openTransfer(tx *gorm.DB, transfer *models.PendingTransfer) error {
+	if transfer.PriceMinor > 0 {
+		return requestPayment(tx, transfer, utils.Money{AmountMinor: transfer.PriceMinor, Currency: transfer.Currency})
+	}
+	transfer.Status = TransferInitiated
+	return tx.Save(transfer).Error
+}
+
+// ConsentToTransfer records a co-owner's approval or refusal of another
+// co-owner's offer
+func ConsentToTransfer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	principal := principalID(c)
+
+	var input ConsentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var transfer *models.PendingTransfer
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transfer, err = findOpenTransfer(tx, c.Param("id"), "status = ? AND initiated_by <> ?", TransferAwaitingConsent, principal)
+		if err != nil {
+			return err
+		}
+
+		share, err := ownerShare(tx, transfer.ProductID, principal)
+		if err != nil {
+			return err
+		}
+		if share == 0 {
+			return errNotCurrentOwner
+		}
+
+		var answered int64
+		if err := tx.Model(&models.TransferConsent{}).
+			Where("transfer_id = ? AND user_id = ?", transfer.ID, principal).Count(&answered).Error; err != nil {
+			return err
+		}
+		if answered > 0 {
+			return errAlreadyAnswered
+		}
+
+		consent := models.TransferConsent{TransferID: transfer.ID, UserID: principal, Approved: *input.Approve}
+		if err := tx.Create(&consent).Error; err != nil {
+			return err
+		}
+
+		event := models.Event{
+			ProductID: transfer.ProductID,
+			EventType: transferConsentEvent,
+			EventData: fmt.Sprintf(`{"transfer_id": %d, "approved": %t}`, transfer.ID, consent.Approved),
+			CreatedBy: userID.(uint),
+		}
+		if err := createEventRecord(tx, &event); err != nil {
+			return fmt.Errorf("failed to log consent event: %w", err)
+		}
+
+		var product models.Product
+		if err := tx.Select("id", "consent_rule").First(&product, transfer.ProductID).Error; err != nil {
+			return err
+		}
+		return settleConsent(tx, product.ConsentRule, transfer, userID.(uint))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotCurrentOwner):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only a co-owner of this product can consent to its transfer"})
+		case errors.Is(err, errAlreadyAnswered):
+			c.JSON(http.StatusConflict, gin.H{"error": "You have already answered this transfer"})
+		default:
+			respondTransferError(c, err, "record consent for")
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Consent recorded",
+		"transfer_id": transfer.ID,
+		"status":      transfer.Status,
+	})
+}
+
+// GetTransfersAwaitingConsent lists the offers by other co-owners that the
+// current user has yet to answer
+func GetTransfersAwaitingConsent(c *gin.Context) {
+	userID := principalID(c)
+
+	var transfers []models.PendingTransfer
+	err := db.Table("pending_transfers").
+		Select("pending_transfers.*").
+		Joins("JOIN product_owners ON product_owners.product_id = pending_transfers.product_id AND product_owners.deleted_at IS NULL").
+		Where("product_owners.user_id = ? AND pending_transfers.initiated_by <> ?", userID, userID).
+		Where("pending_transfers.status = ? AND pending_transfers.expires_at > ?", TransferAwaitingConsent, time.Now()).
+		Where("NOT EXISTS (SELECT 1 FROM transfer_consents WHERE transfer_consents.transfer_id = pending_transfers.id AND transfer_consents.user_id = ?)", userID).
+		Where("pending_transfers.deleted_at IS NULL").
+		Order("pending_transfers.created_at desc").
+		Find(&transfers).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers awaiting consent"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"awaiting_consent": transfers})
+}
+
+// GetProductOwners lists a product's owners and their shares
+func GetProductOwners(c *gin.Context) {
+	var product models.Product
+	if err := db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	var owners []struct {
+		UserID   uint
+		Username string
+		Share    int
+	}
+	if err := db.Table("product_owners").
+		Select("product_owners.user_id, users.username, product_owners.share").
+		Joins("LEFT JOIN users ON users.id = product_owners.user_id").
+		Where("product_owners.product_id = ? AND product_owners.deleted_at IS NULL", product.ID).
+		Order("product_owners.share desc, product_owners.user_id asc").
+		Scan(&owners).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch owners"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(owners))
+	for _, owner := range owners {
+		response = append(response, gin.H{
+			"user_id":  owner.UserID,
+			"username": owner.Username,
+			"share":    utils.FormatShare(owner.Share),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product_id":       product.ID,
+		"current_owner_id": product.CurrentOwnerID,
+		"consent_rule":     product.ConsentRule,
+		"owners":           response,
+	})
+}
+
+// SetConsentRule chooses how co-owners must agree to future share transfers.
+// It can only be changed while the product has a single owner, so no
+// co-owner has the rule changed under them.
+func SetConsentRule(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var input ConsentRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.ConsentRule != utils.ConsentAll && input.ConsentRule != utils.ConsentMajority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "consent_rule must be \"all\" or \"majority\""})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		product, err := lockProduct(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		shares, err := utils.ProductShares(tx, product.ID)
+		if err != nil {
+			return err
+		}
+		if shares[principalID(c)] != utils.FullShare {
+			return errNotSoleOwner
+		}
+
+		if err := tx.Model(product).Update("consent_rule", input.ConsentRule).Error; err != nil {
+			return err
+		}
+
+		event := models.Event{
+			ProductID: product.ID,
+			EventType: consentRuleEvent,
+			EventData: fmt.Sprintf(`{"consent_rule": %q}`, input.ConsentRule),
+			CreatedBy: userID.(uint),
+		}
+		return createEventRecord(tx, &event)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		case errors.Is(err, errNotSoleOwner):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the sole owner of a product can change its consent rule"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update consent rule"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Consent rule updated", "consent_rule": input.ConsentRule})
+}
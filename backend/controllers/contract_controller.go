@@ -3,11 +3,9 @@ package controllers
 import (
 	"backend/models"
 	"backend/utils"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,15 +13,14 @@ import (
 // GetProductContracts returns all contracts for a specific product
 func GetProductContracts(c *gin.Context) {
 	productID := c.Param("id")
-	userID, _ := c.Get("user_id")
+	userID := principalID(c)
 
 	// Check permissions
 	var contracts []models.OwnerContract
 	query := db.Where("product_id = ?", productID)
 
 	// Admin sees everything, others see only their own contracts
-	role, _ := c.Get("role")
-	if role != "admin" {
+	if ok, _ := allowed(c, ActionViewAllContracts); !ok {
 		query = query.Where("owner_id = ? OR previous_owner_id = ?", userID, userID)
 	}
 
@@ -38,7 +35,6 @@ func GetProductContracts(c *gin.Context) {
 // GetContractPDF serves the PDF file for a specific contract
 func GetContractPDF(c *gin.Context) {
 	contractID := c.Param("id")
-	userID, _ := c.Get("user_id")
 
 	var contract models.OwnerContract
 	if err := db.First(&contract, contractID).Error; err != nil {
@@ -46,13 +42,6 @@ func GetContractPDF(c *gin.Context) {
 		return
 	}
 
-	// Check permissions - only owner, previous owner, or admin can access
-	role, _ := c.Get("role")
-	if role != "admin" && contract.OwnerID != userID.(uint) && contract.PreviousOwnerID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this contract"})
-		return
-	}
-
 	// Check if we have an IPFS CID
 	if contract.IPFSCID == "" {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Contract not stored on IPFS"})
@@ -78,10 +67,10 @@ func GetContractPDF(c *gin.Context) {
 	c.FileAttachment(tempFile.Name(), filename)
 }
 
-// RegenerateContractPDF recreates the PDF for a contract (useful if the PDF is missing)
+// RegenerateContractPDF queues the contract to be rendered and uploaded again
+// (useful if the PDF is missing)
 func RegenerateContractPDF(c *gin.Context) {
 	contractID := c.Param("id")
-	userID, _ := c.Get("user_id")
 
 	var contract models.OwnerContract
 	if err := db.First(&contract, contractID).Error; err != nil {
@@ -89,50 +78,80 @@ func RegenerateContractPDF(c *gin.Context) {
 		return
 	}
 
-	// Check permissions
-	role, _ := c.Get("role")
-	if role != "admin" && contract.OwnerID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only the contract owner or an admin can regenerate it"})
+	job, err := utils.EnqueueContractRender(db, contract.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue PDF regeneration"})
 		return
 	}
 
-	// Parse contract data
-	var contractData utils.ContractData
-	if err := json.Unmarshal([]byte(contract.DocumentData), &contractData); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse contract data"})
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "PDF regeneration queued",
+		"job_id":  job.ID,
+	})
+}
+
+// GetContractJobs lists the rendering jobs of a contract and their status
+func GetContractJobs(c *gin.Context) {
+	contractID := c.Param("id")
+
+	var contract models.OwnerContract
+	if err := db.First(&contract, contractID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contract not found"})
 		return
 	}
 
-	// Create PDF directory if it doesn't exist
-	pdfDir := filepath.Join(".", "contracts")
-	if err := os.MkdirAll(pdfDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create contracts directory"})
+	var jobs []models.OutboxJob
+	if err := db.Where("contract_id = ?", contract.ID).Order("created_at desc").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contract jobs"})
 		return
 	}
 
-	// Generate PDF filename
-	pdfPath := filepath.Join(pdfDir, contract.ContractNumber+".pdf")
+	response := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		response = append(response, gin.H{
+			"id":              job.ID,
+			"kind":            job.Kind,
+			"status":          job.Status,
+			"attempts":        job.Attempts,
+			"max_attempts":    job.MaxAttempts,
+			"last_error":      job.LastError,
+			"next_attempt_at": job.NextAttemptAt,
+			"completed_at":    job.CompletedAt,
+			"created_at":      job.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"contract_number": contract.ContractNumber,
+		"ipfs_cid":        contract.IPFSCID,
+		"jobs":            response,
+	})
+}
 
-	// Generate PDF
-	if err := utils.GenerateContractPDF(pdfPath, contractData, contract.ContractHash); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate PDF"})
+// RetryJob puts a dead-lettered job back in the queue
+func RetryJob(c *gin.Context) {
+	var job models.OutboxJob
+	if err := db.First(&job, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
 		return
 	}
 
-	// Update contract record
-	contract.PDFPath = pdfPath
-	if err := db.Save(&contract).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contract record"})
+	if job.Status != utils.OutboxStatusDead {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only dead jobs can be retried"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "PDF regenerated successfully"})
+	if err := utils.RetryOutboxJob(db, &job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job queued for retry"})
 }
 
 // GetContractIPFSLink provides the IPFS link for a specific contract
 func GetContractIPFSLink(c *gin.Context) {
 	contractID := c.Param("id")
-	userID, _ := c.Get("user_id")
 
 	var contract models.OwnerContract
 	if err := db.First(&contract, contractID).Error; err != nil {
@@ -140,13 +159,6 @@ func GetContractIPFSLink(c *gin.Context) {
 		return
 	}
 
-	// Check permissions - only owner, previous owner, or admin can access
-	role, _ := c.Get("role")
-	if role != "admin" && contract.OwnerID != userID.(uint) && contract.PreviousOwnerID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this contract"})
-		return
-	}
-
 	// Check if we have an IPFS CID
 	if contract.IPFSCID == "" {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Contract not stored on IPFS"})
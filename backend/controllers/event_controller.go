@@ -4,11 +4,16 @@ import (
 	"backend/models"
 	"backend/utils"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func InitEventController(database *gorm.DB) {
@@ -18,13 +23,35 @@ func InitEventController(database *gorm.DB) {
 type EventInput struct {
 	EventType string `json:"event_type" binding:"required"`
 	EventData string `json:"event_data" binding:"required"`
+	// Optional client-side signature. When present, created_at and
+	// previous_event_hash must be the values the actor signed.
+	ActorSignature    string `json:"actor_signature"`
+	CreatedAt         string `json:"created_at"`
+	PreviousEventHash string `json:"previous_event_hash"`
 }
 
-// Add this utility function
-func createEventRecord(event *models.Event) error {
+// How far an actor-supplied timestamp may drift from the server clock
+const actorClockSkew = 5 * time.Minute
+
+var (
+	errChainHeadMoved        = errors.New("previous event hash does not match the current chain head")
+	errInvalidActorSignature = errors.New("invalid actor signature")
+	errCreatedAtUnsignable   = errors.New("no server signing key was active at created_at")
+)
+
+// createEventRecord appends an event to its product's chain. It must run
+// inside a transaction: the product row is locked for the rest of tx so that
+// concurrent appends to the same product are serialized and cannot fork the
+// chain.
+func createEventRecord(tx *gorm.DB, event *models.Event) error {
+	var product models.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&product, event.ProductID).Error; err != nil {
+		return err
+	}
+
 	// Find the last event for this product
 	var lastEvent models.Event
-	err := db.Where("product_id = ?", event.ProductID).Order("created_at desc").First(&lastEvent).Error
+	err := tx.Where("product_id = ?", event.ProductID).Order("sequence desc").First(&lastEvent).Error
 	previousHash := ""
 	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -33,45 +60,162 @@ func createEventRecord(event *models.Event) error {
 	} else {
 		previousHash = lastEvent.EventHash
 	}
+	event.Sequence = lastEvent.Sequence + 1
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.CreatedAt = event.CreatedAt.Truncate(utils.EventTimestampPrecision)
+	event.HashVersion = utils.CurrentEventHashVersion
+
+	// An actor signature commits to a chain position, so it is only valid
+	// if nothing was appended since the actor read the head
+	if event.ActorSignature != "" {
+		if event.PreviousEventHash != previousHash {
+			return errChainHeadMoved
+		}
+
+		var actor models.User
+		if err := tx.First(&actor, event.CreatedBy).Error; err != nil {
+			return err
+		}
+		if err := utils.VerifyActorSignature(actor.PublicKey, utils.HashDataForEvent(event), event.ActorSignature); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidActorSignature, err)
+		}
+		event.ActorPublicKey = actor.PublicKey
+	}
 
 	event.PreviousEventHash = previousHash
 
-	// Create the event
-	if err := db.Create(event).Error; err != nil {
+	// Calculate the hash before inserting, with the timestamp at the
+	// precision the database keeps so the stored row hashes the same
+	eventHash, err := utils.ComputeEventHash(utils.HashDataForEvent(event))
+	if err != nil {
 		return err
 	}
 
-	// Calculate and save hash
-	hashData := utils.EventHashData{
-		ProductID:         event.ProductID,
-		EventType:         event.EventType,
-		EventData:         event.EventData,
-		CreatedAt:         event.CreatedAt,
-		CreatedBy:         event.CreatedBy,
-		PreviousEventHash: event.PreviousEventHash,
+	event.EventHash = eventHash
+
+	// Sign with the key that was active when the event was created
+	event.SigningKeyID, event.Signature, err = utils.SignAt(event.CreatedAt, utils.EventSignaturePayload(eventHash))
+	// An actor's created_at can fall just before a key rotation or inside
+	// the time of a retired key. The server cannot countersign it, but the
+	// actor can sign again with a fresh timestamp.
+	if errors.Is(err, utils.ErrNoSigningKey) && event.ActorSignature != "" {
+		return errCreatedAtUnsignable
+	}
+	if err != nil {
+		return err
+	}
+
+	// The unique (product_id, sequence) index backs up the lock above
+	if err := tx.Create(event).Error; err != nil {
+		return err
+	}
+
+	return appendHistoryRoot(tx, event)
+}
+
+// appendEvent appends a single event in its own transaction
+func appendEvent(event *models.Event) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return createEventRecord(tx, event)
+	})
+}
+
+// productEventHashes returns the product's event hashes in chain order
+func productEventHashes(tx *gorm.DB, productID uint) ([]models.Event, []string, error) {
+	var events []models.Event
+	if err := tx.Where("product_id = ?", productID).Order("sequence asc").Find(&events).Error; err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(events))
+	for i, event := range events {
+		hashes[i] = event.EventHash
 	}
+	return events, hashes, nil
+}
 
-	eventHash, err := utils.ComputeEventHash(hashData)
+// updateHistoryRoot recomputes and stores the Merkle root of a product's
+// history from all of its events
+func updateHistoryRoot(tx *gorm.DB, productID uint) error {
+	_, hashes, err := productEventHashes(tx, productID)
 	if err != nil {
 		return err
 	}
 
-	event.EventHash = eventHash
-	return db.Save(event).Error
+	return tx.Model(&models.Product{}).Where("id = ?", productID).Updates(map[string]interface{}{
+		"history_root":     utils.ComputeMerkleRoot(hashes),
+		"history_size":     len(hashes),
+		"history_frontier": strings.Join(utils.MerkleFrontier(hashes), ","),
+	}).Error
+}
+
+// appendHistoryRoot moves the stored Merkle root of a product's history on
+// by the event just appended, using the stored frontier instead of reloading
+// the chain. A product whose stored tree does not end right before the
+// event, such as one stored before frontiers were kept, gets a full
+// recompute.
+func appendHistoryRoot(tx *gorm.DB, event *models.Event) error {
+	var product models.Product
+	if err := tx.Select("id", "history_size", "history_frontier").First(&product, event.ProductID).Error; err != nil {
+		return err
+	}
+	if int(event.Sequence) != product.HistorySize+1 {
+		return updateHistoryRoot(tx, event.ProductID)
+	}
+
+	var frontier []string
+	if product.HistoryFrontier != "" {
+		frontier = strings.Split(product.HistoryFrontier, ",")
+	}
+	frontier, err := utils.AppendMerkleFrontier(frontier, product.HistorySize, event.EventHash)
+	if err != nil {
+		return updateHistoryRoot(tx, event.ProductID)
+	}
+	root, err := utils.MerkleFrontierRoot(frontier)
+	if err != nil {
+		return updateHistoryRoot(tx, event.ProductID)
+	}
+
+	return tx.Model(&models.Product{}).Where("id = ?", event.ProductID).Updates(map[string]interface{}{
+		"history_root":     root,
+		"history_size":     product.HistorySize + 1,
+		"history_frontier": strings.Join(frontier, ","),
+	}).Error
+}
+
+// isSystemEvent reports whether events of this type record registration or
+// ownership changes. Only the flows that make those changes log them, since
+// ownership is replayed from them.
+func isSystemEvent(eventType string) bool {
+	if eventType == "registration" || eventType == transferConsentEvent || eventType == consentRuleEvent {
+		return true
+	}
+	for _, transferEvent := range transferEventTypes {
+		if eventType == transferEvent {
+			return true
+		}
+	}
+	return false
 }
 
 func CreateEvent(c *gin.Context) {
 	productID := c.Param("id")
-	role, _ := c.Get("role")
 
 	var input EventInput
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := c.ShouldBindBodyWith(&input, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if input.EventType == "repair" && role != "repair_shop" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only repair shops can log repairs"})
+	if isSystemEvent(input.EventType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Events of type " + input.EventType + " are only logged by the system"})
+		return
+	}
+
+	if input.EventType == "repair" && !authorize(c, ActionLogRepair) {
 		return
 	}
 
@@ -89,51 +233,146 @@ func CreateEvent(c *gin.Context) {
 		CreatedBy: userID.(uint),
 	}
 
-	if err := createEventRecord(&event); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
+	if input.ActorSignature != "" {
+		if !authorize(c, ActionSignEvent) {
+			return
+		}
+
+		// Anything finer than the stored precision would be lost from the
+		// signed payload, so reject it rather than silently truncate
+		createdAt, err := time.Parse(time.RFC3339Nano, input.CreatedAt)
+		if err != nil || !createdAt.Equal(createdAt.Truncate(utils.EventTimestampPrecision)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Signed events need created_at in RFC 3339 with at most millisecond precision"})
+			return
+		}
+		if skew := time.Since(createdAt); skew > actorClockSkew || skew < -actorClockSkew {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "created_at is too far from the server time"})
+			return
+		}
+
+		event.CreatedAt = createdAt
+		event.PreviousEventHash = input.PreviousEventHash
+		event.ActorSignature = input.ActorSignature
+	}
+
+	if err := appendEvent(&event); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		case errors.Is(err, errChainHeadMoved):
+			c.JSON(http.StatusConflict, gin.H{"error": "Product history changed since the event was signed, sign against the new head"})
+		case errors.Is(err, errInvalidActorSignature):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, errCreatedAtUnsignable):
+			c.JSON(http.StatusConflict, gin.H{"error": "The server signing key changed after created_at, sign again with the current time"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
+		}
 		return
 	}
 
 	c.JSON(http.StatusOK, event)
 }
 
+// VerifyProductHistory checks every event in a product's chain and returns a
+// report of the outcome for each one
 func VerifyProductHistory(c *gin.Context) {
-	productID := c.Param("id")
-	var events []models.Event
-	if err := db.Where("product_id = ?", productID).Order("created_at asc").Find(&events).Error; err != nil {
+	var product models.Product
+	if err := db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	events, _, err := productEventHashes(db, product.ID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, utils.BuildChainReport(product.ID, events))
+}
+
+// GetChainReportSchema serves the JSON schema of the verification report
+func GetChainReportSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", utils.ChainReportSchema)
+}
+
+// GetEventInclusionProof returns a Merkle inclusion proof showing that a single
+// event is part of the product's certified history
+func GetEventInclusionProof(c *gin.Context) {
+	var product models.Product
+	if err := db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	eventID, err := strconv.ParseUint(c.Param("eventId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	events, hashes, err := productEventHashes(db, product.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product history"})
+		return
+	}
+
+	index := -1
 	for i, event := range events {
-		if i == 0 && event.PreviousEventHash != "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid previous hash for first event"})
-			return
-		} else if i > 0 && event.PreviousEventHash != events[i-1].EventHash {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Hash chain broken at event " + string(event.ID)})
-			return
+		if event.ID == uint(eventID) {
+			index = i
+			break
 		}
+	}
+	if index < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found for this product"})
+		return
+	}
 
-		hashData := utils.EventHashData{
-			ProductID:         event.ProductID,
-			EventType:         event.EventType,
-			EventData:         event.EventData,
-			CreatedAt:         event.CreatedAt,
-			CreatedBy:         event.CreatedBy,
-			PreviousEventHash: event.PreviousEventHash,
-		}
+	// The leaf must be the hash the event actually commits to
+	event := events[index]
+	expectedHash, err := utils.ComputeEventHash(utils.HashDataForEvent(&event))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute hash"})
+		return
+	}
+	if expectedHash != event.EventHash {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stored event hash does not match event contents"})
+		return
+	}
 
-		expectedHash, err := utils.ComputeEventHash(hashData)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute hash"})
-			return
-		}
+	proof, err := utils.BuildMerkleProof(hashes, index)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build inclusion proof"})
+		return
+	}
 
-		if event.EventHash != expectedHash {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hash for event " + string(event.ID)})
+	// Products created before roots were stored get theirs on first request
+	if product.HistorySize == 0 {
+		if err := updateHistoryRoot(db, product.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store history root"})
 			return
 		}
+		product.HistoryRoot = proof.RootHash
+		product.HistorySize = proof.TreeSize
+	}
+
+	if product.HistoryRoot != proof.RootHash || product.HistorySize != proof.TreeSize {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product history does not match its stored root"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "History is valid"})
+	c.JSON(http.StatusOK, gin.H{
+		"product_id": product.ID,
+		"event": gin.H{
+			"id":                  event.ID,
+			"event_type":          event.EventType,
+			"created_at":          event.CreatedAt,
+			"event_hash":          event.EventHash,
+			"previous_event_hash": event.PreviousEventHash,
+		},
+		"history_root": product.HistoryRoot,
+		"proof":        proof,
+	})
 }
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupEvents prepares a database with a signing key and one product
+func setupEvents(t *testing.T) *models.Product {
+	t.Helper()
+	database := setupTestDB(t)
+	if err := utils.InitKeyring(database, filepath.Join(t.TempDir(), "keys")); err != nil {
+		t.Fatalf("init keyring: %v", err)
+	}
+	product := models.Product{SerialNumber: "SN-1", CurrentOwnerID: 1}
+	if err := database.Create(&product).Error; err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	return &product
+}
+
+// checkHistoryRoot compares the product's stored root with one computed
+// from its whole chain
+func checkHistoryRoot(t *testing.T, productID uint) {
+	t.Helper()
+	var product models.Product
+	if err := db.First(&product, productID).Error; err != nil {
+		t.Fatalf("load product: %v", err)
+	}
+	_, hashes, err := productEventHashes(db, productID)
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	if want := utils.ComputeMerkleRoot(hashes); product.HistoryRoot != want || product.HistorySize != len(hashes) {
+		t.Fatalf("stored root %s over %d events, want %s over %d", product.HistoryRoot, product.HistorySize, want, len(hashes))
+	}
+}
+
+func TestHistoryRootFollowsAppends(t *testing.T) {
+	product := setupEvents(t)
+
+	for i := 0; i < 13; i++ {
+		event := models.Event{ProductID: product.ID, EventType: "repair", EventData: fmt.Sprintf(`{"n":%d}`, i), CreatedBy: 1}
+		if err := appendEvent(&event); err != nil {
+			t.Fatalf("append event %d: %v", i, err)
+		}
+		checkHistoryRoot(t, product.ID)
+	}
+}
+
+func TestHistoryRootRecomputedWithoutFrontier(t *testing.T) {
+	product := setupEvents(t)
+	for i := 0; i < 5; i++ {
+		event := models.Event{ProductID: product.ID, EventType: "repair", EventData: fmt.Sprintf(`{"n":%d}`, i), CreatedBy: 1}
+		if err := appendEvent(&event); err != nil {
+			t.Fatalf("append event %d: %v", i, err)
+		}
+	}
+
+	// Products from before roots, or before frontiers, were stored
+	for _, stale := range []map[string]interface{}{
+		{"history_root": "", "history_size": 0, "history_frontier": ""},
+		{"history_frontier": ""},
+	} {
+		if err := db.Model(product).Updates(stale).Error; err != nil {
+			t.Fatalf("reset product: %v", err)
+		}
+		event := models.Event{ProductID: product.ID, EventType: "repair", EventData: `{"n":"next"}`, CreatedBy: 1}
+		if err := appendEvent(&event); err != nil {
+			t.Fatalf("append event: %v", err)
+		}
+		checkHistoryRoot(t, product.ID)
+	}
+}
+
+func TestSignedEventBeforeSigningKey(t *testing.T) {
+	product := setupEvents(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	actor := models.User{Username: "shop", Role: "repair_shop", PublicKey: base64.StdEncoding.EncodeToString(pub)}
+	if err := db.Create(&actor).Error; err != nil {
+		t.Fatalf("create actor: %v", err)
+	}
+	var key models.SigningKey
+	if err := db.Where("status = ?", utils.KeyStatusActive).First(&key).Error; err != nil {
+		t.Fatalf("load signing key: %v", err)
+	}
+
+	// Signed by the actor a moment before the server's only key existed
+	event := models.Event{
+		ProductID:   product.ID,
+		EventType:   "repair",
+		EventData:   `{"repair_details":"battery"}`,
+		CreatedBy:   actor.ID,
+		HashVersion: utils.CurrentEventHashVersion,
+	}
+	event.CreatedAt = key.ActivatedAt.Add(-time.Minute).Truncate(utils.EventTimestampPrecision)
+	payload, err := utils.EventHashPayload(utils.HashDataForEvent(&event))
+	if err != nil {
+		t.Fatalf("event payload: %v", err)
+	}
+	event.ActorSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload))
+
+	if err := appendEvent(&event); !errors.Is(err, errCreatedAtUnsignable) {
+		t.Errorf("append: got %v, want %v", err, errCreatedAtUnsignable)
+	}
+}
@@ -20,7 +20,7 @@ func GetPublicProductInfo(c *gin.Context) {
 	}
 
 	var events []models.Event
-	db.Where("product_id = ?", id).Order("created_at asc").Find(&events)
+	db.Where("product_id = ?", id).Order("sequence asc").Find(&events)
 
 	// Filter sensitive information from events
 	publicEvents := []gin.H{}
@@ -32,10 +32,20 @@ func GetPublicProductInfo(c *gin.Context) {
 		// Remove sensitive fields if present
 		delete(eventDataMap, "new_owner_id") // Hide actual owner IDs
 
+		// Actor-signed events carry a signature from the creator's own key;
+		// the rest are vouched for by the server signature alone
+		attestation := "server_attested"
+		if event.ActorSignature != "" {
+			attestation = "actor_signed"
+		} else if event.Signature == "" {
+			attestation = "unsigned"
+		}
+
 		publicEvent := gin.H{
-			"event_type": event.EventType,
-			"created_at": event.CreatedAt,
-			"event_hash": event.EventHash,
+			"event_type":  event.EventType,
+			"created_at":  event.CreatedAt,
+			"event_hash":  event.EventHash,
+			"attestation": attestation,
 		}
 
 		// Add simplified event data
@@ -45,6 +55,20 @@ func GetPublicProductInfo(c *gin.Context) {
 			publicEvent["details"] = "Product registered by manufacturer"
 		} else if event.EventType == "ownership_transfer" {
 			publicEvent["details"] = "Ownership transferred"
+		} else if event.EventType == "transfer_initiated" {
+			publicEvent["details"] = "Ownership transfer offered"
+		} else if event.EventType == "transfer_consent" {
+			publicEvent["details"] = "Co-owner answered a transfer offer"
+		} else if event.EventType == "consent_rule_changed" {
+			publicEvent["details"] = "Co-ownership consent rule changed"
+		} else if event.EventType == "transfer_paid" {
+			publicEvent["details"] = "Payment for transfer confirmed"
+		} else if event.EventType == "transfer_rejected" {
+			publicEvent["details"] = "Transfer offer declined"
+		} else if event.EventType == "transfer_cancelled" {
+			publicEvent["details"] = "Transfer offer withdrawn"
+		} else if event.EventType == "transfer_expired" {
+			publicEvent["details"] = "Transfer offer expired"
 		}
 
 		publicEvents = append(publicEvents, publicEvent)
@@ -58,43 +82,13 @@ func GetPublicProductInfo(c *gin.Context) {
 			"manufacturing_date": product.CreatedAt.Format("2006-01-02"),
 		},
 		"history":             publicEvents,
+		"history_root":        product.HistoryRoot,
 		"verification_status": "authentic", // You might want to calculate this
 	})
 }
 
 func GenerateProductQR(c *gin.Context){
 	productID := c.Param("id")
-	userID, _ := c.Get("user_id")
-	role,_ := c.Get("role")
-
-	// Only brands or current owners can generate QR codes
-	if role != "brand" {
-		// Check if user is current owner
-		isOwner := false
-			
-		// Get last ownership transfer event
-		var lastEvent models.Event
-		if err := db.Where("product_id = ? AND event_type = ?", productID, "ownership_transfer").
-			Order("created_at desc").First(&lastEvent).Error; err == nil {
-			var eventData map[string]interface{}
-			json.Unmarshal([]byte(lastEvent.EventData), &eventData)
-			if newOwnerID, ok := eventData["new_owner_id"].(float64); ok && uint(newOwnerID) == userID.(uint) {
-				isOwner = true
-			}
-		} else if err := db.Where("product_id = ? AND event_type = ?", productID, "registration").
-			First(&lastEvent).Error; err == nil {
-			// Initial owner is the brand that registered it
-			if lastEvent.CreatedBy == userID.(uint) {
-				isOwner = true
-			}
-		}
-			
-		if !isOwner {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Only product owners or manufacturers can generate QR codes"})
-			return
-		}
-	}
-
 	// generate the qr code
 	
 		baseURL := "https://localhost:5173/verify/"
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetSigningKeys lists every server signing key with its activation window so
+// that signatures can be checked independently
+func GetSigningKeys(c *gin.Context) {
+	var keys []models.SigningKey
+	if err := db.Order("activated_at asc").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch signing keys"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, gin.H{
+			"key_id":         key.KeyID,
+			"algorithm":      key.Algorithm,
+			"public_key":     key.PublicKey,
+			"status":         key.Status,
+			"activated_at":   key.ActivatedAt,
+			"deactivated_at": key.DeactivatedAt,
+			"retired_at":     key.RetiredAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": response})
+}
+
+// GetJWKS publishes the public keys that verify access tokens, so other
+// services can check them without calling back
+func GetJWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": utils.JWKS()})
+}
+
+// RotateSigningKey makes a fresh key active for new signatures
+func RotateSigningKey(c *gin.Context) {
+	key, err := utils.RotateSigningKey(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate signing key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Signing key rotated",
+		"key_id":       key.KeyID,
+		"activated_at": key.ActivatedAt,
+	})
+}
+
+// RetireSigningKey destroys an inactive key so it can no longer sign anything
+func RetireSigningKey(c *gin.Context) {
+	key, err := utils.RetireSigningKey(db, c.Param("kid"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Signing key not found"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Signing key retired",
+		"key_id":     key.KeyID,
+		"retired_at": key.RetiredAt,
+	})
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func checkpointResponse(cp models.Checkpoint) gin.H {
+	return gin.H{
+		"sequence":                 cp.Sequence,
+		"tree_size":                cp.TreeSize,
+		"root_hash":                cp.RootHash,
+		"previous_checkpoint_hash": cp.PreviousCheckpointHash,
+		"issued_at":                cp.IssuedAt.Unix(),
+		"checkpoint_hash":          cp.CheckpointHash,
+		"signature":                cp.Signature,
+		"key_id":                   cp.KeyID,
+		"body":                     string(utils.CheckpointBody(&cp)),
+	}
+}
+
+// findCheckpoint loads a checkpoint by sequence number, or the newest one for "latest"
+func findCheckpoint(c *gin.Context) (*models.Checkpoint, bool) {
+	var cp models.Checkpoint
+	var err error
+
+	seq := c.Param("seq")
+	if seq == "latest" {
+		err = db.Order("sequence desc").First(&cp).Error
+	} else {
+		n, parseErr := strconv.ParseUint(seq, 10, 32)
+		if parseErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checkpoint sequence"})
+			return nil, false
+		}
+		err = db.Where("sequence = ?", n).First(&cp).Error
+	}
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Checkpoint not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch checkpoint"})
+		}
+		return nil, false
+	}
+	return &cp, true
+}
+
+// GetCheckpoint returns a signed checkpoint of the transparency log
+func GetCheckpoint(c *gin.Context) {
+	cp, ok := findCheckpoint(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, checkpointResponse(*cp))
+}
+
+// GetCheckpointProductProof proves that a product's chain head was included in a checkpoint
+func GetCheckpointProductProof(c *gin.Context) {
+	cp, ok := findCheckpoint(c)
+	if !ok {
+		return
+	}
+
+	productID, err := strconv.ParseUint(c.Param("productId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	entry, proof, err := utils.BuildCheckpointProof(db, cp, uint(productID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product is not included in this checkpoint"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build checkpoint proof"})
+		}
+		return
+	}
+
+	var head models.Event
+	if err := db.Where("product_id = ?", productID).Order("sequence desc").First(&head).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product head"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"checkpoint":            checkpointResponse(*cp),
+		"product_id":            entry.ProductID,
+		"head_event_hash":       entry.HeadEventHash,
+		"leaf":                  utils.ProductHeadLeaf(entry.ProductID, entry.HeadEventHash),
+		"current_head":          head.EventHash,
+		"current_head_included": head.EventHash == entry.HeadEventHash,
+		"proof":                 proof,
+	})
+}
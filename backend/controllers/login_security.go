@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Every failed login gets this message, whatever the reason, so it does not
+// tell whether the username exists
+const invalidLoginMessage = "Invalid username or password"
+
+var (
+	// Per username: a few free tries, then doubling delays, then a lockout
+	accountLoginPolicy = utils.LoginThrottlePolicy{
+		FreeFailures:    3,
+		LockoutFailures: 10,
+		MaxDelay:        time.Minute,
+		Lockout:         15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+	// Per client IP: looser, since many users can share an address
+	ipLoginPolicy = utils.LoginThrottlePolicy{
+		FreeFailures:    20,
+		LockoutFailures: 100,
+		MaxDelay:        time.Minute,
+		Lockout:         15 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
+// dummyPasswordHash is checked when a username does not exist, so a failed
+// login takes as long whether or not it does
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// auditAuth records an authentication event along with the client it came
+// from. A failure to record is logged but does not fail the request.
+func auditAuth(c *gin.Context, event models.AuthEvent) {
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	if err := db.Create(&event).Error; err != nil {
+		fmt.Printf("Warning: Failed to record %s audit event: %v\n", event.Event, err)
+	}
+}
+
+// throttleKeys are the keys a login attempt for username is counted
+// against. An empty username, from a passkey that names no account, counts
+// against the client's address only.
+func throttleKeys(c *gin.Context, username string) []string {
+	if username == "" {
+		return []string{utils.IPThrottleKey(c.ClientIP())}
+	}
+	return []string{utils.AccountThrottleKey(username), utils.IPThrottleKey(c.ClientIP())}
+}
+
+// loginThrottled answers a login attempt for username that has to wait,
+// because of failures for the username or from the client's address
+func loginThrottled(c *gin.Context, username string) bool {
+	var wait time.Duration
+	for _, key := range throttleKeys(c, username) {
+		keyWait, err := utils.LoginWait(db, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			return true
+		}
+		if keyWait > wait {
+			wait = keyWait
+		}
+	}
+	if wait == 0 {
+		return false
+	}
+
+	retryAfter := int(wait.Round(time.Second).Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	auditAuth(c, models.AuthEvent{Event: "login_throttled", Username: username})
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many failed login attempts, please try again later",
+		"retry_after": retryAfter,
+	})
+	return true
+}
+
+// loginFailed answers a failed password login with the uniform message
+// after recording it. user is nil when the username does not exist.
+func loginFailed(c *gin.Context, username string, user *models.User, method, detail string) {
+	recordLoginFailure(c, username, user, method, detail)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": invalidLoginMessage})
+}
+
+// recordLoginFailure audits a failed login and counts it against the
+// username and the client's address
+func recordLoginFailure(c *gin.Context, username string, user *models.User, method, detail string) {
+	event := models.AuthEvent{Event: "login_failed", Username: username, Method: method, Detail: detail}
+	if user != nil {
+		event.UserID = &user.ID
+	}
+	auditAuth(c, event)
+
+	var locked bool
+	var err error
+	if username != "" {
+		locked, err = utils.RecordLoginFailure(db, utils.AccountThrottleKey(username), accountLoginPolicy)
+	}
+	if err == nil {
+		_, err = utils.RecordLoginFailure(db, utils.IPThrottleKey(c.ClientIP()), ipLoginPolicy)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to record failed login: %v\n", err)
+	}
+	if locked {
+		event.Event, event.Detail = "account_locked", ""
+		auditAuth(c, event)
+	}
+}
+
+// loginSucceeded audits a login that started a session and forgets the
+// username's earlier failures
+func loginSucceeded(c *gin.Context, user *models.User, method string) {
+	auditAuth(c, models.AuthEvent{Event: "login_succeeded", UserID: &user.ID, Username: user.Username, Method: method})
+	if err := utils.ClearLoginThrottle(db, utils.AccountThrottleKey(user.Username)); err != nil {
+		fmt.Printf("Warning: Failed to clear failed logins: %v\n", err)
+	}
+}
+
+// UnlockAccount lifts a lockout after failed logins before it expires
+func UnlockAccount(c *gin.Context) {
+	adminID := c.MustGet("user_id").(uint)
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := utils.ClearLoginThrottle(db, utils.AccountThrottleKey(user.Username)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock account"})
+		return
+	}
+	auditAuth(c, models.AuthEvent{Event: "account_unlocked", UserID: &user.ID, Username: user.Username, ActorID: &adminID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked", "user_id": user.ID})
+}
+
+// GetAuthEvents lists audited authentication events, newest first, filtered
+// by user_id, username, ip or event
+func GetAuthEvents(c *gin.Context) {
+	query := db.Model(&models.AuthEvent{})
+	for _, filter := range []string{"user_id", "username", "ip", "event"} {
+		if value := c.Query(filter); value != "" {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	var events []models.AuthEvent
+	if err := query.Order("id desc").Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load events"})
+		return
+	}
+
+	result := make([]gin.H, len(events))
+	for i, event := range events {
+		result[i] = gin.H{
+			"id":         event.ID,
+			"event":      event.Event,
+			"user_id":    event.UserID,
+			"username":   event.Username,
+			"ip":         event.IP,
+			"user_agent": event.UserAgent,
+			"method":     event.Method,
+			"detail":     event.Detail,
+			"actor_id":   event.ActorID,
+			"created_at": event.CreatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"events": result})
+}
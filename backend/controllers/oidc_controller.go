@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// How long a user has to sign in at the identity provider
+	oidcLoginTTL = 10 * time.Minute
+	// How long the frontend has to exchange the code the callback hands it
+	oidcLoginCodeTTL = time.Minute
+	// The cookie that ties a sign-in attempt to the browser that started it
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/api/auth/oidc"
+)
+
+var (
+	errNoBrandForDomain   = errors.New("no brand is registered for this email domain")
+	errAmbiguousDomain    = errors.New("several verified brands share this email domain")
+	errBrandNotVerified   = errors.New("the brand for this email domain is not verified")
+	errSSOAccountConflict = errors.New("an account with this username already exists")
+	errSSODomainMismatch  = errors.New("email no longer matches the organization's domain")
+)
+
+// OIDCLogin starts single sign-on: it remembers the PKCE verifier and nonce
+// for this attempt, binds its state to the browser with a cookie and sends
+// the browser to the identity provider
+func OIDCLogin(c *gin.Context) {
+	client, err := utils.OIDC()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	state, err := utils.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	nonce, err := utils.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	login := models.OIDCLogin{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: utils.NewPKCEVerifier(),
+		ExpiresAt:    time.Now().Add(oidcLoginTTL),
+	}
+
+	// Attempts that were abandoned at the provider are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCLogin{})
+	if err := db.Create(&login).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	authURL, err := client.AuthCodeURL(c.Request.Context(), login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+		return
+	}
+
+	// The provider returns the browser with a top-level GET, which Lax
+	// cookies survive
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, login.State, int(oidcLoginTTL.Seconds()), oidcCookiePath, "", client.CallbackIsHTTPS(), true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback finishes single sign-on: it exchanges the code for a verified
+// ID token, finds the brand member it belongs to and starts a session
+func OIDCCallback(c *gin.Context) {
+	client, err := utils.OIDC()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	if c.Query("error") != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in was refused by the identity provider: " + c.Query("error")})
+		return
+	}
+
+	// The attempt must have been started by this browser, or an attacker
+	// could sign the victim in to the attacker's account with their own code
+	state := c.Query("state")
+	cookieState, err := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, oidcCookiePath, "", client.CallbackIsHTTPS(), true)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign-in attempt was not started in this browser, please start again"})
+		return
+	}
+
+	// Each attempt can complete once
+	var login models.OIDCLogin
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state = ? AND expires_at > ?", state, time.Now()).First(&login).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&login).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign-in attempt is unknown or has expired, please start again"})
+		return
+	}
+
+	identity, err := client.Exchange(c.Request.Context(), c.Query("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		// The reason can describe the provider's setup, so it stays in the log
+		fmt.Printf("Warning: Single sign-on code exchange failed: %v\n", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in failed, please start again"})
+		return
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your identity provider has not verified your email address"})
+		return
+	}
+
+	user, err := linkOIDCUser(identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, errNoBrandForDomain), errors.Is(err, errAmbiguousDomain), errors.Is(err, errSSODomainMismatch):
+			c.JSON(http.StatusForbidden, gin.H{"error": "No verified brand can be matched to " + identity.Email})
+		case errors.Is(err, errBrandNotVerified):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Your brand is pending verification"})
+		case errors.Is(err, errSSOAccountConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "An account named " + identity.Email + " already exists"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		}
+		return
+	}
+
+	if !oidcAccountUsable(c, user) {
+		return
+	}
+
+	// Browsers land here from the identity provider, so the frontend gets a
+	// one-time code in the URL fragment and trades it for the tokens. The
+	// tokens themselves never appear in a URL, where history or a leaked
+	// Referer could keep them.
+	if postLogin := os.Getenv("OIDC_POST_LOGIN_URL"); postLogin != "" {
+		code, err := createOIDCLoginCode(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		fragment := url.Values{}
+		fragment.Set("code", code)
+		c.Redirect(http.StatusFound, postLogin+"#"+fragment.Encode())
+		return
+	}
+	finishOIDCLogin(c, user)
+}
+
+// oidcAccountUsable answers a sign-in to an account that may not log in,
+// and reports whether it may
+func oidcAccountUsable(c *gin.Context, user *models.User) bool {
+	verificationStatus, err := accountVerificationStatus(db, user)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your organization could not be found"})
+		return false
+	}
+	if msg := accountStatusError(user.Role, verificationStatus, user.SuspendedAt != nil); msg != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return false
+	}
+	return true
+}
+
+// finishOIDCLogin answers with the tokens of a new session, or with the
+// second factor challenge the user has to pass first
+func finishOIDCLogin(c *gin.Context, user *models.User) {
+	response, err := beginLogin(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	if response["mfa_required"] == nil {
+		loginSucceeded(c, user, "oidc")
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// createOIDCLoginCode returns a one-time code that finishes the user's
+// sign-in through ExchangeOIDCCode
+func createOIDCLoginCode(user *models.User) (string, error) {
+	code, err := utils.NewTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	// Codes the frontend never exchanged are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginCode{})
+	return code, db.Create(&models.OIDCLoginCode{
+		CodeHash:  utils.HashRefreshToken(code),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(oidcLoginCodeTTL),
+	}).Error
+}
+
+type OIDCExchangeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ExchangeOIDCCode finishes single sign-on with the one-time code the
+// callback put in the frontend's URL fragment
+func ExchangeOIDCCode(c *gin.Context) {
+	var input OIDCExchangeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Each code can be exchanged once, even by concurrent requests
+	var code models.OIDCLoginCode
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("code_hash = ? AND expires_at > ?", utils.HashRefreshToken(input.Code), time.Now()).
+			First(&code).Error; err != nil {
+			return err
+		}
+		claim := tx.Unscoped().Where("id = ?", code.ID).Delete(&models.OIDCLoginCode{})
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.First(&user, code.UserID).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign-in code is unknown or has expired, please start again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	// The account may have been suspended since the callback
+	if !oidcAccountUsable(c, &user) {
+		return
+	}
+	finishOIDCLogin(c, &user)
+}
+
+// linkOIDCUser returns the brand member a verified identity belongs to. A
+// returning user is found by their subject at the provider. Otherwise the
+// email's domain picks the organization, using the same check RegisterBrand
+// applies to a brand's contact email: an existing member with that email is
+// linked, and anyone else joins as a viewer whom an owner can promote.
+func linkOIDCUser(identity *utils.OIDCIdentity) (*models.User, error) {
+	var user models.User
+	err := db.Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).First(&user).Error
+	if err == nil {
+		var org models.Organization
+		if user.OrganizationID == nil || db.First(&org, *user.OrganizationID).Error != nil ||
+			!utils.EmailInDomain(identity.Email, org.OfficialDomain) {
+			return nil, errSSODomainMismatch
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	org, err := organizationForEmail(identity.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("organization_id = ? AND LOWER(contact_email) = ? AND organization_role <> '' AND oidc_subject = ''", org.ID, identity.Email).
+			First(&user).Error
+		if err == nil {
+			return tx.Model(&user).Updates(map[string]interface{}{
+				"oidc_issuer":  identity.Issuer,
+				"oidc_subject": identity.Subject,
+			}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var taken int64
+		if err := tx.Model(&models.User{}).Unscoped().Where("username = ?", identity.Email).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return errSSOAccountConflict
+		}
+		user = models.User{
+			Username:         identity.Email,
+			Role:             "brand",
+			ContactEmail:     identity.Email,
+			OrganizationID:   &org.ID,
+			OrganizationRole: OrgRoleViewer,
+			OIDCIssuer:       identity.Issuer,
+			OIDCSubject:      identity.Subject,
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// organizationForEmail finds the verified brand whose official domain an
+// email belongs to
+func organizationForEmail(email string) (*models.Organization, error) {
+	domain := email[strings.LastIndex(email, "@")+1:]
+
+	var orgs []models.Organization
+	if err := db.Where("LOWER(official_domain) = ?", strings.ToLower(domain)).Order("id asc").Find(&orgs).Error; err != nil {
+		return nil, err
+	}
+
+	var verified []models.Organization
+	for _, org := range orgs {
+		if org.VerificationStatus == "verified" && utils.EmailInDomain(email, org.OfficialDomain) {
+			verified = append(verified, org)
+		}
+	}
+	switch {
+	case len(verified) == 1:
+		return &verified[0], nil
+	case len(verified) > 1:
+		return nil, errAmbiguousDomain
+	case len(orgs) > 0:
+		return nil, errBrandNotVerified
+	}
+	return nil, errNoBrandForDomain
+}
@@ -0,0 +1,423 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	testOIDCClientID     = "veriown"
+	testOIDCClientSecret = "test-secret"
+	testOIDCRedirectURL  = "http://localhost:8080/api/auth/oidc/callback"
+)
+
+// mockIdP is an OpenID Connect provider that issues codes without a sign-in
+// page and checks PKCE the way a real provider does. audience and nonce,
+// when set, replace the claims it would otherwise put in ID tokens.
+type mockIdP struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	audience string
+	nonce    string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	subject       string
+	email         string
+	nonce         string
+	codeChallenge string
+}
+
+// setupMockIdP starts a provider and points the OIDC client at it
+func setupMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	p := &mockIdP{t: t, key: key, codes: map[string]mockAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	if err := utils.InitOIDC(utils.OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCClientSecret,
+		RedirectURL:  testOIDCRedirectURL,
+	}); err != nil {
+		t.Fatalf("init OIDC: %v", err)
+	}
+	t.Cleanup(func() { utils.InitOIDC(utils.OIDCConfig{}) })
+	return p
+}
+
+// authorize stands in for the user signing in at the provider: it checks
+// the request the backend sent the browser with and returns the code the
+// provider would redirect back with
+func (p *mockIdP) authorize(authURL *url.URL, subject, email string) string {
+	p.t.Helper()
+	query := authURL.Query()
+	if !strings.HasPrefix(authURL.String(), p.server.URL+"/authorize") {
+		p.t.Fatalf("login redirected to %s", authURL)
+	}
+	if query.Get("client_id") != testOIDCClientID || query.Get("redirect_uri") != testOIDCRedirectURL {
+		p.t.Fatalf("unexpected client in %s", authURL)
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		p.t.Fatalf("no PKCE challenge in %s", authURL)
+	}
+	if query.Get("nonce") == "" {
+		p.t.Fatalf("no nonce in %s", authURL)
+	}
+
+	code, err := utils.NewTokenID()
+	if err != nil {
+		p.t.Fatalf("code: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codes[code] = mockAuthorization{
+		subject:       subject,
+		email:         email,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	return code
+}
+
+func (p *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            p.server.URL,
+		"aud":            testOIDCClientID,
+		"sub":            auth.subject,
+		"email":          auth.email,
+		"email_verified": true,
+		"nonce":          auth.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+	}
+	if p.audience != "" {
+		claims["aud"] = p.audience
+	}
+	if p.nonce != "" {
+		claims["nonce"] = p.nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func oidcRouter() *gin.Engine {
+	r := gin.New()
+	r.GET("/api/auth/oidc/login", OIDCLogin)
+	r.GET("/api/auth/oidc/callback", OIDCCallback)
+	return r
+}
+
+// startOIDCLogin starts a sign-in and returns where the browser was sent
+// and the state cookie it was given
+func startOIDCLogin(t *testing.T, r *gin.Engine) (*url.URL, *http.Cookie) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", recorder.Code, recorder.Body.String())
+	}
+	authURL, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("login redirect: %v", err)
+	}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return authURL, cookie
+		}
+	}
+	t.Fatalf("login set no %s cookie", oidcStateCookie)
+	return nil, nil
+}
+
+// oidcCallback returns the browser to the backend with code and state,
+// carrying cookie when it is not nil
+func oidcCallback(t *testing.T, r *gin.Engine, cookie *http.Cookie, code, state string) (int, gin.H) {
+	t.Helper()
+	query := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+
+	var response gin.H
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode callback response %q: %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, response
+}
+
+// setupOIDCBrand creates a verified brand signing in with example.com
+// addresses
+func setupOIDCBrand(t *testing.T, database *gorm.DB) *models.Organization {
+	t.Helper()
+	account := models.User{Username: "acme", Role: "brand"}
+	if err := database.Create(&account).Error; err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	org := models.Organization{CompanyName: "Acme", OfficialDomain: "example.com", VerificationStatus: "verified", AccountUserID: account.ID}
+	if err := database.Create(&org).Error; err != nil {
+		t.Fatalf("create organization: %v", err)
+	}
+	return &org
+}
+
+func TestOIDCLoginRoundTrip(t *testing.T) {
+	database := setupTestDB(t)
+	org := setupOIDCBrand(t, database)
+	idp := setupMockIdP(t)
+	r := oidcRouter()
+
+	authURL, cookie := startOIDCLogin(t, r)
+	state := authURL.Query().Get("state")
+	if cookie.Value != state || !cookie.HttpOnly || cookie.Path != oidcCookiePath {
+		t.Fatalf("state cookie %+v does not bind state %q", cookie, state)
+	}
+	var login models.OIDCLogin
+	if err := database.Where("state = ?", state).First(&login).Error; err != nil {
+		t.Fatalf("attempt not stored: %v", err)
+	}
+	challenge := sha256.Sum256([]byte(login.CodeVerifier))
+	if authURL.Query().Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		t.Fatal("PKCE challenge is not derived from the stored verifier")
+	}
+	if authURL.Query().Get("nonce") != login.Nonce {
+		t.Fatal("nonce sent to the provider is not the stored one")
+	}
+
+	code := idp.authorize(authURL, "subject-1", "Jane@Example.com")
+	status, response := oidcCallback(t, r, cookie, code, state)
+	if status != http.StatusOK || response["mfa_required"] != true {
+		t.Fatalf("callback: %d %v", status, response)
+	}
+
+	var user models.User
+	if err := database.Where("oidc_subject = ?", "subject-1").First(&user).Error; err != nil {
+		t.Fatalf("user not created: %v", err)
+	}
+	if user.Username != "jane@example.com" || user.OIDCIssuer != idp.server.URL ||
+		user.OrganizationID == nil || *user.OrganizationID != org.ID || user.OrganizationRole != OrgRoleViewer {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	if database.Where("state = ?", state).First(&models.OIDCLogin{}).Error == nil {
+		t.Fatal("attempt was not deleted once used")
+	}
+}
+
+func TestOIDCCallbackRefusesState(t *testing.T) {
+	database := setupTestDB(t)
+	setupOIDCBrand(t, database)
+	idp := setupMockIdP(t)
+	r := oidcRouter()
+
+	authURL, cookie := startOIDCLogin(t, r)
+	state := authURL.Query().Get("state")
+	otherURL, otherCookie := startOIDCLogin(t, r)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		state  string
+	}{
+		{"no cookie", nil, state},
+		{"another browser's cookie", otherCookie, state},
+		{"no state", cookie, ""},
+	}
+	for _, tt := range tests {
+		code := idp.authorize(authURL, "subject-1", "jane@example.com")
+		if status, response := oidcCallback(t, r, tt.cookie, code, tt.state); status != http.StatusBadRequest {
+			t.Errorf("%s: %d %v", tt.name, status, response)
+		}
+	}
+
+	code := idp.authorize(authURL, "subject-1", "jane@example.com")
+	if status, response := oidcCallback(t, r, cookie, code, state); status != http.StatusOK {
+		t.Fatalf("callback: %d %v", status, response)
+	}
+	code = idp.authorize(authURL, "subject-1", "jane@example.com")
+	if status, response := oidcCallback(t, r, cookie, code, state); status != http.StatusBadRequest {
+		t.Fatalf("reused state: %d %v", status, response)
+	}
+
+	// A verifier other than the one the challenge was made from is refused
+	// by the provider
+	otherState := otherURL.Query().Get("state")
+	if err := database.Model(&models.OIDCLogin{}).Where("state = ?", otherState).
+		Update("code_verifier", utils.NewPKCEVerifier()).Error; err != nil {
+		t.Fatalf("replace verifier: %v", err)
+	}
+	code = idp.authorize(otherURL, "subject-1", "jane@example.com")
+	if status, response := oidcCallback(t, r, otherCookie, code, otherState); status != http.StatusUnauthorized {
+		t.Fatalf("wrong PKCE verifier: %d %v", status, response)
+	}
+}
+
+func TestOIDCCallbackRefusesIDToken(t *testing.T) {
+	database := setupTestDB(t)
+	setupOIDCBrand(t, database)
+	idp := setupMockIdP(t)
+	r := oidcRouter()
+
+	tests := []struct {
+		name     string
+		audience string
+		nonce    string
+	}{
+		{"wrong audience", "another-client", ""},
+		{"wrong nonce", "", "another-nonce"},
+	}
+	for _, tt := range tests {
+		idp.audience, idp.nonce = tt.audience, tt.nonce
+		authURL, cookie := startOIDCLogin(t, r)
+		code := idp.authorize(authURL, "subject-1", "jane@example.com")
+		if status, response := oidcCallback(t, r, cookie, code, authURL.Query().Get("state")); status != http.StatusUnauthorized {
+			t.Errorf("%s: %d %v", tt.name, status, response)
+		}
+	}
+
+	var users int64
+	database.Model(&models.User{}).Where("oidc_subject <> ''").Count(&users)
+	if users != 0 {
+		t.Fatalf("%d users were linked from refused tokens", users)
+	}
+}
+
+func TestLinkOIDCUser(t *testing.T) {
+	database := setupTestDB(t)
+	org := setupOIDCBrand(t, database)
+	issuer := "https://idp.example.com"
+
+	member := models.User{Username: "jane", Role: "brand", ContactEmail: "Jane@example.com", OrganizationID: &org.ID, OrganizationRole: OrgRoleOwner}
+	if err := database.Create(&member).Error; err != nil {
+		t.Fatalf("create member: %v", err)
+	}
+
+	// An existing member is linked by their email the first time
+	user, err := linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "jane-sub", Email: "jane@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatalf("link existing member: %v", err)
+	}
+	if user.ID != member.ID || user.OrganizationRole != OrgRoleOwner {
+		t.Fatalf("linked %+v instead of member %d", user, member.ID)
+	}
+	var stored models.User
+	database.First(&stored, member.ID)
+	if stored.OIDCIssuer != issuer || stored.OIDCSubject != "jane-sub" {
+		t.Fatalf("member not linked: %+v", stored)
+	}
+
+	// and by their subject afterwards, whatever their email has become
+	// within the domain
+	user, err = linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "jane-sub", Email: "j.doe@example.com", EmailVerified: true})
+	if err != nil || user.ID != member.ID {
+		t.Fatalf("returning member: %v %+v", err, user)
+	}
+	if _, err := linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "jane-sub", Email: "jane@elsewhere.com", EmailVerified: true}); !errors.Is(err, errSSODomainMismatch) {
+		t.Fatalf("returning member outside the domain: %v", err)
+	}
+
+	// Anyone else in the domain joins as a viewer
+	user, err = linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "bob-sub", Email: "bob@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatalf("link new user: %v", err)
+	}
+	if user.ID == member.ID || user.Username != "bob@example.com" || user.OrganizationRole != OrgRoleViewer ||
+		user.OrganizationID == nil || *user.OrganizationID != org.ID {
+		t.Fatalf("unexpected new user %+v", user)
+	}
+
+	if _, err := linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "eve-sub", Email: "eve@unknown.com", EmailVerified: true}); !errors.Is(err, errNoBrandForDomain) {
+		t.Fatalf("unknown domain: %v", err)
+	}
+	if _, err := linkOIDCUser(&utils.OIDCIdentity{Issuer: issuer, Subject: "other-bob", Email: "bob@example.com", EmailVerified: true}); !errors.Is(err, errSSOAccountConflict) {
+		t.Fatalf("taken username: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Roles of a user within an organization
+const (
+	OrgRoleOwner            = "owner"             // manages members and the organization's products
+	OrgRoleProductRegistrar = "product_registrar" // registers products and logs events on them
+	OrgRoleViewer           = "viewer"            // read-only access
+)
+
+// Usernames of organization accounts; users cannot register them
+const orgAccountPrefix = "org:"
+
+var errLastOwner = errors.New("an organization needs at least one owner")
+
+func validOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleProductRegistrar || role == OrgRoleViewer
+}
+
+// ResolvePrincipal runs after the auth middleware and works out on whose
+// behalf the request acts. Organization members act for their organization's
+// account; everyone else acts for themselves. It also refuses suspended
+// accounts and brands and repair shops that are no longer verified, and
+// replaces the token's role with the stored one.
+func ResolvePrincipal() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		acct, err := loadAccount(c.MustGet("user_id").(uint))
+		if err != nil {
+			respondAccountError(c, err)
+			c.Abort()
+			return
+		}
+		if msg := accountStatusError(acct.role, acct.verificationStatus, acct.suspended); msg != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": msg})
+			c.Abort()
+			return
+		}
+
+		c.Set("role", acct.role)
+		c.Set("verification_status", acct.verificationStatus)
+		if acct.organizationID != nil {
+			c.Set("organization_id", *acct.organizationID)
+			c.Set("organization_role", acct.organizationRole)
+		}
+		c.Set("principal_id", acct.principalID)
+		c.Next()
+	}
+}
+
+// principalID returns the account the request acts for in ownership matters
+func principalID(c *gin.Context) uint {
+	return c.MustGet("principal_id").(uint)
+}
+
+// hasOrgRole reports whether the user may act for their organization in one
+// of the given roles. Users outside an organization act for themselves and
+// always may.
+func hasOrgRole(c *gin.Context, roles ...string) bool {
+	if _, ok := c.Get("organization_id"); !ok {
+		return true
+	}
+	role := c.GetString("organization_role")
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+type OrganizationMemberInput struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+	// Email links the member to their single sign-on identity and must be
+	// in the organization's official domain
+	Email string `json:"email"`
+}
+
+type OrganizationRoleInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// GetOrganization returns the current user's organization and its members
+func GetOrganization(c *gin.Context) {
+	orgID := c.MustGet("organization_id")
+
+	var org models.Organization
+	if err := db.First(&org, orgID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	var members []models.User
+	if err := db.Where("organization_id = ? AND organization_role <> ''", org.ID).Order("id asc").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+
+	memberList := make([]gin.H, 0, len(members))
+	for _, member := range members {
+		memberList = append(memberList, gin.H{
+			"user_id":  member.ID,
+			"username": member.Username,
+			"role":     member.OrganizationRole,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                  org.ID,
+		"company_name":        org.CompanyName,
+		"tax_id":              org.TaxID,
+		"contact_email":       org.ContactEmail,
+		"official_domain":     org.OfficialDomain,
+		"verification_status": org.VerificationStatus,
+		"account_user_id":     org.AccountUserID,
+		"members":             memberList,
+	})
+}
+
+// AddOrganizationMember creates a login for a new member of the owner's
+// organization
+func AddOrganizationMember(c *gin.Context) {
+	orgID := c.MustGet("organization_id")
+
+	var input OrganizationMemberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validOrgRole(input.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, product_registrar or viewer"})
+		return
+	}
+	if strings.HasPrefix(input.Username, orgAccountPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames starting with " + orgAccountPrefix + " are reserved"})
+		return
+	}
+	if !passwordAccepted(c, input.Password, input.Username) {
+		return
+	}
+
+	id := orgID.(uint)
+	if input.Email != "" {
+		var org models.Organization
+		if err := db.First(&org, id).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organization"})
+			return
+		}
+		if !utils.EmailInDomain(input.Email, org.OfficialDomain) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email must match the official domain"})
+			return
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	member := models.User{
+		Username:         input.Username,
+		PasswordHash:     string(hash),
+		Role:             "brand",
+		ContactEmail:     strings.ToLower(input.Email),
+		OrganizationID:   &id,
+		OrganizationRole: input.Role,
+	}
+	if err := db.Create(&member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Member added",
+		"user_id": member.ID,
+	})
+}
+
+// changeMember applies change to a member of the owner's organization, making
+// sure the organization keeps at least one owner
+func changeMember(c *gin.Context, change func(tx *gorm.DB, member *models.User) error) error {
+	orgID := c.MustGet("organization_id")
+	return db.Transaction(func(tx *gorm.DB) error {
+		var member models.User
+		if err := tx.Where("id = ? AND organization_id = ? AND organization_role <> ''", c.Param("userId"), orgID).
+			First(&member).Error; err != nil {
+			return err
+		}
+		if err := change(tx, &member); err != nil {
+			return err
+		}
+
+		var owners int64
+		if err := tx.Model(&models.User{}).
+			Where("organization_id = ? AND organization_role = ?", orgID, OrgRoleOwner).Count(&owners).Error; err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errLastOwner
+		}
+		return nil
+	})
+}
+
+func respondMemberError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+	case errors.Is(err, errLastOwner):
+		c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " member"})
+	}
+}
+
+// UpdateOrganizationMember changes a member's role
+func UpdateOrganizationMember(c *gin.Context) {
+	var input OrganizationRoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validOrgRole(input.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, product_registrar or viewer"})
+		return
+	}
+
+	err := changeMember(c, func(tx *gorm.DB, member *models.User) error {
+		return tx.Model(member).Update("organization_role", input.Role).Error
+	})
+	if err != nil {
+		respondMemberError(c, err, "update")
+		return
+	}
+	forgetAccounts()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member role updated"})
+}
+
+// RemoveOrganizationMember deletes a member's login. The organization's
+// products are unaffected; they belong to the organization's account.
+func RemoveOrganizationMember(c *gin.Context) {
+	err := changeMember(c, func(tx *gorm.DB, member *models.User) error {
+		// The login of a brand that predates organizations is also the
+		// organization's account and cannot go
+		var org models.Organization
+		if err := tx.First(&org, *member.OrganizationID).Error; err != nil {
+			return err
+		}
+		if org.AccountUserID == member.ID {
+			return tx.Model(member).Update("organization_role", OrgRoleViewer).Error
+		}
+		return tx.Delete(member).Error
+	})
+	if err != nil {
+		respondMemberError(c, err, "remove")
+		return
+	}
+	forgetAccounts()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// VerifyOrganization records the admin's decision on an organization's
+// brand verification
+func VerifyOrganization(c *gin.Context) {
+	input, ok := bindVerificationInput(c)
+	if !ok {
+		return
+	}
+
+	var org models.Organization
+	if err := db.First(&org, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	// Decided for the organization as a whole, not through a member
+	adminID := c.MustGet("user_id").(uint)
+	var decision *models.VerificationDecision
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		decision, err = decideVerification(tx, &models.User{OrganizationID: &org.ID}, &adminID, input.Status, input.Reason, input.Notes)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update verification status"})
+		return
+	}
+	forgetAccounts()
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Organization verification status updated",
+		"decision": verificationDecisionJSON(*decision),
+	})
+}
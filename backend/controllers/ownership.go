@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+var (
+	errNotCurrentOwner = errors.New("only an owner of the product can do this")
+	errShareTooLarge   = errors.New("offered share is larger than the sender's holding")
+)
+
+// currentOwnerID is the one place handlers learn who owns a product. It reads
+// Product.CurrentOwnerID, which only registration and an accepted transfer
+// write; cmd/check-ownership compares it against the event chain. For a
+// co-owned product it is the holder of the largest share.
+func currentOwnerID(tx *gorm.DB, productID interface{}) (uint, error) {
+	var product models.Product
+	if err := tx.Select("id", "current_owner_id").First(&product, productID).Error; err != nil {
+		return 0, err
+	}
+	return product.CurrentOwnerID, nil
+}
+
+// ownerShare returns the share of the product userID holds, in basis points
+func ownerShare(tx *gorm.DB, productID interface{}, userID uint) (int, error) {
+	var product models.Product
+	if err := tx.Select("id").First(&product, productID).Error; err != nil {
+		return 0, err
+	}
+
+	var owner models.ProductOwner
+	err := tx.Where("product_id = ? AND user_id = ?", product.ID, userID).First(&owner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return owner.Share, err
+}
+
+// isCurrentOwner reports whether userID holds any share of the product
+func isCurrentOwner(tx *gorm.DB, productID interface{}, userID uint) (bool, error) {
+	share, err := ownerShare(tx, productID, userID)
+	return share > 0, err
+}
+
+// moveShare records an accepted offer: the sender's share (or the whole
+// product, for offers made before co-ownership) goes to the recipient. It is
+// called only from the transfer flow, inside the transaction that logs the
+// change.
+func moveShare(tx *gorm.DB, transfer *models.PendingTransfer) error {
+	shares, err := utils.ProductShares(tx, transfer.ProductID)
+	if err != nil {
+		return err
+	}
+
+	if transfer.Share == 0 {
+		shares = map[uint]int{transfer.NewOwnerID: utils.FullShare}
+	} else {
+		if shares[transfer.InitiatedBy] < transfer.Share {
+			return errShareTooLarge
+		}
+		shares[transfer.InitiatedBy] -= transfer.Share
+		if shares[transfer.InitiatedBy] == 0 {
+			delete(shares, transfer.InitiatedBy)
+		}
+		shares[transfer.NewOwnerID] += transfer.Share
+	}
+	return utils.SetProductShares(tx, transfer.ProductID, shares)
+}
+
+// transferEventData describes an offer in the events logged for it. Share
+// offers also name the sender and the share, which is what lets
+// utils.SharesFromChain replay co-ownership from the chain.
+func transferEventData(transfer *models.PendingTransfer) string {
+	if transfer.Share == 0 {
+		return fmt.Sprintf(`{"transfer_id": %d, "new_owner_id": %d}`, transfer.ID, transfer.NewOwnerID)
+	}
+	return fmt.Sprintf(`{"transfer_id": %d, "new_owner_id": %d, "from_owner_id": %d, "share_bp": %d}`,
+		transfer.ID, transfer.NewOwnerID, transfer.InitiatedBy, transfer.Share)
+}
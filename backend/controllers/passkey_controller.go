@@ -0,0 +1,430 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+var errCeremonyInvalid = errors.New("invalid passkey ceremony")
+
+// passkeyUser presents a user and their passkeys to the WebAuthn library
+type passkeyUser struct {
+	user     *models.User
+	passkeys []models.Passkey
+}
+
+func (u *passkeyUser) WebAuthnID() []byte          { return []byte(u.user.WebAuthnHandle) }
+func (u *passkeyUser) WebAuthnName() string        { return u.user.Username }
+func (u *passkeyUser) WebAuthnDisplayName() string { return u.user.Username }
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, passkey := range u.passkeys {
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range strings.Split(passkey.Transports, ",") {
+			if transport != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+		credentials[i] = webauthn.Credential{
+			ID:              passkey.CredentialID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+// loadPasskeyUser loads a user with their passkeys
+func loadPasskeyUser(tx *gorm.DB, user *models.User) (*passkeyUser, error) {
+	var passkeys []models.Passkey
+	if err := tx.Where("user_id = ?", user.ID).Find(&passkeys).Error; err != nil {
+		return nil, err
+	}
+	return &passkeyUser{user: user, passkeys: passkeys}, nil
+}
+
+// startCeremony remembers the challenge of a registration or login until
+// the browser answers it, and returns the token the answer must carry
+func startCeremony(kind string, userID uint, session *webauthn.SessionData) (string, error) {
+	token, err := utils.NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	// Ceremonies the browser never answered are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.PasskeyCeremony{})
+	err = db.Create(&models.PasskeyCeremony{
+		TokenHash:   utils.HashRefreshToken(token),
+		Kind:        kind,
+		UserID:      userID,
+		SessionData: string(data),
+		ExpiresAt:   session.Expires,
+	}).Error
+	return token, err
+}
+
+// finishCeremony consumes a ceremony, so each challenge is answered once
+func finishCeremony(kind, token string) (*models.PasskeyCeremony, *webauthn.SessionData, error) {
+	var ceremony models.PasskeyCeremony
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("token_hash = ? AND kind = ? AND expires_at > ?", utils.HashRefreshToken(token), kind, time.Now()).
+			First(&ceremony).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&ceremony).Error
+	})
+	if err != nil {
+		return nil, nil, errCeremonyInvalid
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(ceremony.SessionData), &session); err != nil {
+		return nil, nil, err
+	}
+	return &ceremony, &session, nil
+}
+
+// BeginPasskeyRegistration returns the options the browser passes to
+// navigator.credentials.create to make a passkey for the current user
+func BeginPasskeyRegistration(c *gin.Context) {
+	rp, err := utils.WebAuthn()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Passkeys are not available"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.WebAuthnHandle == "" {
+		handle, err := utils.NewTokenID()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+			return
+		}
+		// A concurrent registration may have set the handle first
+		err = db.Model(&models.User{}).Where("id = ? AND web_authn_handle = ''", user.ID).
+			Update("web_authn_handle", handle).Error
+		if err == nil {
+			err = db.First(&user, user.ID).Error
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+			return
+		}
+	}
+	pkUser, err := loadPasskeyUser(db, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+		return
+	}
+
+	// A passkey must be discoverable, so login needs no username, and must
+	// verify the user, since it replaces the password
+	options, session, err := rp.BeginRegistration(pkUser,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(webauthn.Credentials(pkUser.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+		return
+	}
+	token, err := startCeremony(ceremonyRegistration, user.ID, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ceremony_token": token,
+		"options":        options,
+	})
+}
+
+type PasskeyRegistrationInput struct {
+	CeremonyToken string          `json:"ceremony_token" binding:"required"`
+	Name          string          `json:"name"`
+	Credential    json.RawMessage `json:"credential" binding:"required"` // The PublicKeyCredential from the browser
+}
+
+// FinishPasskeyRegistration verifies the browser's new credential and
+// stores it as a passkey of the current user
+func FinishPasskeyRegistration(c *gin.Context) {
+	rp, err := utils.WebAuthn()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Passkeys are not available"})
+		return
+	}
+
+	var input PasskeyRegistrationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.MustGet("user_id").(uint)
+	ceremony, session, err := finishCeremony(ceremonyRegistration, input.CeremonyToken)
+	if err != nil || ceremony.UserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration is unknown or has expired, please start again"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pkUser, err := loadPasskeyUser(db, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register passkey"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(input.Credential))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid passkey credential: " + protocolErrorDetails(err)})
+		return
+	}
+	credential, err := rp.CreateCredential(pkUser, *session, parsed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey verification failed: " + protocolErrorDetails(err)})
+		return
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+	if input.Name == "" {
+		input.Name = "Passkey"
+	}
+	passkey := models.Passkey{
+		UserID:          user.ID,
+		Name:            input.Name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := db.Create(&passkey).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This passkey is already registered"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Passkey registered",
+		"passkey_id": passkey.ID,
+	})
+}
+
+// GetPasskeys lists the current user's passkeys
+func GetPasskeys(c *gin.Context) {
+	var passkeys []models.Passkey
+	if err := db.Where("user_id = ?", c.MustGet("user_id")).Order("id asc").Find(&passkeys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load passkeys"})
+		return
+	}
+
+	result := make([]gin.H, len(passkeys))
+	for i, passkey := range passkeys {
+		result[i] = gin.H{
+			"id":           passkey.ID,
+			"name":         passkey.Name,
+			"synced":       passkey.BackupState,
+			"created_at":   passkey.CreatedAt,
+			"last_used_at": passkey.LastUsedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"passkeys": result})
+}
+
+// DeletePasskey removes one of the current user's passkeys
+func DeletePasskey(c *gin.Context) {
+	result := db.Unscoped().Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("user_id")).Delete(&models.Passkey{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete passkey"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Passkey deleted"})
+}
+
+// BeginPasskeyLogin returns the options the browser passes to
+// navigator.credentials.get. No username is needed: the passkey the user
+// picks names its account.
+func BeginPasskeyLogin(c *gin.Context) {
+	rp, err := utils.WebAuthn()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Passkeys are not available"})
+		return
+	}
+
+	options, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey login"})
+		return
+	}
+	token, err := startCeremony(ceremonyLogin, 0, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey login"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ceremony_token": token,
+		"options":        options,
+	})
+}
+
+type PasskeyLoginInput struct {
+	CeremonyToken string          `json:"ceremony_token" binding:"required"`
+	Credential    json.RawMessage `json:"credential" binding:"required"` // The PublicKeyCredential from the browser
+}
+
+// FinishPasskeyLogin verifies the browser's assertion and starts a session,
+// the same one a password login starts
+func FinishPasskeyLogin(c *gin.Context) {
+	rp, err := utils.WebAuthn()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Passkeys are not available"})
+		return
+	}
+
+	var input PasskeyLoginInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(input.Credential))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid passkey assertion: " + protocolErrorDetails(err)})
+		return
+	}
+
+	// The authenticator names the account by the user handle it stored.
+	// Failed assertions are throttled like wrong passwords, per account when
+	// the handle names one and per client address always.
+	var user *models.User
+	username := ""
+	if handle := string(parsed.Response.UserHandle); handle != "" {
+		var found models.User
+		err := db.Where("web_authn_handle = ?", handle).First(&found).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		if err == nil {
+			user, username = &found, found.Username
+		}
+	}
+	if loginThrottled(c, username) {
+		return
+	}
+
+	_, session, err := finishCeremony(ceremonyLogin, input.CeremonyToken)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey login is unknown or has expired, please start again"})
+		return
+	}
+
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if user == nil || string(userHandle) != user.WebAuthnHandle {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return loadPasskeyUser(db, user)
+	}
+	_, credential, err := rp.ValidatePasskeyLogin(findUser, *session, parsed)
+	if err != nil {
+		recordLoginFailure(c, username, user, "passkey", protocolErrorDetails(err))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey login failed"})
+		return
+	}
+	// A signature counter that went backwards means two copies of the key
+	if credential.Authenticator.CloneWarning {
+		recordLoginFailure(c, username, user, "passkey", "signature counter went backwards")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "This passkey may have been copied; sign in with your password and replace it"})
+		return
+	}
+
+	if err := db.Model(&models.Passkey{}).Where("user_id = ? AND credential_id = ?", user.ID, credential.ID).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": time.Now(),
+		}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	if msg := accountStatusError(user.Role, user.VerificationStatus, user.SuspendedAt != nil); msg != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return
+	}
+	// Passkeys are for regular users. A passkey verifies the user on the
+	// device, so it is not followed by the second factor step.
+	if user.Role != "regular" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Passkey login is only available to regular users"})
+		return
+	}
+
+	response, err := startSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	loginSucceeded(c, user, "passkey")
+	c.JSON(http.StatusOK, response)
+}
+
+// protocolErrorDetails explains why the WebAuthn library refused a response
+func protocolErrorDetails(err error) string {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) && protocolErr.Details != "" {
+		return protocolErr.Details
+	}
+	return err.Error()
+}
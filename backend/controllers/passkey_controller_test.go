@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+)
+
+const testOrigin = "http://localhost:5173"
+
+// virtualAuthenticator answers WebAuthn ceremonies the way a platform
+// authenticator holding one P-256 passkey would
+type virtualAuthenticator struct {
+	t            *testing.T
+	rpID         string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newVirtualAuthenticator(t *testing.T, rpID string) *virtualAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &virtualAuthenticator{t: t, rpID: rpID, key: key, credentialID: credentialID}
+}
+
+var b64 = base64.RawURLEncoding
+
+// challenge pulls the challenge out of the options a Begin endpoint returned
+func challenge(t *testing.T, response gin.H) string {
+	t.Helper()
+	publicKey, _ := response["options"].(map[string]interface{})["publicKey"].(map[string]interface{})
+	value, ok := publicKey["challenge"].(string)
+	if !ok {
+		t.Fatalf("no challenge in %v", response)
+	}
+	return value
+}
+
+func (a *virtualAuthenticator) clientData(kind, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+// authenticatorData is the RP ID hash, the flags (user present and
+// verified, plus attested credential data when registering) and the counter
+func (a *virtualAuthenticator) authenticatorData(attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(0x01 | 0x04)
+	if attested != nil {
+		flags |= 0x40
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// create makes the passkey for a registration challenge and returns the
+// PublicKeyCredential a browser would send
+func (a *virtualAuthenticator) create(response gin.H) json.RawMessage {
+	a.t.Helper()
+	publicKey := response["options"].(map[string]interface{})["publicKey"].(map[string]interface{})
+	handle, err := b64.DecodeString(publicKey["user"].(map[string]interface{})["id"].(string))
+	if err != nil {
+		a.t.Fatalf("decode user handle: %v", err)
+	}
+	a.userHandle = handle
+
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatalf("encode public key: %v", err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(attested),
+	})
+	if err != nil {
+		a.t.Fatalf("encode attestation: %v", err)
+	}
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", challenge(a.t, response))),
+		"attestationObject": b64.EncodeToString(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get signs a login challenge and returns the PublicKeyCredential a
+// browser would send
+func (a *virtualAuthenticator) get(response gin.H) json.RawMessage {
+	a.t.Helper()
+	a.signCount++
+	authData := a.authenticatorData(nil)
+	clientData := a.clientData("webauthn.get", challenge(a.t, response))
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("sign assertion: %v", err)
+	}
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    b64.EncodeToString(clientData),
+		"authenticatorData": b64.EncodeToString(authData),
+		"signature":         b64.EncodeToString(signature),
+		"userHandle":        b64.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *virtualAuthenticator) credential(response map[string]interface{}) json.RawMessage {
+	data, err := json.Marshal(map[string]interface{}{
+		"id":       b64.EncodeToString(a.credentialID),
+		"rawId":    b64.EncodeToString(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatalf("encode credential: %v", err)
+	}
+	return data
+}
+
+// setupPasskeys prepares a database and relying party, and registers a
+// passkey for a new regular user
+func setupPasskeys(t *testing.T) (*models.User, *virtualAuthenticator) {
+	t.Helper()
+	database := setupTestDB(t)
+	if err := utils.InitWebAuthn(utils.WebAuthnConfig{RPID: "localhost", RPDisplayName: "VeriOwn", RPOrigins: []string{testOrigin}}); err != nil {
+		t.Fatalf("init WebAuthn: %v", err)
+	}
+
+	user := models.User{Username: "alice", Role: "regular", VerificationStatus: "verified"}
+	if err := database.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	authenticator := newVirtualAuthenticator(t, "localhost")
+
+	code, begin := callHandler(t, BeginPasskeyRegistration, user.ID, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin registration: %d %v", code, begin)
+	}
+	code, finish := callHandler(t, FinishPasskeyRegistration, user.ID, gin.H{
+		"ceremony_token": begin["ceremony_token"],
+		"name":           "Laptop",
+		"credential":     authenticator.create(begin),
+	})
+	if code != http.StatusOK {
+		t.Fatalf("finish registration: %d %v", code, finish)
+	}
+	if err := database.First(&user, user.ID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	return &user, authenticator
+}
+
+// passkeyLogin runs a login ceremony, letting tamper change the credential
+// before it is sent
+func passkeyLogin(t *testing.T, authenticator *virtualAuthenticator, tamper func(json.RawMessage) json.RawMessage) (int, gin.H) {
+	t.Helper()
+	code, begin := callHandler(t, BeginPasskeyLogin, 0, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin login: %d %v", code, begin)
+	}
+	credential := authenticator.get(begin)
+	if tamper != nil {
+		credential = tamper(credential)
+	}
+	return callHandler(t, FinishPasskeyLogin, 0, gin.H{
+		"ceremony_token": begin["ceremony_token"],
+		"credential":     credential,
+	})
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	user, authenticator := setupPasskeys(t)
+
+	var passkeys []models.Passkey
+	if err := db.Where("user_id = ?", user.ID).Find(&passkeys).Error; err != nil {
+		t.Fatalf("load passkeys: %v", err)
+	}
+	if len(passkeys) != 1 {
+		t.Fatalf("got %d passkeys, want 1", len(passkeys))
+	}
+	if passkeys[0].Name != "Laptop" || string(passkeys[0].CredentialID) != string(authenticator.credentialID) {
+		t.Errorf("stored passkey %q with credential %x, want Laptop with %x", passkeys[0].Name, passkeys[0].CredentialID, authenticator.credentialID)
+	}
+	if user.WebAuthnHandle == "" || string(authenticator.userHandle) != user.WebAuthnHandle {
+		t.Errorf("authenticator got user handle %q, want %q", authenticator.userHandle, user.WebAuthnHandle)
+	}
+
+	// The same authenticator is excluded from registering again
+	code, begin := callHandler(t, BeginPasskeyRegistration, user.ID, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin registration: %d %v", code, begin)
+	}
+	code, _ = callHandler(t, FinishPasskeyRegistration, user.ID, gin.H{
+		"ceremony_token": begin["ceremony_token"],
+		"credential":     authenticator.create(begin),
+	})
+	if code != http.StatusConflict {
+		t.Errorf("registering the same passkey twice: got %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestPasskeyRegistrationRejectsForeignCeremony(t *testing.T) {
+	user, _ := setupPasskeys(t)
+	other := models.User{Username: "mallory", Role: "regular", VerificationStatus: "verified"}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	code, begin := callHandler(t, BeginPasskeyRegistration, user.ID, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin registration: %d %v", code, begin)
+	}
+	code, _ = callHandler(t, FinishPasskeyRegistration, other.ID, gin.H{
+		"ceremony_token": begin["ceremony_token"],
+		"credential":     newVirtualAuthenticator(t, "localhost").create(begin),
+	})
+	if code != http.StatusBadRequest {
+		t.Errorf("finishing another user's registration: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	user, authenticator := setupPasskeys(t)
+
+	code, response := passkeyLogin(t, authenticator, nil)
+	if code != http.StatusOK {
+		t.Fatalf("login: %d %v", code, response)
+	}
+	if response["token"] == nil || response["refresh_token"] == nil {
+		t.Errorf("login response has no tokens: %v", response)
+	}
+
+	var passkey models.Passkey
+	if err := db.Where("user_id = ?", user.ID).First(&passkey).Error; err != nil {
+		t.Fatalf("load passkey: %v", err)
+	}
+	if passkey.SignCount != authenticator.signCount || passkey.LastUsedAt == nil {
+		t.Errorf("passkey sign count %d, last used %v; want %d and a time", passkey.SignCount, passkey.LastUsedAt, authenticator.signCount)
+	}
+
+	var succeeded int64
+	db.Model(&models.AuthEvent{}).Where("event = ? AND user_id = ? AND method = ?", "login_succeeded", user.ID, "passkey").Count(&succeeded)
+	if succeeded != 1 {
+		t.Errorf("got %d login_succeeded events, want 1", succeeded)
+	}
+}
+
+func TestPasskeyLoginCeremonyWorksOnce(t *testing.T) {
+	_, authenticator := setupPasskeys(t)
+
+	code, begin := callHandler(t, BeginPasskeyLogin, 0, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin login: %d %v", code, begin)
+	}
+	input := gin.H{"ceremony_token": begin["ceremony_token"], "credential": authenticator.get(begin)}
+	if code, response := callHandler(t, FinishPasskeyLogin, 0, input); code != http.StatusOK {
+		t.Fatalf("login: %d %v", code, response)
+	}
+	if code, _ := callHandler(t, FinishPasskeyLogin, 0, input); code != http.StatusBadRequest {
+		t.Errorf("replayed login: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// corruptSignature flips a bit of the assertion's signature
+func corruptSignature(credential json.RawMessage) json.RawMessage {
+	var decoded map[string]map[string]interface{}
+	json.Unmarshal(credential, &decoded)
+	signature, _ := b64.DecodeString(decoded["response"]["signature"].(string))
+	signature[len(signature)-1] ^= 0x01
+	var raw map[string]interface{}
+	json.Unmarshal(credential, &raw)
+	raw["response"].(map[string]interface{})["signature"] = b64.EncodeToString(signature)
+	data, _ := json.Marshal(raw)
+	return data
+}
+
+func TestPasskeyLoginFailures(t *testing.T) {
+	user, authenticator := setupPasskeys(t)
+
+	code, response := passkeyLogin(t, authenticator, corruptSignature)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("bad signature: got %d %v, want %d", code, response, http.StatusUnauthorized)
+	}
+
+	var failed models.AuthEvent
+	if err := db.Where("event = ? AND method = ?", "login_failed", "passkey").First(&failed).Error; err != nil {
+		t.Fatalf("no login_failed event: %v", err)
+	}
+	if failed.UserID == nil || *failed.UserID != user.ID || failed.Username != user.Username {
+		t.Errorf("login_failed event names user %v %q, want %d %q", failed.UserID, failed.Username, user.ID, user.Username)
+	}
+	for _, key := range []string{utils.AccountThrottleKey(user.Username), utils.IPThrottleKey("192.0.2.1")} {
+		var throttle models.LoginThrottle
+		if err := db.Where("`key` = ?", key).First(&throttle).Error; err != nil || throttle.Failures != 1 {
+			t.Errorf("throttle %s: %d failures (%v), want 1", key, throttle.Failures, err)
+		}
+	}
+
+	// A passkey that names no account counts against the address only
+	stranger := newVirtualAuthenticator(t, "localhost")
+	stranger.userHandle = []byte("unknown-handle")
+	if code, response := passkeyLogin(t, stranger, nil); code != http.StatusUnauthorized {
+		t.Fatalf("unknown passkey: got %d %v, want %d", code, response, http.StatusUnauthorized)
+	}
+	var accountKeys int64
+	db.Model(&models.LoginThrottle{}).Where("`key` LIKE ?", "account:%").Count(&accountKeys)
+	if accountKeys != 1 {
+		t.Errorf("got %d account throttles, want only the one for %s", accountKeys, user.Username)
+	}
+}
+
+func TestPasskeyLoginThrottled(t *testing.T) {
+	user, authenticator := setupPasskeys(t)
+
+	for i := 0; i < accountLoginPolicy.LockoutFailures; i++ {
+		if _, err := utils.RecordLoginFailure(db, utils.AccountThrottleKey(user.Username), accountLoginPolicy); err != nil {
+			t.Fatalf("record failure: %v", err)
+		}
+	}
+	code, response := passkeyLogin(t, authenticator, nil)
+	if code != http.StatusTooManyRequests {
+		t.Errorf("locked account: got %d %v, want %d", code, response, http.StatusTooManyRequests)
+	}
+}
+
+func TestPasskeyLoginOnlyForRegularUsers(t *testing.T) {
+	user, authenticator := setupPasskeys(t)
+	if err := db.Model(user).Update("role", "repair_shop").Error; err != nil {
+		t.Fatalf("update role: %v", err)
+	}
+
+	if code, response := passkeyLogin(t, authenticator, nil); code != http.StatusForbidden {
+		t.Errorf("repair shop passkey login: got %d %v, want %d", code, response, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// How long a password reset link works
+	passwordResetTTL = time.Hour
+	// A user is sent at most one reset link in this time
+	passwordResetInterval = time.Minute
+)
+
+var errPasswordResetInvalid = errors.New("invalid password reset token")
+
+// passwordResetsPending tracks reset links still being sent after their
+// request was answered
+var passwordResetsPending sync.WaitGroup
+
+// passwordAccepted answers a request whose new password breaks the password
+// policy, and reports whether it did not
+func passwordAccepted(c *gin.Context, password, username string) bool {
+	if err := utils.CheckPassword(password, username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// setPassword replaces a user's password and ends all of their sessions,
+// along with any reset links still open
+func setPassword(tx *gorm.DB, user *models.User, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := tx.Model(user).Updates(map[string]interface{}{
+		"password_hash":       string(hash),
+		"password_changed_at": now,
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.PasswordReset{}).Where("user_id = ? AND used_at IS NULL", user.ID).
+		Update("used_at", now).Error; err != nil {
+		return err
+	}
+	return utils.RevokeSessions(tx, "user_id = ?", user.ID)
+}
+
+// passwordResetURL is the page of the frontend a reset link opens
+func passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = "http://localhost:5173/reset-password"
+	}
+	return base + "?token=" + url.QueryEscape(token)
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword sets a new password for the current user. Every session,
+// this one included, is ended; the response starts a new one.
+func ChangePassword(c *gin.Context) {
+	var input ChangePasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.PasswordHash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This account has no password"})
+		return
+	}
+
+	// A stolen session must not be a way around the login throttle
+	if loginThrottled(c, user.Username) {
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(input.CurrentPassword)); err != nil {
+		recordLoginFailure(c, user.Username, &user, "password_change", "wrong password")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	if !passwordAccepted(c, input.NewPassword, user.Username) {
+		return
+	}
+	if input.NewPassword == input.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New password must differ from the current one"})
+		return
+	}
+
+	sessionID, err := utils.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	var response gin.H
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := utils.RevokeAccessToken(tx, c.GetString("jti"), c.GetTime("token_expires_at")); err != nil {
+			return err
+		}
+		if err := setPassword(tx, &user, input.NewPassword); err != nil {
+			return err
+		}
+		response, err = issueTokens(tx, &user, sessionID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	auditAuth(c, models.AuthEvent{Event: "password_changed", UserID: &user.ID, Username: user.Username, ActorID: &user.ID})
+
+	response["message"] = "Password changed, other sessions have been logged out"
+	c.JSON(http.StatusOK, response)
+}
+
+type ForgotPasswordInput struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// RequestPasswordReset emails a reset link to the account's contact email.
+// The answer is the same whether or not one was sent, and is given before
+// the account is looked up, so neither its content nor its timing tells
+// which usernames exist or have an email address.
+func RequestPasswordReset(c *gin.Context) {
+	var input ForgotPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	auditAuth(c, models.AuthEvent{Event: "password_reset_requested", Username: input.Username})
+	passwordResetsPending.Add(1)
+	go func() {
+		defer passwordResetsPending.Done()
+		if err := sendPasswordReset(input.Username); err != nil {
+			fmt.Printf("Warning: Failed to send password reset: %v\n", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account has an email address, a reset link has been sent to it"})
+}
+
+// sendPasswordReset creates a reset link for username and mails it, unless
+// the account cannot get one or was sent one moments ago
+func sendPasswordReset(username string) error {
+	var user models.User
+	err := db.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ContactEmail == "" || user.PasswordHash == "" {
+		return nil
+	}
+
+	var recent int64
+	if err := db.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-passwordResetInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return nil
+	}
+
+	mailer, err := utils.Mail()
+	if err != nil {
+		return err
+	}
+	token, err := utils.NewTokenID()
+	if err != nil {
+		return err
+	}
+	reset := models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: utils.HashRefreshToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+
+	// Links that were never used are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.PasswordReset{})
+	if err := db.Create(&reset).Error; err != nil {
+		return err
+	}
+	return mailer.Send(utils.MailMessage{
+		To:      user.ContactEmail,
+		Subject: "Reset your VeriOwn password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password of your VeriOwn account. To choose a new password, open this link within %d minutes:\n\n"+
+			"%s\n\n"+
+			"If it was not you, ignore this email; your password stays the same.\n",
+			user.Username, int(passwordResetTTL.Minutes()), passwordResetURL(token)),
+	})
+}
+
+type ResetPasswordInput struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// ResetPassword sets a new password with the token from a reset link and
+// ends every session of the account
+func ResetPassword(c *gin.Context) {
+	var input ResetPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reset models.PasswordReset
+	var user models.User
+	err := db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", utils.HashRefreshToken(input.Token), time.Now()).
+		First(&reset).Error
+	if err == nil {
+		err = db.First(&user, reset.UserID).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if !passwordAccepted(c, input.NewPassword, user.Username) {
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Claim the link so it works only once, even for concurrent requests
+		claim := tx.Model(&models.PasswordReset{}).Where("id = ? AND used_at IS NULL", reset.ID).Update("used_at", time.Now())
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			return errPasswordResetInvalid
+		}
+		return setPassword(tx, &user, input.NewPassword)
+	})
+	if errors.Is(err, errPasswordResetInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	auditAuth(c, models.AuthEvent{Event: "password_reset", UserID: &user.ID, Username: user.Username})
+
+	// Whoever locked the account out was guessing a password that is gone now
+	if err := utils.ClearLoginThrottle(db, utils.AccountThrottleKey(user.Username)); err != nil {
+		fmt.Printf("Warning: Failed to clear failed logins: %v\n", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset, please log in with the new password"})
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heldMailer records messages, each Send waiting until release is closed
+type heldMailer struct {
+	release chan struct{}
+	mu      sync.Mutex
+	sent    []utils.MailMessage
+}
+
+func (m *heldMailer) Name() string { return "held" }
+
+func (m *heldMailer) Send(msg utils.MailMessage) error {
+	<-m.release
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestPasswordResetAnsweredBeforeSending(t *testing.T) {
+	database := setupTestDB(t)
+	mailer := &heldMailer{release: make(chan struct{})}
+	utils.RegisterMailer("held", func() (utils.Mailer, error) { return mailer, nil })
+	if err := utils.InitMailer("held"); err != nil {
+		t.Fatalf("init mailer: %v", err)
+	}
+	t.Cleanup(func() { utils.InitMailer("") })
+
+	user := models.User{Username: "alice", Role: "regular", PasswordHash: "hash", ContactEmail: "alice@example.com"}
+	if err := database.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	// Neither answer waits for the mailer, which has not sent anything yet
+	for _, username := range []string{"alice", "nobody"} {
+		answered := make(chan gin.H, 1)
+		go func() {
+			status, response := callHandler(t, RequestPasswordReset, 0, ForgotPasswordInput{Username: username})
+			if status != http.StatusOK {
+				t.Errorf("%s: %d %v", username, status, response)
+			}
+			answered <- response
+		}()
+		select {
+		case <-answered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: request waited for the mail to be sent", username)
+		}
+	}
+
+	close(mailer.release)
+	passwordResetsPending.Wait()
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "alice@example.com" {
+		t.Fatalf("sent %+v, want one link to alice", mailer.sent)
+	}
+	var resets int64
+	database.Model(&models.PasswordReset{}).Where("user_id = ?", user.ID).Count(&resets)
+	if resets != 1 {
+		t.Fatalf("%d reset links stored, want 1", resets)
+	}
+}
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Largest webhook body accepted from a payment provider
+const maxPaymentWebhookBody = 1 << 20
+
+var (
+	errPaymentMismatch   = errors.New("payment does not match the transfer price")
+	errPaymentNotPending = errors.New("transfer is not awaiting payment")
+)
+
+// requestPayment holds an escrow offer until payment is confirmed. The
+// offer is registered with the payment provider by the outbox once the
+// transaction commits.
+func requestPayment(tx *gorm.DB, transfer *models.PendingTransfer, price utils.Money) error {
+	provider, err := utils.Payments()
+	if err != nil {
+		return err
+	}
+
+	transfer.Status = TransferAwaitingPayment
+	transfer.PriceMinor = price.AmountMinor
+	transfer.Currency = price.Currency
+	transfer.PaymentProvider = provider.Name()
+	if err := tx.Save(transfer).Error; err != nil {
+		return err
+	}
+	_, err = utils.EnqueuePaymentRequest(tx, transfer.ID)
+	return err
+}
+
+// PaymentWebhook receives payment outcomes from the payment provider. It sits
+// outside the auth middleware; the provider's signature authenticates it.
+func PaymentWebhook(c *gin.Context) {
+	provider, err := utils.Payments()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payments are not available"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPaymentWebhookBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	notification, err := provider.ParseWebhook(c.Request.Header, body)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var found models.PendingTransfer
+	if err := db.Select("id", "product_id").
+		Where("payment_provider = ? AND payment_reference = ?", provider.Name(), notification.Reference).
+		First(&found).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment reference"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		transfer, err := findOpenTransfer(tx, found.ProductID, "id = ?", found.ID)
+		if err != nil {
+			if errors.Is(err, errNoOpenTransfer) {
+				return errPaymentNotPending
+			}
+			return err
+		}
+
+		// Providers retry deliveries, so a repeat of the confirmation is fine
+		if transfer.Status == TransferPaid {
+			return nil
+		}
+		if transfer.Status != TransferAwaitingPayment {
+			return errPaymentNotPending
+		}
+
+		// A failed attempt leaves the offer waiting for another one
+		if notification.Status != utils.PaymentSucceeded {
+			return nil
+		}
+		if notification.Price.AmountMinor != transfer.PriceMinor || notification.Price.Currency != transfer.Currency {
+			return errPaymentMismatch
+		}
+		if !time.Now().Before(transfer.ExpiresAt) {
+			return errTransferExpired
+		}
+
+		now := time.Now()
+		transfer.Status = TransferPaid
+		transfer.PaidAt = &now
+		if err := tx.Save(transfer).Error; err != nil {
+			return fmt.Errorf("failed to update transfer: %w", err)
+		}
+
+		event := models.Event{
+			ProductID: transfer.ProductID,
+			EventType: transferEventTypes[TransferPaid],
+			EventData: transferEventData(transfer),
+		}
+		return createEventRecord(tx, &event)
+	})
+	// Money that was taken but cannot buy the product goes back
+	unapplied := errors.Is(err, errPaymentNotPending) || errors.Is(err, errPaymentMismatch) || errors.Is(err, errTransferExpired)
+	if unapplied && notification.Status == utils.PaymentSucceeded {
+		if refundErr := refundUnappliedPayment(provider, found.ID, notification, err.Error()); refundErr != nil {
+			fmt.Printf("Warning: Failed to refund payment %s: %v\n", notification.Reference, refundErr)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+			return
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errPaymentNotPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "The transfer is no longer awaiting payment"})
+		case errors.Is(err, errPaymentMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, errTransferExpired):
+			c.JSON(http.StatusGone, gin.H{"error": "The transfer offer has expired"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payment"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// refundUnappliedPayment refunds a captured payment that could not be
+// applied to its transfer, and records it for reconciliation. Providers
+// retry deliveries, so each payment is refunded at most once; a failed
+// refund is tried again on the next delivery.
+func refundUnappliedPayment(provider utils.PaymentProvider, transferID uint, notification *utils.PaymentNotification, reason string) error {
+	var transfer models.PendingTransfer
+	if err := db.First(&transfer, transferID).Error; err != nil {
+		return err
+	}
+	// A repeat of a confirmation that was applied, to an offer that has
+	// moved on since, is not a stray payment
+	if transfer.PaidAt != nil {
+		return nil
+	}
+
+	refund := models.PaymentRefund{
+		TransferID:       transferID,
+		PaymentProvider:  provider.Name(),
+		PaymentReference: notification.Reference,
+		AmountMinor:      notification.Price.AmountMinor,
+		Currency:         notification.Price.Currency,
+		Reason:           reason,
+		Status:           "pending",
+	}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&refund).Error; err != nil {
+		return err
+	}
+
+	// Claim the refund so concurrent deliveries do not both send the money
+	claim := db.Model(&models.PaymentRefund{}).
+		Where("payment_provider = ? AND payment_reference = ? AND status IN ?", provider.Name(), notification.Reference, []string{"pending", "failed"}).
+		Update("status", "refunding")
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return nil
+	}
+
+	scope := db.Model(&models.PaymentRefund{}).Where("payment_provider = ? AND payment_reference = ?", provider.Name(), notification.Reference)
+	refundReference, err := provider.Refund(notification.Reference, notification.Price)
+	if err != nil {
+		if updateErr := scope.Updates(map[string]interface{}{"status": "failed", "error": err.Error()}).Error; updateErr != nil {
+			fmt.Printf("Warning: Failed to record failed refund of %s: %v\n", notification.Reference, updateErr)
+		}
+		return err
+	}
+	return scope.Updates(map[string]interface{}{"status": "refunded", "refund_reference": refundReference, "error": ""}).Error
+}
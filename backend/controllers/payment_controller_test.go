@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deliverPaymentWebhook posts a webhook signed the way the fake provider
+// signs them
+func deliverPaymentWebhook(t *testing.T, reference, amount, status string) int {
+	t.Helper()
+	provider, err := utils.Payments()
+	if err != nil {
+		t.Fatalf("payments: %v", err)
+	}
+	body, _ := json.Marshal(map[string]string{"reference": reference, "amount": amount, "currency": "EUR", "status": status})
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/payments/webhook", bytes.NewReader(body))
+	c.Request.Header.Set(utils.FakePaymentSignatureHeader, provider.(*utils.FakePaymentProvider).SignWebhook(body, time.Now()))
+	PaymentWebhook(c)
+	return recorder.Code
+}
+
+// setupEscrowTransfer creates a product with an escrow offer of 100.00 EUR
+// awaiting payment under reference
+func setupEscrowTransfer(t *testing.T, reference string, expiresAt time.Time) *models.PendingTransfer {
+	t.Helper()
+	database := setupTestDB(t)
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "test secret")
+	if err := utils.InitPaymentProvider("fake"); err != nil {
+		t.Fatalf("init payments: %v", err)
+	}
+
+	product := models.Product{SerialNumber: "SN-1", CurrentOwnerID: 1}
+	if err := database.Create(&product).Error; err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	transfer := models.PendingTransfer{
+		ProductID:        product.ID,
+		NewOwnerID:       2,
+		InitiatedBy:      1,
+		Status:           TransferAwaitingPayment,
+		ExpiresAt:        expiresAt,
+		PriceMinor:       10000,
+		Currency:         "EUR",
+		PaymentProvider:  "fake",
+		PaymentReference: reference,
+	}
+	if err := database.Create(&transfer).Error; err != nil {
+		t.Fatalf("create transfer: %v", err)
+	}
+	return &transfer
+}
+
+func TestPaymentWebhookRefundsExpiredOffer(t *testing.T) {
+	transfer := setupEscrowTransfer(t, "fake_late", time.Now().Add(-time.Minute))
+
+	// The provider retries, and the payment must go back once
+	for i := 0; i < 2; i++ {
+		if code := deliverPaymentWebhook(t, "fake_late", "100.00", utils.PaymentSucceeded); code != http.StatusGone {
+			t.Fatalf("delivery %d: got %d, want %d", i+1, code, http.StatusGone)
+		}
+	}
+
+	var refunds []models.PaymentRefund
+	if err := db.Find(&refunds).Error; err != nil {
+		t.Fatalf("load refunds: %v", err)
+	}
+	if len(refunds) != 1 {
+		t.Fatalf("got %d refunds, want 1", len(refunds))
+	}
+	refund := refunds[0]
+	if refund.Status != "refunded" || refund.RefundReference == "" || refund.TransferID != transfer.ID ||
+		refund.AmountMinor != 10000 || refund.Currency != "EUR" {
+		t.Errorf("refund = %+v, want a refunded 100.00 EUR for transfer %d", refund, transfer.ID)
+	}
+}
+
+func TestPaymentWebhookRefundsWrongAmount(t *testing.T) {
+	setupEscrowTransfer(t, "fake_short", time.Now().Add(time.Hour))
+
+	if code := deliverPaymentWebhook(t, "fake_short", "90.00", utils.PaymentSucceeded); code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+	var refund models.PaymentRefund
+	if err := db.Where("payment_reference = ?", "fake_short").First(&refund).Error; err != nil {
+		t.Fatalf("no refund recorded: %v", err)
+	}
+	if refund.Status != "refunded" || refund.AmountMinor != 9000 {
+		t.Errorf("refund = %+v, want the 90.00 EUR received refunded", refund)
+	}
+}
+
+func TestPaymentWebhookFailedPaymentIsNotRefunded(t *testing.T) {
+	setupEscrowTransfer(t, "fake_declined", time.Now().Add(-time.Minute))
+
+	deliverPaymentWebhook(t, "fake_declined", "100.00", utils.PaymentFailed)
+	var refunds int64
+	db.Model(&models.PaymentRefund{}).Count(&refunds)
+	if refunds != 0 {
+		t.Errorf("got %d refunds for a payment that failed, want none", refunds)
+	}
+}
+
+// setupTransferOffer gives a seller sole ownership of a product and returns
+// its ID and a function that makes an offer of it, as the seller, with a
+// JSON body
+func setupTransferOffer(t *testing.T) (uint, func(body string) int) {
+	t.Helper()
+	database := setupTestDB(t)
+	if err := utils.InitKeyring(database, filepath.Join(t.TempDir(), "keys")); err != nil {
+		t.Fatalf("init keyring: %v", err)
+	}
+	seller := models.User{Username: "seller", Role: "regular"}
+	buyer := models.User{Username: "buyer", Role: "regular"}
+	for _, user := range []*models.User{&seller, &buyer} {
+		if err := database.Create(user).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	product := models.Product{SerialNumber: "SN-1", CurrentOwnerID: seller.ID}
+	if err := database.Create(&product).Error; err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	if err := database.Create(&models.ProductOwner{ProductID: product.ID, UserID: seller.ID, Share: utils.FullShare}).Error; err != nil {
+		t.Fatalf("create owner: %v", err)
+	}
+
+	offer := func(body string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(body)))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Params = gin.Params{{Key: "id", Value: fmt.Sprint(product.ID)}}
+		c.Set("user_id", seller.ID)
+		c.Set("principal_id", seller.ID)
+		InitiateTransfer(c)
+		return recorder.Code
+	}
+	return product.ID, offer
+}
+
+func TestPricedTransferNeedsPayments(t *testing.T) {
+	_, offer := setupTransferOffer(t)
+	if err := utils.InitPaymentProvider(""); err != nil {
+		t.Fatalf("disable payments: %v", err)
+	}
+
+	if code := offer(`{"new_owner_username":"buyer","price":"100.00","currency":"EUR"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("priced offer without payments: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := offer(`{"new_owner_username":"buyer"}`); code != http.StatusOK {
+		t.Errorf("offer without a price: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestPaymentRequestedAfterCommit(t *testing.T) {
+	productID, offer := setupTransferOffer(t)
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "test secret")
+	if err := utils.InitPaymentProvider("fake"); err != nil {
+		t.Fatalf("init payments: %v", err)
+	}
+
+	if code := offer(`{"new_owner_username":"buyer","price":"100.00","currency":"EUR"}`); code != http.StatusOK {
+		t.Fatalf("priced offer: got %d, want %d", code, http.StatusOK)
+	}
+
+	// The offer waits for payment, but only the outbox talks to the provider
+	var transfer models.PendingTransfer
+	if err := db.Where("product_id = ?", productID).First(&transfer).Error; err != nil {
+		t.Fatalf("load transfer: %v", err)
+	}
+	if transfer.Status != TransferAwaitingPayment || transfer.PaymentReference != "" {
+		t.Errorf("transfer status %s, reference %q; want %s and none yet", transfer.Status, transfer.PaymentReference, TransferAwaitingPayment)
+	}
+	var jobs int64
+	if err := db.Model(&models.OutboxJob{}).
+		Where("kind = ? AND transfer_id = ?", utils.OutboxKindCreatePayment, transfer.ID).Count(&jobs).Error; err != nil {
+		t.Fatalf("count jobs: %v", err)
+	}
+	if jobs != 1 {
+		t.Errorf("got %d payment jobs, want 1", jobs)
+	}
+}
@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"backend/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+// Actions that policies authorize. Most are bound to routes in routePolicies;
+// the rest depend on the request body and are checked by their handlers.
+const (
+	ActionPublic = "public" // routes outside the auth middleware
+
+	ActionOwnAccount        = "account.own"
+	ActionRegisterPublicKey = "account.register_public_key"
+	ActionManagePasskeys    = "account.passkeys"
+
+	ActionRegisterProduct = "product.register"
+	ActionViewProduct     = "product.view"
+	ActionVerifyProduct   = "product.verify"
+	ActionLogEvent        = "product.log_event"
+	ActionLogRepair       = "product.log_repair"
+	ActionSignEvent       = "product.sign_event"
+	ActionProductQR       = "product.qr"
+	ActionManageProduct   = "product.manage"
+	ActionAnswerTransfer  = "transfer.answer"
+
+	ActionListContracts      = "contract.list"
+	ActionViewAllContracts   = "contract.view_all"
+	ActionViewContract       = "contract.view"
+	ActionRegenerateContract = "contract.regenerate"
+
+	ActionViewOrganization   = "organization.view"
+	ActionManageOrganization = "organization.manage"
+
+	ActionAdmin = "admin"
+)
+
+// condition is an attribute check on the user and the resource a request
+// names. It returns gorm.ErrRecordNotFound when the resource does not exist.
+type condition func(c *gin.Context) (bool, error)
+
+// rule grants an action to users with one of roles (any role when empty)
+// for whom every condition holds. Organization members also need one of
+// orgRoles, when given.
+type rule struct {
+	roles      []string
+	orgRoles   []string
+	conditions []condition
+}
+
+type policy struct {
+	rules    []rule // the action is allowed if any rule grants it
+	resource string // what a condition failed to find, for the 404
+	denied   string // error returned when no rule grants the action
+}
+
+var (
+	orgWriters = []string{OrgRoleOwner, OrgRoleProductRegistrar}
+	orgOwners  = []string{OrgRoleOwner}
+)
+
+// policies is the single list of who may do what
+var policies = map[string]policy{
+	ActionOwnAccount: {
+		rules: []rule{{}},
+	},
+	ActionRegisterPublicKey: {
+		rules:  []rule{{roles: []string{"brand", "repair_shop"}, orgRoles: orgWriters}},
+		denied: "Only brands and repair shops can register signing keys",
+	},
+	ActionManagePasskeys: {
+		rules:  []rule{{roles: []string{"regular"}}},
+		denied: "Passkeys are only available to regular users",
+	},
+
+	ActionRegisterProduct: {
+		rules:  []rule{{roles: []string{"brand"}, orgRoles: orgWriters, conditions: []condition{isVerified}}},
+		denied: "Only verified brands can register products",
+	},
+	ActionViewProduct: {
+		rules: []rule{
+			{roles: []string{"admin"}},
+			{roles: []string{"brand"}, conditions: []condition{isManufacturer}},
+			{conditions: []condition{isProductOwner}},
+		},
+		resource: "Product",
+		denied:   "You don't have permission to view this product",
+	},
+	ActionVerifyProduct: {
+		rules: []rule{{}},
+	},
+	ActionLogEvent: {
+		rules: []rule{
+			{roles: []string{"repair_shop"}, conditions: []condition{isVerified, isRepairEvent}},
+			{roles: []string{"brand"}, orgRoles: orgWriters, conditions: []condition{isVerified, isManufacturer}},
+			{orgRoles: orgWriters, conditions: []condition{isProductOwner}},
+		},
+		resource: "Product",
+		denied:   "Only the product's owner or its manufacturer can log events on it; repair shops can log repairs",
+	},
+	ActionLogRepair: {
+		rules:  []rule{{roles: []string{"repair_shop"}, conditions: []condition{isVerified}}},
+		denied: "Only repair shops can log repairs",
+	},
+	ActionSignEvent: {
+		rules:  []rule{{roles: []string{"brand", "repair_shop"}}},
+		denied: "Only brands and repair shops can sign events",
+	},
+	ActionProductQR: {
+		rules: []rule{
+			{roles: []string{"brand"}, conditions: []condition{isManufacturer}},
+			{conditions: []condition{isProductOwner}},
+		},
+		resource: "Product",
+		denied:   "Only product owners or manufacturers can generate QR codes",
+	},
+	ActionManageProduct: {
+		rules:    []rule{{orgRoles: orgOwners, conditions: []condition{isProductOwner}}},
+		resource: "Product",
+		denied:   "Only an owner of this product can manage its transfers",
+	},
+	ActionAnswerTransfer: {
+		rules:  []rule{{orgRoles: orgOwners}},
+		denied: "Only organization owners can manage transfers",
+	},
+
+	ActionListContracts: {
+		rules: []rule{{}},
+	},
+	ActionViewAllContracts: {
+		rules: []rule{{roles: []string{"admin"}}},
+	},
+	ActionViewContract: {
+		rules: []rule{
+			{roles: []string{"admin"}},
+			{conditions: []condition{isContractParty}},
+		},
+		resource: "Contract",
+		denied:   "You don't have permission to view this contract",
+	},
+	ActionRegenerateContract: {
+		rules: []rule{
+			{roles: []string{"admin"}},
+			{orgRoles: orgOwners, conditions: []condition{isContractOwner}},
+		},
+		resource: "Contract",
+		denied:   "Only the contract owner or an admin can regenerate it",
+	},
+
+	ActionViewOrganization: {
+		rules:  []rule{{conditions: []condition{isOrgMember}}},
+		denied: "You are not a member of an organization",
+	},
+	ActionManageOrganization: {
+		rules:  []rule{{orgRoles: orgOwners, conditions: []condition{isOrgMember}}},
+		denied: "Only organization owners can manage members",
+	},
+
+	ActionAdmin: {
+		rules:  []rule{{roles: []string{"admin"}}},
+		denied: "Only admins can do this",
+	},
+}
+
+// routePolicies binds every route in main.go to the action it performs.
+// CheckRoutePolicies refuses to start the server if a route is missing.
+var routePolicies = map[string]string{
+	"GET /api/products/public/:id":                       ActionPublic,
+	"GET /api/products/public/:id/events/:eventId/proof": ActionPublic,
+	"GET /api/keys":                                           ActionPublic,
+	"GET /.well-known/jwks.json":                              ActionPublic,
+	"GET /api/schemas/chain-verification-report.json":         ActionPublic,
+	"GET /api/log/checkpoints/:seq":                           ActionPublic,
+	"GET /api/log/checkpoints/:seq/products/:productId/proof": ActionPublic,
+	"POST /api/payments/webhook":                              ActionPublic,
+	"POST /api/users/register/regular":                        ActionPublic,
+	"POST /api/users/register/brand":                          ActionPublic,
+	"POST /api/users/register/repair-shop":                    ActionPublic,
+	"POST /api/users/confirm-email":                           ActionPublic,
+	"POST /api/organizations/:id/verification/email":          ActionPublic,
+	"POST /api/organizations/:id/verification/domain":         ActionPublic,
+	"POST /api/verification/documents":                        ActionPublic,
+	"POST /api/users/login":                                   ActionPublic,
+	"POST /api/users/refresh":                                 ActionPublic,
+	"POST /api/users/password/forgot":                         ActionPublic,
+	"POST /api/users/password/reset":                          ActionPublic,
+	"GET /api/auth/oidc/login":                                ActionPublic,
+	"GET /api/auth/oidc/callback":                             ActionPublic,
+	"POST /api/auth/oidc/exchange":                            ActionPublic,
+	"POST /api/users/login/2fa":                               ActionPublic,
+	"POST /api/users/login/2fa/enroll":                        ActionPublic,
+	"POST /api/users/passkeys/login/begin":                    ActionPublic,
+	"POST /api/users/passkeys/login/finish":                   ActionPublic,
+
+	"POST /api/products":                       ActionRegisterProduct,
+	"GET /api/products/:id":                    ActionViewProduct,
+	"POST /api/products/:id/events":            ActionLogEvent,
+	"POST /api/products/:id/transfer":          ActionManageProduct,
+	"GET /api/transfers/pending":               ActionOwnAccount,
+	"POST /api/products/:id/transfer/confirm":  ActionAnswerTransfer,
+	"POST /api/products/:id/transfer/reject":   ActionAnswerTransfer,
+	"POST /api/products/:id/transfer/cancel":   ActionAnswerTransfer,
+	"GET /api/transfers/outgoing":              ActionOwnAccount,
+	"POST /api/products/:id/transfer/consent":  ActionManageProduct,
+	"GET /api/transfers/consents":              ActionOwnAccount,
+	"GET /api/products/:id/owners":             ActionViewProduct,
+	"PUT /api/products/:id/consent-rule":       ActionManageProduct,
+	"GET /api/products/:id/verify":             ActionVerifyProduct,
+	"GET /api/products/:id/qr":                 ActionProductQR,
+	"GET /api/user/products":                   ActionOwnAccount,
+	"GET /api/products/:id/contracts":          ActionListContracts,
+	"GET /api/contracts/:id/pdf":               ActionViewContract,
+	"GET /api/contracts/:id/ipfs":              ActionViewContract,
+	"POST /api/contracts/:id/regenerate":       ActionRegenerateContract,
+	"GET /api/contracts/:id/jobs":              ActionViewContract,
+	"GET /api/user/info":                       ActionOwnAccount,
+	"POST /api/users/logout":                   ActionOwnAccount,
+	"POST /api/users/logout-all":               ActionOwnAccount,
+	"PUT /api/user/public-key":                 ActionRegisterPublicKey,
+	"PUT /api/user/password":                   ActionOwnAccount,
+	"POST /api/user/2fa/enroll":                ActionOwnAccount,
+	"POST /api/user/2fa/confirm":               ActionOwnAccount,
+	"POST /api/user/2fa/recovery-codes":        ActionOwnAccount,
+	"POST /api/user/2fa/disable":               ActionOwnAccount,
+	"POST /api/user/passkeys/register/begin":   ActionManagePasskeys,
+	"POST /api/user/passkeys/register/finish":  ActionManagePasskeys,
+	"GET /api/user/passkeys":                   ActionManagePasskeys,
+	"DELETE /api/user/passkeys/:id":            ActionManagePasskeys,
+	"GET /api/organization":                    ActionViewOrganization,
+	"POST /api/organization/members":           ActionManageOrganization,
+	"PUT /api/organization/members/:userId":    ActionManageOrganization,
+	"DELETE /api/organization/members/:userId": ActionManageOrganization,
+
+	"GET /api/admin/verifications/pending":          ActionAdmin,
+	"POST /api/admin/verify-user/:id":               ActionAdmin,
+	"POST /api/admin/verify-organization/:id":       ActionAdmin,
+	"GET /api/admin/verification-documents/:id":     ActionAdmin,
+	"GET /api/admin/users/:id/verification-history": ActionAdmin,
+	"POST /api/admin/keys/rotate":                   ActionAdmin,
+	"POST /api/admin/keys/:kid/retire":              ActionAdmin,
+	"POST /api/admin/users/:id/suspend":             ActionAdmin,
+	"POST /api/admin/users/:id/reinstate":           ActionAdmin,
+	"POST /api/admin/users/:id/2fa/reset":           ActionAdmin,
+	"POST /api/admin/users/:id/unlock":              ActionAdmin,
+	"GET /api/admin/auth-events":                    ActionAdmin,
+	"POST /api/admin/jobs/:id/retry":                ActionAdmin,
+}
+
+// CheckRoutePolicies makes sure every registered route has a policy and
+// every policy binding still names a route, so a new endpoint cannot ship
+// unguarded by accident
+func CheckRoutePolicies(routes gin.RoutesInfo) error {
+	var problems []string
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		action, ok := routePolicies[key]
+		if !ok {
+			problems = append(problems, key+" has no policy")
+			continue
+		}
+		if _, ok := policies[action]; !ok && action != ActionPublic {
+			problems = append(problems, fmt.Sprintf("%s uses undefined action %q", key, action))
+		}
+	}
+	for key := range routePolicies {
+		if !registered[key] {
+			problems = append(problems, key+" has a policy but no route")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("route policies: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Authorize enforces the policy bound to the matched route. It runs after
+// ResolvePrincipal; a route without a policy is denied.
+func Authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		action, ok := routePolicies[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No policy allows this request"})
+			c.Abort()
+			return
+		}
+		if action == ActionPublic {
+			c.Next()
+			return
+		}
+		if !authorize(c, action) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowed reports whether the user may perform action on the resource the
+// request names
+func allowed(c *gin.Context, action string) (bool, error) {
+	p, ok := policies[action]
+	if !ok {
+		return false, fmt.Errorf("no policy for action %q", action)
+	}
+
+	role := c.GetString("role")
+	for _, r := range p.rules {
+		if len(r.roles) > 0 && !containsString(r.roles, role) {
+			continue
+		}
+		if len(r.orgRoles) > 0 && !hasOrgRole(c, r.orgRoles...) {
+			continue
+		}
+		granted := true
+		for _, cond := range r.conditions {
+			ok, err := cond(c)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				granted = false
+				break
+			}
+		}
+		if granted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorize checks action and answers the request itself when it is not
+// allowed. Handlers call it for actions that depend on the request body.
+func authorize(c *gin.Context, action string) bool {
+	ok, err := allowed(c, action)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": policies[action].resource + " not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+	case !ok:
+		denied := policies[action].denied
+		if denied == "" {
+			denied = "You don't have permission to do this"
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": denied})
+	}
+	return err == nil && ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// accountVerificationStatus is the verification status that applies to a
+// user: their organization's for organization members, their own otherwise
+func accountVerificationStatus(tx *gorm.DB, user *models.User) (string, error) {
+	if user.OrganizationID == nil {
+		return user.VerificationStatus, nil
+	}
+	var org models.Organization
+	if err := tx.Select("id", "verification_status").First(&org, *user.OrganizationID).Error; err != nil {
+		return "", err
+	}
+	return org.VerificationStatus, nil
+}
+
+// isVerified holds for brands and repair shops an admin has verified and
+// for roles that need no verification
+func isVerified(c *gin.Context) (bool, error) {
+	return !needsVerification(c.GetString("role")) || c.GetString("verification_status") == "verified", nil
+}
+
+// isProductOwner holds when the user's principal holds a share of the
+// product named by the :id parameter
+func isProductOwner(c *gin.Context) (bool, error) {
+	return isCurrentOwner(db, c.Param("id"), principalID(c))
+}
+
+// isManufacturer holds when the product named by the :id parameter was
+// registered by the user's organization
+func isManufacturer(c *gin.Context) (bool, error) {
+	var product models.Product
+	if err := db.Select("id", "organization_id").First(&product, c.Param("id")).Error; err != nil {
+		return false, err
+	}
+	orgID, ok := c.Get("organization_id")
+	return ok && product.OrganizationID != 0 && product.OrganizationID == orgID.(uint), nil
+}
+
+// isRepairEvent holds when the event in the request body is a repair. The
+// body stays readable for the handler.
+func isRepairEvent(c *gin.Context) (bool, error) {
+	var input struct {
+		EventType string `json:"event_type"`
+	}
+	if err := c.ShouldBindBodyWith(&input, binding.JSON); err != nil {
+		return false, nil
+	}
+	return input.EventType == "repair", nil
+}
+
+func contractParam(c *gin.Context) (*models.OwnerContract, error) {
+	var contract models.OwnerContract
+	if err := db.Select("id", "owner_id", "previous_owner_id").First(&contract, c.Param("id")).Error; err != nil {
+		return nil, err
+	}
+	return &contract, nil
+}
+
+// isContractParty holds when the user's principal is the owner or previous
+// owner on the contract named by the :id parameter
+func isContractParty(c *gin.Context) (bool, error) {
+	contract, err := contractParam(c)
+	if err != nil {
+		return false, err
+	}
+	principal := principalID(c)
+	return contract.OwnerID == principal || contract.PreviousOwnerID == principal, nil
+}
+
+// isContractOwner holds when the user's principal is the owner on the
+// contract named by the :id parameter
+func isContractOwner(c *gin.Context) (bool, error) {
+	contract, err := contractParam(c)
+	if err != nil {
+		return false, err
+	}
+	return contract.OwnerID == principalID(c), nil
+}
+
+// isOrgMember holds for members of an organization
+func isOrgMember(c *gin.Context) (bool, error) {
+	_, ok := c.Get("organization_id")
+	return ok, nil
+}
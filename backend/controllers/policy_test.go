@@ -0,0 +1,322 @@
+package controllers
+
+import (
+	"backend/models"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// policyFixtures holds the users and resources the policy tests request as
+// and against, by name
+type policyFixtures struct {
+	users     map[string]uint
+	resources map[string]uint
+}
+
+// Users that ResolvePrincipal lets through. The brand members belong to
+// the organization that manufactured both products; "owner" holds the
+// first product and is the owner on its contract, and the organization
+// holds the second.
+var activeFixtures = []string{
+	"admin", "owner", "stranger",
+	"brandOwner", "brandRegistrar", "brandViewer", "otherBrand",
+	"shop",
+}
+
+// Users refused before any policy runs
+var refusedFixtures = []string{"pendingBrand", "pendingShop"}
+
+func setupPolicyFixtures(t *testing.T) *policyFixtures {
+	t.Helper()
+	database := setupTestDB(t)
+	f := &policyFixtures{users: map[string]uint{}, resources: map[string]uint{}}
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := database.Create(value).Error; err != nil {
+			t.Fatalf("create %T: %v", value, err)
+		}
+	}
+	organization := func(name, status string) *models.Organization {
+		t.Helper()
+		account := models.User{Username: name, Role: "brand"}
+		create(&account)
+		org := models.Organization{CompanyName: account.Username, VerificationStatus: status, AccountUserID: account.ID}
+		create(&org)
+		if err := database.Model(&account).Update("organization_id", org.ID).Error; err != nil {
+			t.Fatalf("link account: %v", err)
+		}
+		return &org
+	}
+	user := func(name string, u models.User) {
+		t.Helper()
+		u.Username = name
+		create(&u)
+		f.users[name] = u.ID
+	}
+	member := func(name string, org *models.Organization, role string) {
+		t.Helper()
+		user(name, models.User{Role: "brand", OrganizationID: &org.ID, OrganizationRole: role})
+	}
+
+	manufacturer := organization("manufacturer", "verified")
+	other := organization("other", "verified")
+	pending := organization("pending", "pending")
+
+	user("admin", models.User{Role: "admin"})
+	user("owner", models.User{Role: "regular"})
+	user("stranger", models.User{Role: "regular"})
+	member("brandOwner", manufacturer, OrgRoleOwner)
+	member("brandRegistrar", manufacturer, OrgRoleProductRegistrar)
+	member("brandViewer", manufacturer, OrgRoleViewer)
+	member("otherBrand", other, OrgRoleOwner)
+	member("pendingBrand", pending, OrgRoleOwner)
+	user("shop", models.User{Role: "repair_shop", VerificationStatus: "verified"})
+	user("pendingShop", models.User{Role: "repair_shop", VerificationStatus: "pending"})
+
+	product := func(name string, ownerID uint) {
+		t.Helper()
+		p := models.Product{SerialNumber: name, OrganizationID: manufacturer.ID, CurrentOwnerID: ownerID}
+		create(&p)
+		create(&models.ProductOwner{ProductID: p.ID, UserID: ownerID, Share: 10000})
+		f.resources[name] = p.ID
+	}
+	product("ownedProduct", f.users["owner"])
+	product("orgProduct", manufacturer.AccountUserID)
+
+	contract := func(name string, ownerID, previousOwnerID uint) {
+		t.Helper()
+		ct := models.OwnerContract{ProductID: f.resources["ownedProduct"], OwnerID: ownerID, PreviousOwnerID: previousOwnerID, ContractNumber: name}
+		create(&ct)
+		f.resources[name] = ct.ID
+	}
+	contract("ownedContract", f.users["owner"], manufacturer.AccountUserID)
+	contract("orgContract", manufacturer.AccountUserID, 0)
+
+	return f
+}
+
+// policyRouter serves every route in routePolicies behind the same
+// middleware main.go uses, with a handler that answers 204 once a request
+// gets past them. The X-User header stands in for the access token.
+func policyRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := gin.New()
+	authenticate := func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.GetHeader("X-User"), 10, 64)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("user_id", uint(id))
+	}
+	reached := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+
+	for key, action := range routePolicies {
+		method, path, _ := strings.Cut(key, " ")
+		if action == ActionPublic {
+			r.Handle(method, path, reached)
+		} else {
+			r.Handle(method, path, authenticate, ResolvePrincipal(), Authorize(), reached)
+		}
+	}
+	if err := CheckRoutePolicies(r.Routes()); err != nil {
+		t.Fatalf("check routes: %v", err)
+	}
+	return r
+}
+
+// policyCase lists who may perform action on target, or on any resource
+// when target is empty
+type policyCase struct {
+	action  string
+	target  string
+	allowed []string
+}
+
+var policyCases = []policyCase{
+	{ActionOwnAccount, "", activeFixtures},
+	{ActionRegisterPublicKey, "", []string{"brandOwner", "brandRegistrar", "otherBrand", "shop"}},
+	{ActionManagePasskeys, "", []string{"owner", "stranger"}},
+
+	{ActionRegisterProduct, "", []string{"brandOwner", "brandRegistrar", "otherBrand"}},
+	{ActionViewProduct, "ownedProduct", []string{"admin", "owner", "brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionViewProduct, "orgProduct", []string{"admin", "brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionVerifyProduct, "", activeFixtures},
+	// These requests name no event type; TestEventTypePolicies covers repairs
+	{ActionLogEvent, "ownedProduct", []string{"owner", "brandOwner", "brandRegistrar"}},
+	{ActionLogEvent, "orgProduct", []string{"brandOwner", "brandRegistrar"}},
+	{ActionProductQR, "ownedProduct", []string{"owner", "brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionProductQR, "orgProduct", []string{"brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionManageProduct, "ownedProduct", []string{"owner"}},
+	{ActionManageProduct, "orgProduct", []string{"brandOwner"}},
+	{ActionAnswerTransfer, "", []string{"admin", "owner", "stranger", "brandOwner", "otherBrand", "shop"}},
+
+	{ActionListContracts, "", activeFixtures},
+	{ActionViewContract, "ownedContract", []string{"admin", "owner", "brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionViewContract, "orgContract", []string{"admin", "brandOwner", "brandRegistrar", "brandViewer"}},
+	{ActionRegenerateContract, "ownedContract", []string{"admin", "owner"}},
+	{ActionRegenerateContract, "orgContract", []string{"admin", "brandOwner"}},
+
+	{ActionViewOrganization, "", []string{"brandOwner", "brandRegistrar", "brandViewer", "otherBrand"}},
+	{ActionManageOrganization, "", []string{"brandOwner", "otherBrand"}},
+
+	{ActionAdmin, "", []string{"admin"}},
+}
+
+func findPolicyCase(action, target string) (policyCase, bool) {
+	for _, pc := range policyCases {
+		if pc.action == action && (pc.target == "" || pc.target == target) {
+			return pc, true
+		}
+	}
+	return policyCase{}, false
+}
+
+// routeTargets returns the resources a route is requested against: both
+// products or both contracts when its :id names one, otherwise none
+func routeTargets(path string) []string {
+	switch {
+	case strings.HasPrefix(path, "/api/products/:id"):
+		return []string{"ownedProduct", "orgProduct"}
+	case strings.HasPrefix(path, "/api/contracts/:id"):
+		return []string{"ownedContract", "orgContract"}
+	}
+	return []string{""}
+}
+
+var pathParam = regexp.MustCompile(`:[A-Za-z]+`)
+
+func policyRequest(r *gin.Engine, method, path string, userID uint) int {
+	return policyRequestWithBody(r, method, path, userID, "")
+}
+
+func policyRequestWithBody(r *gin.Engine, method, path string, userID uint, body string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if userID != 0 {
+		req.Header.Set("X-User", strconv.FormatUint(uint64(userID), 10))
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestRoutePolicies(t *testing.T) {
+	f := setupPolicyFixtures(t)
+	r := policyRouter(t)
+
+	keys := make([]string, 0, len(routePolicies))
+	for key := range routePolicies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		action := routePolicies[key]
+		method, route, _ := strings.Cut(key, " ")
+		for _, target := range routeTargets(route) {
+			path := pathParam.ReplaceAllStringFunc(route, func(param string) string {
+				if param == ":id" && target != "" {
+					return strconv.FormatUint(uint64(f.resources[target]), 10)
+				}
+				return "1"
+			})
+
+			if action == ActionPublic {
+				if code := policyRequest(r, method, path, 0); code != http.StatusNoContent {
+					t.Errorf("%s: anonymous request got %d, want it let through", key, code)
+				}
+				continue
+			}
+
+			pc, ok := findPolicyCase(action, target)
+			if !ok {
+				t.Errorf("%s: no test case for action %q on %q", key, action, target)
+				continue
+			}
+			if code := policyRequest(r, method, path, 0); code != http.StatusUnauthorized {
+				t.Errorf("%s: anonymous request got %d, want 401", key, code)
+			}
+			for _, name := range append(append([]string{}, activeFixtures...), refusedFixtures...) {
+				want := http.StatusForbidden
+				if containsString(pc.allowed, name) {
+					want = http.StatusNoContent
+				}
+				if code := policyRequest(r, method, path, f.users[name]); code != want {
+					t.Errorf("%s on %s as %s: got %d, want %d", key, target, name, code, want)
+				}
+			}
+		}
+	}
+}
+
+// TestEventTypePolicies checks that repair shops can log repairs on any
+// product but nothing else on products they don't own
+func TestEventTypePolicies(t *testing.T) {
+	f := setupPolicyFixtures(t)
+	r := policyRouter(t)
+	logEvent := fmt.Sprintf("/api/products/%d/events", f.resources["ownedProduct"])
+
+	tests := []struct {
+		user, eventType string
+		want            int
+	}{
+		{"shop", "repair", http.StatusNoContent},
+		{"shop", "sale", http.StatusForbidden},
+		{"shop", "recall", http.StatusForbidden},
+		{"pendingShop", "repair", http.StatusForbidden},
+		{"owner", "sale", http.StatusNoContent},
+		{"stranger", "repair", http.StatusForbidden},
+		{"brandRegistrar", "recall", http.StatusNoContent},
+		{"brandViewer", "recall", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"event_type":%q}`, tt.eventType)
+		if code := policyRequestWithBody(r, http.MethodPost, logEvent, f.users[tt.user], body); code != tt.want {
+			t.Errorf("%s logging %s: got %d, want %d", tt.user, tt.eventType, code, tt.want)
+		}
+	}
+}
+
+// TestProductOwnershipPolicies follows a product to a new owner: viewing it
+// and logging events on it move with the ownership
+func TestProductOwnershipPolicies(t *testing.T) {
+	f := setupPolicyFixtures(t)
+	r := policyRouter(t)
+	productID := f.resources["ownedProduct"]
+	view := fmt.Sprintf("/api/products/%d", productID)
+	logEvent := view + "/events"
+
+	check := func(stage, user string, want int) {
+		t.Helper()
+		if code := policyRequest(r, http.MethodGet, view, f.users[user]); code != want {
+			t.Errorf("%s: GetProduct as %s got %d, want %d", stage, user, code, want)
+		}
+		if code := policyRequest(r, http.MethodPost, logEvent, f.users[user]); code != want {
+			t.Errorf("%s: CreateEvent as %s got %d, want %d", stage, user, code, want)
+		}
+	}
+
+	check("before transfer", "owner", http.StatusNoContent)
+	check("before transfer", "stranger", http.StatusForbidden)
+
+	if err := db.Model(&models.ProductOwner{}).Where("product_id = ?", productID).
+		Update("user_id", f.users["stranger"]).Error; err != nil {
+		t.Fatalf("transfer product: %v", err)
+	}
+	check("after transfer", "owner", http.StatusForbidden)
+	check("after transfer", "stranger", http.StatusNoContent)
+
+	if err := db.Delete(&models.Product{}, productID).Error; err != nil {
+		t.Fatalf("delete product: %v", err)
+	}
+	check("after deletion", "stranger", http.StatusNotFound)
+}
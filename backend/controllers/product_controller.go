@@ -6,9 +6,8 @@ import (
 	"backend/models"
 	"backend/utils"
 
-	"encoding/json"
-	"errors"
 	"fmt"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -25,14 +24,6 @@ type ProductInput struct {
 }
 
 func RegisterProduct(c *gin.Context) {
-	role, _ := c.Get("role")
-
-	// Only brands can register products
-	if role != "brand" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only verified brands can register products"})
-		return
-	}
-
 	var input ProductInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.String(http.StatusBadRequest, "failed to bind JSON: %v", err)
@@ -45,45 +36,60 @@ func RegisterProduct(c *gin.Context) {
 		ProductModel: input.Model,
 	}
 
-	// create the product in db
-	if err := db.Create(&product).Error; err != nil {
-		c.String(http.StatusInternalServerError, "failed to create product: %v", err)
-		return
-	}
-
 	userID := c.MustGet("user_id")
 
-	// create the event in db
-	event := models.Event{
-		ProductID: product.ID,
-		EventType: "registration",
-		EventData: `{"details": "Product registered"}`,
-		CreatedBy: userID.(uint),
+	// The product belongs to the brand's organization, not to the member
+	// who registered it
+	ownerID := principalID(c)
+	if orgID, ok := c.Get("organization_id"); ok {
+		product.OrganizationID = orgID.(uint)
 	}
 
-	if err := createEventRecord(&event); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log registration event"})
-		return
-	}
+	// create the product, its registration event and its first owner
+	// contract together; the contract PDF is rendered by the outbox workers
+	var contract *models.OwnerContract
+	err := db.Transaction(func(tx *gorm.DB) error {
+		product.CurrentOwnerID = ownerID
+		if err := tx.Create(&product).Error; err != nil {
+			return fmt.Errorf("failed to create product: %w", err)
+		}
+		if err := utils.SetProductShares(tx, product.ID, map[uint]int{ownerID: utils.FullShare}); err != nil {
+			return fmt.Errorf("failed to record owner: %w", err)
+		}
+
+		event := models.Event{
+			ProductID: product.ID,
+			EventType: "registration",
+			EventData: fmt.Sprintf(`{"details": "Product registered", "owner_id": %d}`, ownerID),
+			CreatedBy: userID.(uint),
+		}
+		if err := createEventRecord(tx, &event); err != nil {
+			return fmt.Errorf("failed to log registration event: %w", err)
+		}
 
-	// Generate owner contract
-	contract, err := utils.GenerateOwnerContract(db, product.ID, userID.(uint), 0)
+		var err error
+		contract, err = utils.CreateOwnerContract(tx, product.ID, ownerID, 0, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = utils.EnqueueContractRender(tx, contract.ID)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Warning: Failed to generate owner contract: %v\n", err)
+		c.String(http.StatusInternalServerError, "%v", err)
+		return
 	}
 
-	// Add contract info to response if created
-	response := gin.H{
+	c.JSON(http.StatusOK, gin.H{
 		"product": product,
-	}
-	if contract != nil {
-		response["contract"] = gin.H{
+		"contract": gin.H{
+			"id":              contract.ID,
 			"contract_number": contract.ContractNumber,
 			"issued_at":       contract.CreatedAt,
-		}
-	}
-
-	c.JSON(http.StatusOK, response)
+			"pdf_status":      "pending",
+		},
+	})
 }
 
 func GetProduct(c *gin.Context) {
@@ -95,7 +101,7 @@ func GetProduct(c *gin.Context) {
 	}
 
 	var events []models.Event
-	db.Where("product_id = ?", id).Order("created_at asc").Find(&events)
+	db.Where("product_id = ?", id).Order("sequence asc").Find(&events)
 
 	c.JSON(http.StatusOK, gin.H{
 		"product": product,
@@ -105,11 +111,19 @@ func GetProduct(c *gin.Context) {
 
 type TransferInput struct {
 	NewOwnerUsername string `json:"new_owner_username" binding:"required"`
+	// Optional sale price. When set, the transfer is held in escrow until
+	// the payment provider confirms payment.
+	Price    string `json:"price"`
+	Currency string `json:"currency"`
+	// Optional percentage of the sender's holding to transfer; the whole
+	// holding when empty
+	Share string `json:"share"`
 }
 
 func InitiateTransfer(c *gin.Context) {
 	productID := c.Param("id")
 	userID, _ := c.Get("user_id")
+	principal := principalID(c)
 
 	var product models.Product
 	if err := db.First(&product, productID).Error; err != nil {
@@ -117,32 +131,6 @@ func InitiateTransfer(c *gin.Context) {
 		return
 	}
 
-	var lastEvent models.Event
-	if err := db.Where("product_id = ? AND event_type = ?", productID, "ownership_transfer").Order("created_at desc").First(&lastEvent).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	var currentOwnerID uint
-	if lastEvent.ID != 0 {
-		var eventData map[string]interface{}
-		json.Unmarshal([]byte(lastEvent.EventData), &eventData)
-		currentOwnerID = uint(eventData["new_owner_id"].(float64))
-	} else {
-		// Assume initial owner is the one who registered it
-		var regEvent models.Event
-		if err := db.Where("product_id = ? AND event_type = ?", productID, "registration").First(&regEvent).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "No registration event found"})
-			return
-		}
-		currentOwnerID = regEvent.CreatedBy
-	}
-
-	if currentOwnerID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only the current owner can initiate a transfer"})
-		return
-	}
-
 	var input TransferInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -155,98 +143,208 @@ func InitiateTransfer(c *gin.Context) {
 		return
 	}
 
-	pendingTransfer := models.PendingTransfer{
-		ProductID:  product.ID,
-		NewOwnerID: newOwner.ID,
-	}
-
-	if err := db.Create(&pendingTransfer).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate transfer"})
+	if newOwner.ID == principal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You already own this product"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Transfer initiated"})
-}
+	var price *utils.Money
+	if input.Price != "" || input.Currency != "" {
+		parsed, err := utils.ParseMoney(input.Price, input.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		price = &parsed
+		if _, err := utils.Payments(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Paid transfers are not available on this server"})
+			return
+		}
+	}
 
-func ConfirmTransfer(c *gin.Context) {
-	productIDStr := c.Param("id") // Rename to avoid conflict
-	userID, _ := c.Get("user_id")
+	var requestedShare int
+	if input.Share != "" {
+		parsed, err := utils.ParseShare(input.Share)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		requestedShare = parsed
+	}
 
+	// Ownership is checked and only one offer may be open per product; the
+	// product lock keeps concurrent requests from both passing the checks
 	var pendingTransfer models.PendingTransfer
-	if err := db.Where("product_id = ? AND new_owner_id = ?", productIDStr, userID).First(&pendingTransfer).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending transfer found"})
-		return
-	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockProduct(tx, product.ID)
+		if err != nil {
+			return err
+		}
+		share, err := ownerShare(tx, locked.ID, principal)
+		if err != nil {
+			return err
+		}
+		if share == 0 {
+			return errNotCurrentOwner
+		}
+		if requestedShare == 0 {
+			requestedShare = share
+		}
+		if requestedShare > share {
+			return errShareTooLarge
+		}
 
-	event := models.Event{
-		ProductID: pendingTransfer.ProductID,
-		EventType: "ownership_transfer",
-		EventData: fmt.Sprintf(`{"new_owner_id": %d}`, pendingTransfer.NewOwnerID),
-		CreatedBy: userID.(uint),
-	}
+		var open int64
+		if err := tx.Model(&models.PendingTransfer{}).
+			Where("product_id = ? AND status IN ?", product.ID, openTransferStates).Count(&open).Error; err != nil {
+			return err
+		}
+		if open > 0 {
+			return errTransferConflict
+		}
 
-	if err := createEventRecord(&event); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log transfer event"})
+		// The offer waits for the other co-owners' consent, which a sole
+		// owner gives by making it
+		pendingTransfer = models.PendingTransfer{
+			ProductID:   product.ID,
+			NewOwnerID:  newOwner.ID,
+			InitiatedBy: principal,
+			Share:       requestedShare,
+			Status:      TransferAwaitingConsent,
+			ExpiresAt:   time.Now().Add(TransferOfferTTL()),
+		}
+		if price != nil {
+			pendingTransfer.PriceMinor = price.AmountMinor
+			pendingTransfer.Currency = price.Currency
+		}
+		if err := tx.Create(&pendingTransfer).Error; err != nil {
+			return err
+		}
+
+		eventData := fmt.Sprintf(`{"transfer_id": %d, "new_owner_id": %d, "share": %q}`,
+			pendingTransfer.ID, newOwner.ID, utils.FormatShare(requestedShare))
+		if price != nil {
+			eventData = fmt.Sprintf(`{"transfer_id": %d, "new_owner_id": %d, "share": %q, "price": %q, "currency": %q}`,
+				pendingTransfer.ID, newOwner.ID, utils.FormatShare(requestedShare), price.Decimal(), price.Currency)
+		}
+
+		event := models.Event{
+			ProductID: product.ID,
+			EventType: transferEventTypes[TransferInitiated],
+			EventData: eventData,
+			CreatedBy: userID.(uint),
+		}
+		if err := createEventRecord(tx, &event); err != nil {
+			return err
+		}
+
+		return settleConsent(tx, locked.ConsentRule, &pendingTransfer, userID.(uint))
+	})
+	if err != nil {
+		respondTransferError(c, err, "initiate")
 		return
 	}
 
-	if err := db.Delete(&pendingTransfer).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete pending transfer"})
-		return
+	response := gin.H{
+		"message":     "Transfer initiated",
+		"transfer_id": pendingTransfer.ID,
+		"status":      pendingTransfer.Status,
+		"share":       utils.FormatShare(pendingTransfer.Share),
+		"expires_at":  pendingTransfer.ExpiresAt,
+	}
+	if price != nil {
+		response["price"] = price.Decimal()
+		response["currency"] = price.Currency
 	}
+	if pendingTransfer.PaymentProvider != "" {
+		response["payment_provider"] = pendingTransfer.PaymentProvider
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-	// Use the existing variable without redeclaration
-	pID := pendingTransfer.ProductID
-	newOwnerID := pendingTransfer.NewOwnerID
-	currentOwnerID := userID.(uint)
+func ConfirmTransfer(c *gin.Context) {
+	productIDStr := c.Param("id") // Rename to avoid conflict
+	userID, _ := c.Get("user_id")
 
-	// Generate new owner contract for the transfer
-	contract, err := utils.GenerateOwnerContract(db, pID, newOwnerID, currentOwnerID)
+	// Accepting the offer, the transfer event, the new contract and its
+	// rendering job are committed together or not at all. Rendering the PDF
+	// and uploading it to IPFS happen afterwards through the outbox.
+	var contract *models.OwnerContract
+	err := db.Transaction(func(tx *gorm.DB) error {
+		pendingTransfer, err := findOpenTransfer(tx, productIDStr, "new_owner_id = ?", principalID(c))
+		if err != nil {
+			return err
+		}
+		// An escrow offer can only be accepted once paid, and a paid offer
+		// no longer expires
+		var price *utils.Money
+		switch pendingTransfer.Status {
+		case TransferAwaitingConsent:
+			return errConsentPending
+		case TransferAwaitingPayment:
+			return errPaymentPending
+		case TransferPaid:
+			price = &utils.Money{AmountMinor: pendingTransfer.PriceMinor, Currency: pendingTransfer.Currency}
+		default:
+			if !time.Now().Before(pendingTransfer.ExpiresAt) {
+				return errTransferExpired
+			}
+		}
+
+		if err := closeTransfer(tx, pendingTransfer, TransferAccepted, userID.(uint)); err != nil {
+			return err
+		}
+
+		// Record the new owner contract for the transfer
+		contract, err = utils.CreateOwnerContract(tx, pendingTransfer.ProductID, pendingTransfer.NewOwnerID, pendingTransfer.InitiatedBy, price)
+		if err != nil {
+			return err
+		}
+
+		_, err = utils.EnqueueContractRender(tx, contract.ID)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Warning: Failed to generate transfer contract: %v\n", err)
+		respondTransferError(c, err, "confirm")
+		return
 	}
 
-	response := gin.H{
+	c.JSON(http.StatusOK, gin.H{
 		"message": "Transfer confirmed",
-	}
-	if contract != nil {
-		response["contract"] = gin.H{
+		"contract": gin.H{
+			"id":              contract.ID,
 			"contract_number": contract.ContractNumber,
 			"issued_at":       contract.CreatedAt,
-		}
-	}
-
-	c.JSON(http.StatusOK, response)
+			"pdf_status":      "pending",
+		},
+	})
 }
 
 // GetUserProducts returns all products owned by the currently logged in user
 func GetUserProducts(c *gin.Context) {
-	userID, _ := c.Get("user_id")
+	userID := principalID(c)
 
-	// Find all contracts where the user is the current owner
-	var contracts []models.OwnerContract
-	if err := db.Where("owner_id = ?", userID).Find(&contracts).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user's contracts"})
+	// Find the products the user currently holds a share of; contracts are
+	// kept for past owners too, so they cannot answer this
+	var holdings []models.ProductOwner
+	if err := db.Where("user_id = ?", userID).Find(&holdings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
 	}
 
-	// Extract product IDs from the contracts
-	var productIDs []uint
-	for _, contract := range contracts {
-		productIDs = append(productIDs, contract.ProductID)
+	productIDs := make([]uint, 0, len(holdings))
+	shares := make(map[uint]int, len(holdings))
+	for _, holding := range holdings {
+		productIDs = append(productIDs, holding.ProductID)
+		shares[holding.ProductID] = holding.Share
 	}
 
-	// If user doesn't own any products, return empty array
-	if len(productIDs) == 0 {
-		c.JSON(http.StatusOK, gin.H{"products": []string{}})
-		return
-	}
-
-	// Find products by their IDs
 	var products []models.Product
-	if err := db.Where("id IN ?", productIDs).Find(&products).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
-		return
+	if len(productIDs) > 0 {
+		if err := db.Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
 	}
 
 	// Prepare response with products and their contracts
@@ -259,7 +357,7 @@ func GetUserProducts(c *gin.Context) {
 			continue // Skip if contract can't be found
 		}
 
-		// Skip if no contracts found (shouldn't happen based on our query)
+		// Skip if no contracts found (shouldn't happen for a current owner)
 		if len(productContracts) == 0 {
 			continue
 		}
@@ -280,6 +378,7 @@ func GetUserProducts(c *gin.Context) {
 			"manufacturer":  product.Manufacturer,
 			"model":         product.ProductModel,
 			"created_at":    product.CreatedAt,
+			"share":         utils.FormatShare(shares[product.ID]),
 			"contract": gin.H{
 				"id":              latestContract.ID,
 				"contract_number": latestContract.ContractNumber,
@@ -299,7 +398,7 @@ func GetUserProducts(c *gin.Context) {
 
 // GetPendingTransfersForUser retrieves all pending transfers for the current authenticated user
 func GetPendingTransfersForUser(c *gin.Context) {
-    userID, _ := c.Get("user_id")
+    userID := principalID(c)
     
     var pendingTransfers []struct {
         models.PendingTransfer
@@ -313,9 +412,10 @@ func GetPendingTransfersForUser(c *gin.Context) {
     err := db.Table("pending_transfers").
         Select("pending_transfers.*, products.product_model, products.manufacturer, products.serial_number, users.username as current_owner_username").
         Joins("JOIN products ON pending_transfers.product_id = products.id").
-        Joins("JOIN events ON products.id = events.product_id AND events.event_type = 'registration'").
-        Joins("JOIN users ON events.created_by = users.id").
-        Where("pending_transfers.new_owner_id = ?", userID).
+        Joins("LEFT JOIN users ON pending_transfers.initiated_by = users.id").
+        Where("pending_transfers.new_owner_id = ? AND pending_transfers.status IN ?", userID, openTransferStates).
+        Where("pending_transfers.expires_at > ? OR pending_transfers.status = ?", time.Now(), TransferPaid).
+        Where("pending_transfers.deleted_at IS NULL").
         Find(&pendingTransfers).Error
     
     if err != nil {
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// AccessTokenTTL is how long an access token is accepted
+func AccessTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		return 15 * time.Minute
+	}
+	return ttl
+}
+
+// RefreshTokenTTL is how long a session survives without being refreshed
+func RefreshTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// issueTokens signs a new access token for the session and stores the
+// refresh token that will replace it, returning the response for the client
+func issueTokens(tx *gorm.DB, user *models.User, sessionID string) (gin.H, error) {
+	jti, err := utils.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := utils.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	accessExpiresAt := now.Add(AccessTokenTTL())
+	tokenString, err := utils.SignJWT(jwt.MapClaims{
+		"user_id": user.ID,
+		"role":    user.Role,
+		"sid":     sessionID,
+		"jti":     jti,
+		"iat":     now.Unix(),
+		"exp":     accessExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.RefreshToken{
+		UserID:          user.ID,
+		SessionID:       sessionID,
+		TokenHash:       utils.HashRefreshToken(refreshToken),
+		AccessJTI:       jti,
+		AccessExpiresAt: accessExpiresAt,
+		ExpiresAt:       now.Add(RefreshTokenTTL()),
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":              tokenString,
+		"expires_in":         int(AccessTokenTTL().Seconds()),
+		"refresh_token":      refreshToken,
+		"refresh_expires_at": record.ExpiresAt,
+	}, nil
+}
+
+// startSession issues the first token pair of a new session after login
+func startSession(user *models.User) (gin.H, error) {
+	sessionID, err := utils.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	var response gin.H
+	err = db.Transaction(func(tx *gorm.DB) error {
+		response, err = issueTokens(tx, user, sessionID)
+		return err
+	})
+	return response, err
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token. A refresh token that was already exchanged has been copied,
+// so the session it belongs to is ended for everyone holding it.
+func RefreshSession(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var response gin.H
+	var statusError string
+	reused := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var token models.RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", utils.HashRefreshToken(input.RefreshToken)).First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errRefreshTokenInvalid
+			}
+			return err
+		}
+		if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+			return errRefreshTokenInvalid
+		}
+		if token.UsedAt != nil {
+			// The revocation has to be committed, so report the reuse
+			// after the transaction rather than by failing it
+			reused = true
+			return utils.RevokeSessions(tx, "session_id = ?", token.SessionID)
+		}
+
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			return errRefreshTokenInvalid
+		}
+		verificationStatus, err := accountVerificationStatus(tx, &user)
+		if err != nil {
+			return err
+		}
+		if statusError = accountStatusError(user.Role, verificationStatus, user.SuspendedAt != nil); statusError != "" {
+			return nil
+		}
+		// Sessions of privileged users who never set up a second factor
+		// predate it being required, and are not renewed
+		if requiresTwoFactor(user.Role) && user.TOTPEnabledAt == nil {
+			statusError = "Two-factor authentication is required, please log in again"
+			return nil
+		}
+
+		if err := tx.Model(&token).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		response, err = issueTokens(tx, &user, token.SessionID)
+		return err
+	})
+	if err == nil && reused {
+		err = errRefreshTokenReused
+	}
+	switch {
+	case errors.Is(err, errRefreshTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+	case errors.Is(err, errRefreshTokenReused):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token was already used; the session has been ended, please log in again"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+	case statusError != "":
+		c.JSON(http.StatusForbidden, gin.H{"error": statusError})
+	default:
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// Logout ends the session of the access token used for the request
+func Logout(c *gin.Context) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := utils.RevokeAccessToken(tx, c.GetString("jti"), c.GetTime("token_expires_at")); err != nil {
+			return err
+		}
+		return utils.RevokeSessions(tx, "session_id = ? AND user_id = ?", c.GetString("session_id"), c.MustGet("user_id"))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAll ends every session of the current user, on all devices
+func LogoutAll(c *gin.Context) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := utils.RevokeAccessToken(tx, c.GetString("jti"), c.GetTime("token_expires_at")); err != nil {
+			return err
+		}
+		return utils.RevokeSessions(tx, "user_id = ?", c.MustGet("user_id"))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
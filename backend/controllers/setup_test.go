@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// setupTestDB points the controllers at a fresh SQLite database holding
+// every table the server migrates, and gives them access token keys
+func setupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dir := t.TempDir()
+	database, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := database.AutoMigrate(&models.User{}, &models.Product{}, &models.Event{}, &models.PendingTransfer{}, &models.OwnerContract{},
+		&models.Checkpoint{}, &models.CheckpointEntry{}, &models.SigningKey{},
+		&models.OutboxJob{}, &models.ProductOwner{}, &models.TransferConsent{}, &models.Organization{},
+		&models.RefreshToken{}, &models.RevokedToken{}, &models.OIDCLogin{}, &models.OIDCLoginCode{},
+		&models.RecoveryCode{}, &models.LoginChallenge{}, &models.Passkey{}, &models.PasskeyCeremony{},
+		&models.LoginThrottle{}, &models.AuthEvent{}, &models.PasswordReset{},
+		&models.EmailConfirmation{}, &models.VerificationDocument{}, &models.VerificationDecision{},
+		&models.PaymentRefund{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := utils.InitJWTKeys(filepath.Join(dir, "jwt-keys"), "", nil); err != nil {
+		t.Fatalf("JWT keys: %v", err)
+	}
+
+	InitUserController(database)
+	forgetAccounts()
+	t.Cleanup(func() {
+		forgetAccounts()
+		if sqlDB, err := database.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return database
+}
+
+// callHandler runs handler on a JSON request as the user userID, or
+// anonymously when it is 0, and decodes the JSON response
+func callHandler(t *testing.T, handler gin.HandlerFunc, userID uint, body interface{}) (int, gin.H) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+	if userID != 0 {
+		c.Set("user_id", userID)
+	}
+	handler(c)
+
+	var response gin.H
+	if recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response %q: %v", recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code, response
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"backend/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transfer offer states. An offer of a share of a co-owned product starts as
+// awaiting_consent until the product's consent rule is met. An escrow offer
+// (one with a price) then waits in awaiting_payment instead of initiated and
+// becomes paid once the payment provider confirms it.
+const (
+	TransferAwaitingConsent = "awaiting_consent"
+	TransferInitiated       = "initiated"
+	TransferAwaitingPayment = "awaiting_payment"
+	TransferPaid            = "paid"
+	TransferAccepted        = "accepted"
+	TransferRejected        = "rejected"
+	TransferCancelled       = "cancelled"
+	TransferExpired         = "expired"
+)
+
+// States in which an offer is still open
+var openTransferStates = []string{TransferAwaitingConsent, TransferInitiated, TransferAwaitingPayment, TransferPaid}
+
+// Chain event logged for each state an offer can move into
+var transferEventTypes = map[string]string{
+	TransferInitiated: "transfer_initiated",
+	TransferPaid:      "transfer_paid",
+	TransferAccepted:  "ownership_transfer",
+	TransferRejected:  "transfer_rejected",
+	TransferCancelled: "transfer_cancelled",
+	TransferExpired:   "transfer_expired",
+}
+
+var (
+	errNoOpenTransfer   = errors.New("no open transfer")
+	errTransferExpired  = errors.New("transfer offer has expired")
+	errTransferConflict = errors.New("product already has an open transfer offer")
+	errPaymentPending   = errors.New("payment has not been confirmed")
+	errTransferPaid     = errors.New("transfer offer has already been paid")
+	errConsentPending   = errors.New("co-owners have not consented")
+)
+
+// TransferOfferTTL is how long a recipient has to accept an offer
+func TransferOfferTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("TRANSFER_OFFER_TTL"))
+	if err != nil || ttl <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// lockProduct takes the product row lock that every change to a product's
+// chain or transfer offers goes through. Taking it first keeps the lock
+// order the same everywhere.
+func lockProduct(tx *gorm.DB, productID interface{}) (*models.Product, error) {
+	var product models.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productID).Error; err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// findOpenTransfer locks the product and its open offer. extra narrows the
+// lookup to the offer a given user may act on.
+func findOpenTransfer(tx *gorm.DB, productID interface{}, extra string, args ...interface{}) (*models.PendingTransfer, error) {
+	if _, err := lockProduct(tx, productID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errNoOpenTransfer
+		}
+		return nil, err
+	}
+
+	var transfer models.PendingTransfer
+	query := tx.Where("product_id = ? AND status IN ?", productID, openTransferStates)
+	if extra != "" {
+		query = query.Where(extra, args...)
+	}
+	if err := query.First(&transfer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errNoOpenTransfer
+		}
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// closeTransfer moves an open offer into a final state and logs the change
+// on the product's chain
+func closeTransfer(tx *gorm.DB, transfer *models.PendingTransfer, status string, actorID uint) error {
+	now := time.Now()
+	transfer.Status = status
+	transfer.ResolvedAt = &now
+	transfer.ResolvedBy = actorID
+	if err := tx.Save(transfer).Error; err != nil {
+		return fmt.Errorf("failed to update transfer: %w", err)
+	}
+
+	if status == TransferAccepted {
+		if err := moveShare(tx, transfer); err != nil {
+			return fmt.Errorf("failed to update owners: %w", err)
+		}
+	}
+
+	event := models.Event{
+		ProductID: transfer.ProductID,
+		EventType: transferEventTypes[status],
+		EventData: transferEventData(transfer),
+		CreatedBy: actorID,
+	}
+	if err := createEventRecord(tx, &event); err != nil {
+		return fmt.Errorf("failed to log transfer event: %w", err)
+	}
+	return nil
+}
+
+// respondTransferError maps the errors of the transfer flow to responses
+func respondTransferError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, errNoOpenTransfer):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending transfer found"})
+	case errors.Is(err, errTransferExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "The transfer offer has expired"})
+	case errors.Is(err, errTransferConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "This product already has an open transfer offer"})
+	case errors.Is(err, errPaymentPending):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Payment for this transfer has not been confirmed yet"})
+	case errors.Is(err, errTransferPaid):
+		c.JSON(http.StatusConflict, gin.H{"error": "This transfer has been paid for; only the recipient can close it"})
+	case errors.Is(err, errConsentPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "The co-owners have not yet consented to this transfer"})
+	case errors.Is(err, errNotCurrentOwner):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only an owner of this product can initiate a transfer"})
+	case errors.Is(err, errShareTooLarge):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot offer more than your share of this product"})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " transfer"})
+	}
+}
+
+// RejectTransfer lets the recipient decline an open offer
+func RejectTransfer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		transfer, err := findOpenTransfer(tx, c.Param("id"), "new_owner_id = ?", principalID(c))
+		if err != nil {
+			return err
+		}
+		return closeTransfer(tx, transfer, TransferRejected, userID.(uint))
+	})
+	if err != nil {
+		respondTransferError(c, err, "reject")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Transfer rejected"})
+}
+
+// CancelTransfer lets the sender withdraw an open offer
+func CancelTransfer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		transfer, err := findOpenTransfer(tx, c.Param("id"), "initiated_by = ?", principalID(c))
+		if err != nil {
+			return err
+		}
+		// The buyer has paid, so the seller can no longer back out
+		if transfer.Status == TransferPaid {
+			return errTransferPaid
+		}
+		return closeTransfer(tx, transfer, TransferCancelled, userID.(uint))
+	})
+	if err != nil {
+		respondTransferError(c, err, "cancel")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Transfer cancelled"})
+}
+
+// GetOutgoingTransfersForUser lists the open offers the current user has made
+func GetOutgoingTransfersForUser(c *gin.Context) {
+	userID := principalID(c)
+
+	var transfers []models.PendingTransfer
+	if err := db.Where("initiated_by = ? AND status IN ?", userID, openTransferStates).
+		Where("expires_at > ? OR status = ?", time.Now(), TransferPaid).
+		Order("created_at desc").Find(&transfers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve outgoing transfers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"outgoing_transfers": transfers})
+}
+
+// expireTransfers closes every open offer whose deadline has passed. Paid
+// offers never expire; the buyer's payment has to be settled by the recipient
+// accepting or rejecting.
+func expireTransfers() {
+	var due []models.PendingTransfer
+	if err := db.Select("id", "product_id").
+		Where("status IN ? AND expires_at <= ?", []string{TransferAwaitingConsent, TransferInitiated, TransferAwaitingPayment}, time.Now()).
+		Find(&due).Error; err != nil {
+		fmt.Printf("Warning: Failed to look up expired transfers: %v\n", err)
+		return
+	}
+
+	for _, t := range due {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			transfer, err := findOpenTransfer(tx, t.ProductID, "id = ? AND status <> ? AND expires_at <= ?", t.ID, TransferPaid, time.Now())
+			if err != nil {
+				return err
+			}
+			return closeTransfer(tx, transfer, TransferExpired, 0)
+		})
+		if err != nil && !errors.Is(err, errNoOpenTransfer) {
+			fmt.Printf("Warning: Failed to expire transfer %d: %v\n", t.ID, err)
+		}
+	}
+}
+
+// StartTransferExpiry periodically expires offers that were never answered
+func StartTransferExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expireTransfers()
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,482 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Name authenticator apps show for the account
+	totpIssuer = "VeriOwn"
+	// How long a user has to enter the second factor after the password
+	loginChallengeTTL = 5 * time.Minute
+	// Wrong codes allowed before the login has to start over
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+var (
+	errChallengeInvalid    = errors.New("invalid login challenge")
+	errTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+)
+
+// requiresTwoFactor reports whether a role must sign in with a second
+// factor. These are the roles that verify accounts and vouch for products.
+func requiresTwoFactor(role string) bool {
+	return role == "admin" || role == "brand" || role == "repair_shop"
+}
+
+// beginLogin is called once a user has proven their identity with a
+// password or single sign-on. A user with a second factor, or whose role
+// requires one, gets a challenge to answer instead of tokens.
+func beginLogin(user *models.User) (gin.H, error) {
+	if user.TOTPEnabledAt == nil && !requiresTwoFactor(user.Role) {
+		return startSession(user)
+	}
+
+	token, err := utils.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+	challenge := models.LoginChallenge{
+		UserID:    user.ID,
+		TokenHash: utils.HashRefreshToken(token),
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	}
+
+	// Challenges that were never answered are dropped here
+	db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.LoginChallenge{})
+	if err := db.Create(&challenge).Error; err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"mfa_required":            true,
+		"mfa_enrollment_required": user.TOTPEnabledAt == nil,
+		"challenge_token":         token,
+		"challenge_expires_at":    challenge.ExpiresAt,
+	}, nil
+}
+
+// findChallenge returns the open login challenge for a token
+func findChallenge(tx *gorm.DB, token string) (*models.LoginChallenge, error) {
+	var challenge models.LoginChallenge
+	err := tx.Where("token_hash = ? AND expires_at > ?", utils.HashRefreshToken(token), time.Now()).First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errChallengeInvalid
+	}
+	return &challenge, err
+}
+
+// newTOTPEnrollment gives a user without a second factor a fresh secret to
+// add to their authenticator app. It is enabled once a code from the app
+// confirms the user has it.
+func newTOTPEnrollment(user *models.User) (gin.H, error) {
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := utils.SealTOTPSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"totp_secret":    sealed,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	uri := utils.TOTPProvisioningURI(totpIssuer, user.Username, secret)
+	qrCode, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"secret":      secret,
+		"otpauth_url": uri,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode),
+	}, nil
+}
+
+// checkTOTP verifies a code from the user's authenticator and records its
+// time step so the same code cannot be used again
+func checkTOTP(tx *gorm.DB, user *models.User, code string) (bool, error) {
+	if user.TOTPSecret == "" {
+		return false, errTwoFactorNotEnabled
+	}
+	secret, err := utils.OpenTOTPSecret(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := utils.ValidateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	return true, tx.Model(user).Update("totp_last_step", step).Error
+}
+
+// useRecoveryCode spends one of the user's recovery codes
+func useRecoveryCode(tx *gorm.DB, user *models.User, code string) (bool, error) {
+	var recovery models.RecoveryCode
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashRecoveryCode(code)).
+		First(&recovery).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Model(&recovery).Update("used_at", time.Now()).Error
+}
+
+// enableTOTP turns on the second factor after its first code and returns a
+// new set of recovery codes, replacing any earlier ones
+func enableTOTP(tx *gorm.DB, user *models.User) ([]string, error) {
+	now := time.Now()
+	if err := tx.Model(user).Update("totp_enabled_at", now).Error; err != nil {
+		return nil, err
+	}
+	user.TOTPEnabledAt = &now
+	return replaceRecoveryCodes(tx, user.ID)
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	codes, err := utils.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	records := make([]models.RecoveryCode, len(codes))
+	for i, code := range codes {
+		records[i] = models.RecoveryCode{UserID: userID, CodeHash: utils.HashRecoveryCode(code)}
+	}
+	return codes, tx.Create(&records).Error
+}
+
+type LoginChallengeInput struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+// EnrollLoginTwoFactor sets up a second factor during login, for a user
+// whose role requires one and who has none yet
+func EnrollLoginTwoFactor(c *gin.Context) {
+	var input LoginChallengeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := findChallenge(db, input.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login challenge, please log in again"})
+		return
+	}
+	var user models.User
+	if err := db.First(&user, challenge.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login challenge, please log in again"})
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+
+	enrollment, err := newTOTPEnrollment(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+type LoginTwoFactorInput struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// CompleteLoginTwoFactor answers a login challenge with a code from the
+// authenticator, or a recovery code, and starts the session. The first code
+// after enrollment also enables the second factor.
+func CompleteLoginTwoFactor(c *gin.Context) {
+	var input LoginTwoFactorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (input.Code == "") == (input.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either code or recovery_code"})
+		return
+	}
+
+	// Wrong codes count towards the account's lockout like wrong passwords,
+	// so starting new challenges does not give more guesses
+	var loginUser models.User
+	challenge, err := findChallenge(db, input.ChallengeToken)
+	if err == nil {
+		err = db.First(&loginUser, challenge.UserID).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login challenge, please log in again"})
+		return
+	}
+	if loginThrottled(c, loginUser.Username) {
+		return
+	}
+	method := "totp"
+	if input.RecoveryCode != "" {
+		method = "recovery_code"
+	}
+
+	var response gin.H
+	var statusError string
+	var recoveryCodes []string
+	wrongCode := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		challenge, err := findChallenge(tx.Clauses(clause.Locking{Strength: "UPDATE"}), input.ChallengeToken)
+		if err != nil {
+			return err
+		}
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, challenge.UserID).Error; err != nil {
+			return errChallengeInvalid
+		}
+
+		var ok bool
+		if input.RecoveryCode != "" {
+			if user.TOTPEnabledAt == nil {
+				return errTwoFactorNotEnabled
+			}
+			ok, err = useRecoveryCode(tx, &user, input.RecoveryCode)
+		} else {
+			ok, err = checkTOTP(tx, &user, input.Code)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// The failed attempt has to be counted, so report it after the
+			// transaction rather than by failing it
+			wrongCode = true
+			if challenge.Attempts+1 >= maxChallengeAttempts {
+				return tx.Unscoped().Delete(challenge).Error
+			}
+			return tx.Model(challenge).Update("attempts", gorm.Expr("attempts + 1")).Error
+		}
+
+		if err := tx.Unscoped().Delete(challenge).Error; err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt == nil {
+			if recoveryCodes, err = enableTOTP(tx, &user); err != nil {
+				return err
+			}
+		}
+
+		// The account may have changed while the challenge was open
+		verificationStatus, err := accountVerificationStatus(tx, &user)
+		if err != nil {
+			return err
+		}
+		if statusError = accountStatusError(user.Role, verificationStatus, user.SuspendedAt != nil); statusError != "" {
+			return nil
+		}
+
+		sessionID, err := utils.NewTokenID()
+		if err != nil {
+			return err
+		}
+		response, err = issueTokens(tx, &user, sessionID)
+		return err
+	})
+	switch {
+	case errors.Is(err, errChallengeInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login challenge, please log in again"})
+	case errors.Is(err, errTwoFactorNotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set up two-factor authentication first"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+	case wrongCode:
+		recordLoginFailure(c, loginUser.Username, &loginUser, method, "wrong code")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+	case statusError != "":
+		c.JSON(http.StatusForbidden, gin.H{"error": statusError})
+	default:
+		loginSucceeded(c, &loginUser, method)
+		if recoveryCodes != nil {
+			response["recovery_codes"] = recoveryCodes
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// StartTwoFactorEnrollment sets up a second factor for the current user
+func StartTwoFactorEnrollment(c *gin.Context) {
+	var user models.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+
+	enrollment, err := newTOTPEnrollment(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+type TwoFactorCodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// withTOTPCode runs action for the current user once the code from their
+// authenticator checks out
+func withTOTPCode(c *gin.Context, action func(tx *gorm.DB, user *models.User) error) error {
+	var input TwoFactorCodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return err
+	}
+
+	wrongCode := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, c.MustGet("user_id")).Error; err != nil {
+			return err
+		}
+		ok, err := checkTOTP(tx, &user, input.Code)
+		if err != nil || !ok {
+			wrongCode = !ok
+			return err
+		}
+		return action(tx, &user)
+	})
+	switch {
+	case errors.Is(err, errTwoFactorNotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor enrollment first"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update two-factor authentication"})
+	case wrongCode:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		err = errors.New("invalid two-factor code")
+	}
+	return err
+}
+
+// ConfirmTwoFactor enables the second factor with the first code from the
+// authenticator app and returns the recovery codes
+func ConfirmTwoFactor(c *gin.Context) {
+	var codes []string
+	err := withTOTPCode(c, func(tx *gorm.DB, user *models.User) error {
+		if user.TOTPEnabledAt != nil {
+			return nil
+		}
+		var err error
+		codes, err = enableTOTP(tx, user)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if codes == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var codes []string
+	err := withTOTPCode(c, func(tx *gorm.DB, user *models.User) error {
+		if user.TOTPEnabledAt == nil {
+			return errTwoFactorNotEnabled
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns off the second factor, for roles that may sign in
+// without one
+func DisableTwoFactor(c *gin.Context) {
+	if requiresTwoFactor(c.GetString("role")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+
+	err := withTOTPCode(c, func(tx *gorm.DB, user *models.User) error {
+		return clearTwoFactor(tx, user.ID)
+	})
+	if err != nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// clearTwoFactor removes a user's second factor and recovery codes
+func clearTwoFactor(tx *gorm.DB, userID uint) error {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"totp_secret":     "",
+		"totp_enabled_at": nil,
+		"totp_last_step":  0,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
+
+// ResetTwoFactor removes the second factor of a user who lost both their
+// authenticator and their recovery codes, and ends their sessions. They set
+// up a new one at their next login.
+func ResetTwoFactor(c *gin.Context) {
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := clearTwoFactor(tx, user.ID); err != nil {
+			return err
+		}
+		return utils.RevokeSessions(tx, "user_id = ?", user.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+	adminID := c.MustGet("user_id").(uint)
+	auditAuth(c, models.AuthEvent{Event: "two_factor_reset", UserID: &user.ID, Username: user.Username, ActorID: &adminID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset", "user_id": user.ID})
+}
@@ -2,18 +2,17 @@ package controllers
 
 import (
 	"backend/models"
+	"backend/utils"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
-var jwtSecret = []byte("dK8xP3qZ7rT2vF5yJ9cM4bN6hG1wS0aE5dR8fL3xV7tP")
-
 var db *gorm.DB
 
 func InitUserController(database *gorm.DB) {
@@ -23,25 +22,31 @@ func InitUserController(database *gorm.DB) {
 type RegularUserInput struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// Optional, for password reset links
+	Email string `json:"email" binding:"omitempty,email"`
 }
 
+// Brands and repair shops register with JSON, or with a multipart form that
+// also carries their verification documents
 type BrandRegisterInput struct {
-	Username       string `json:"username" binding:"required"`
-	Password       string `json:"password" binding:"required"`
-	CompanyName    string `json:"company_name" binding:"required"`
-	TaxID          string `json:"tax_id" binding:"required"`
-	ContactEmail   string `json:"contact_email" binding:"required,email"`
-	OfficialDomain string `json:"official_domain" binding:"required"`
+	Username       string `json:"username" form:"username" binding:"required"`
+	Password       string `json:"password" form:"password" binding:"required"`
+	CompanyName    string `json:"company_name" form:"company_name" binding:"required"`
+	TaxID          string `json:"tax_id" form:"tax_id" binding:"required"`
+	ContactEmail   string `json:"contact_email" form:"contact_email" binding:"required,email"`
+	OfficialDomain string `json:"official_domain" form:"official_domain" binding:"required"`
 }
 
 type RepairShopRegisterInput struct {
-	Username           string `json:"username" binding:"required"`
-	Password           string `json:"password" binding:"required"`
-	BusinessName       string `json:"business_name" binding:"required"`
-	BusinessLicense    string `json:"business_license" binding:"required"`
-	LocationAddress    string `json:"location_address" binding:"required"`
-	CertificationProof string `json:"certification_proof" binding:"required"`
-	ContactEmail       string `json:"contact_email" binding:"required,email"`
+	Username        string `json:"username" form:"username" binding:"required"`
+	Password        string `json:"password" form:"password" binding:"required"`
+	BusinessName    string `json:"business_name" form:"business_name" binding:"required"`
+	BusinessLicense string `json:"business_license" form:"business_license" binding:"required"`
+	LocationAddress string `json:"location_address" form:"location_address" binding:"required"`
+	// A link to or description of the certification; optional when the
+	// certification document is uploaded
+	CertificationProof string `json:"certification_proof" form:"certification_proof"`
+	ContactEmail       string `json:"contact_email" form:"contact_email" binding:"required,email"`
 }
 
 type RegisterInput struct {
@@ -57,6 +62,14 @@ func RegisterUser(c *gin.Context) {
 		return
 	}
 
+	if strings.HasPrefix(input.Username, orgAccountPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames starting with " + orgAccountPrefix + " are reserved"})
+		return
+	}
+	if !passwordAccepted(c, input.Password, input.Username) {
+		return
+	}
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
@@ -84,6 +97,14 @@ func RegisterRegularUser(c *gin.Context) {
 		return
 	}
 
+	if strings.HasPrefix(input.Username, orgAccountPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames starting with " + orgAccountPrefix + " are reserved"})
+		return
+	}
+	if !passwordAccepted(c, input.Password, input.Username) {
+		return
+	}
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
@@ -94,6 +115,7 @@ func RegisterRegularUser(c *gin.Context) {
 		Username:     input.Username,
 		PasswordHash: string(hash),
 		Role:         "regular",
+		ContactEmail: strings.ToLower(input.Email),
 	}
 
 	if err := db.Create(&user).Error; err != nil {
@@ -105,58 +127,154 @@ func RegisterRegularUser(c *gin.Context) {
 }
 
 func RegisterBrand(c *gin.Context) {
+	if !verificationRequestAccepted(c) {
+		return
+	}
 	var input BrandRegisterInput
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := c.ShouldBind(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if strings.HasPrefix(input.Username, orgAccountPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames starting with " + orgAccountPrefix + " are reserved"})
+		return
+	}
+	if !passwordAccepted(c, input.Password, input.Username) {
+		return
+	}
+
 	// Domain validation - check if email matches official domain
-	if !strings.HasSuffix(input.ContactEmail, "@"+input.OfficialDomain) {
+	if !utils.EmailInDomain(input.ContactEmail, input.OfficialDomain) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email must match the official domain"})
 		return
 	}
 
+	docs, err := readVerificationDocuments(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
-	user := models.User{
-		Username:           input.Username,
-		PasswordHash:       string(hash),
-		Role:               "brand",
-		CompanyName:        input.CompanyName,
-		TaxID:              input.TaxID,
-		ContactEmail:       input.ContactEmail,
-		OfficialDomain:     input.OfficialDomain,
-		VerificationStatus: "pending", // Brands need verification
+	// The registrant proves control of the domain by publishing this token
+	// in DNS
+	domainChallenge, err := utils.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create brand"})
+		return
+	}
+	documents, err := storeVerificationDocuments(docs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store documents"})
+		return
 	}
 
-	if err := db.Create(&user).Error; err != nil {
+	// The organization holds the verification data and, through its
+	// account, owns the products its members register. The registering user
+	// becomes its first owner.
+	var user models.User
+	var org models.Organization
+	err = db.Transaction(func(tx *gorm.DB) error {
+		org = models.Organization{
+			CompanyName:        input.CompanyName,
+			TaxID:              input.TaxID,
+			ContactEmail:       input.ContactEmail,
+			OfficialDomain:     input.OfficialDomain,
+			VerificationStatus: "pending", // Brands need verification
+			DomainChallenge:    domainChallenge,
+		}
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+
+		account := models.User{
+			Username:       fmt.Sprintf("%s%d", orgAccountPrefix, org.ID),
+			Role:           "brand",
+			OrganizationID: &org.ID,
+		}
+		if err := tx.Create(&account).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&org).Update("account_user_id", account.ID).Error; err != nil {
+			return err
+		}
+
+		user = models.User{
+			Username:         input.Username,
+			PasswordHash:     string(hash),
+			Role:             "brand",
+			ContactEmail:     input.ContactEmail,
+			OrganizationID:   &org.ID,
+			OrganizationRole: OrgRoleOwner,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return saveVerificationDocuments(tx, documents, &user)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create brand"})
 		return
 	}
 
+	// The registration stands even if the mail fails; the link can be sent
+	// again
+	if _, err := sendEmailConfirmation(&org); err != nil {
+		fmt.Printf("Warning: Failed to send email confirmation: %v\n", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Brand registration submitted for verification",
-		"user_id": user.ID,
+		"message":             "Brand registration submitted for verification. Confirm the contact email and publish the DNS record to prove ownership of the domain.",
+		"user_id":             user.ID,
+		"organization_id":     org.ID,
+		"domain_verification": domainChallengeInstructions(&org),
 	})
 }
 
 func RegisterRepairShop(c *gin.Context) {
+	if !verificationRequestAccepted(c) {
+		return
+	}
 	var input RepairShopRegisterInput
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := c.ShouldBind(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if strings.HasPrefix(input.Username, orgAccountPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames starting with " + orgAccountPrefix + " are reserved"})
+		return
+	}
+	if !passwordAccepted(c, input.Password, input.Username) {
+		return
+	}
+
+	docs, err := readVerificationDocuments(c)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if input.CertificationProof == "" && !hasDocument(docs, "certification") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "certification_proof or certification_file is required"})
+		return
+	}
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
+	documents, err := storeVerificationDocuments(docs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store documents"})
+		return
+	}
 
 	user := models.User{
 		Username:           input.Username,
@@ -170,14 +288,21 @@ func RegisterRepairShop(c *gin.Context) {
 		VerificationStatus: "pending", // Repair shops need verification
 	}
 
-	if err := db.Create(&user).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return saveVerificationDocuments(tx, documents, &user)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create repair shop"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Repair shop registration submitted for verification",
-		"user_id": user.ID,
+		"message":   "Repair shop registration submitted for verification",
+		"user_id":   user.ID,
+		"documents": len(documents),
 	})
 }
 
@@ -193,59 +318,83 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	if loginThrottled(c, LoginInput.Username) {
+		return
+	}
+
 	var user models.User
 	if err := db.First(&user, "username = ?", LoginInput.Username).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(LoginInput.Password))
+		loginFailed(c, LoginInput.Username, nil, "password", "unknown username")
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(LoginInput.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, LoginInput.Username, &user, "password", "wrong password")
 		return
 	}
 
-	// Check verification status for brand and repair shop
-	if (user.Role == "brand" || user.Role == "repair_shop") && user.VerificationStatus != "verified" {
-		if user.VerificationStatus == "pending" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Your account is pending verification"})
-		} else {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Your account verification was rejected"})
+	// Check verification status for brand and repair shop; a brand member is
+	// verified through its organization
+	verificationStatus, err := accountVerificationStatus(db, &user)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your organization could not be found"})
+		return
+	}
+	if msg := accountStatusError(user.Role, verificationStatus, user.SuspendedAt != nil); msg != "" {
+		response := gin.H{"error": msg}
+		if verificationStatus == "rejected" && user.SuspendedAt == nil {
+			response["rejection_reason"] = latestRejectionReason(&user)
 		}
+		c.JSON(http.StatusForbidden, response)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	tokenString, err := token.SignedString(jwtSecret)
+	// A short-lived access token plus the refresh token that renews it, or
+	// the second factor challenge that leads to them
+	response, err := beginLogin(&user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	if response["mfa_required"] == nil {
+		loginSucceeded(c, &user, "password")
+	}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+	c.JSON(http.StatusOK, response)
 }
 
 type VerificationInput struct {
 	Status string `json:"status" binding:"required,oneof=verified rejected"`
+	// Required when rejecting; the applicant is told it
+	Reason string `json:"reason"`
+	// For other admins only
+	Notes string `json:"notes"`
 }
 
-func VerifyUser(c *gin.Context) {
-	// Only admins can verify users
-	role, _ := c.Get("role")
-	if role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can verify users"})
-		return
+// bindVerificationInput reads an admin's decision, which must give a reason
+// for a rejection
+func bindVerificationInput(c *gin.Context) (*VerificationInput, bool) {
+	var input VerificationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Status == "rejected" && input.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required to reject a verification"})
+		return nil, false
 	}
+	return &input, true
+}
 
+// VerifyUser approves or rejects a repair shop, or the organization of a
+// brand member. The decision is added to the account's verification history.
+func VerifyUser(c *gin.Context) {
 	userID := c.Param("id")
 
-	var input VerificationInput
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	input, ok := bindVerificationInput(c)
+	if !ok {
 		return
 	}
 
@@ -261,30 +410,146 @@ func VerifyUser(c *gin.Context) {
 		return
 	}
 
-	user.VerificationStatus = input.Status
-	if err := db.Save(&user).Error; err != nil {
+	adminID := c.MustGet("user_id").(uint)
+	var decision *models.VerificationDecision
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		decision, err = decideVerification(tx, &user, &adminID, input.Status, input.Reason, input.Notes)
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update verification status"})
 		return
 	}
+	// A brand is verified as an organization, which all its members share
+	if user.OrganizationID != nil {
+		forgetAccounts()
+	} else {
+		forgetAccount(user.ID)
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User verification status updated"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "User verification status updated",
+		"decision": verificationDecisionJSON(*decision),
+	})
+}
+
+// PendingVerification is an account awaiting verification with the details
+// it applied with, the documents it uploaded and its earlier decisions.
+// Brands also carry the evidence gathered for their organization.
+type PendingVerification struct {
+	ID                 uint           `json:"id"`
+	Username           string         `json:"username"`
+	Role               string         `json:"role"`
+	CompanyName        string         `json:"company_name"`
+	TaxID              string         `json:"tax_id,omitempty"`
+	OfficialDomain     string         `json:"official_domain,omitempty"`
+	BusinessLicense    string         `json:"business_license,omitempty"`
+	LocationAddress    string         `json:"location_address,omitempty"`
+	CertificationProof string         `json:"certification_proof,omitempty"`
+	ContactEmail       string         `json:"contact_email"`
+	VerificationStatus string         `json:"verification_status"`
+	CreatedAt          time.Time      `json:"created_at"`
+	Evidence           *BrandEvidence `json:"evidence,omitempty"`
+	Documents          []gin.H        `json:"documents"`
+	Decisions          []gin.H        `json:"decisions"`
+}
+
+func pendingVerification(user *models.User) (PendingVerification, error) {
+	docs, decisions, err := verificationRecords(user)
+	if err != nil {
+		return PendingVerification{}, err
+	}
+	return PendingVerification{
+		ID:                 user.ID,
+		Username:           user.Username,
+		Role:               user.Role,
+		CompanyName:        user.CompanyName,
+		TaxID:              user.TaxID,
+		OfficialDomain:     user.OfficialDomain,
+		BusinessLicense:    user.BusinessLicense,
+		LocationAddress:    user.LocationAddress,
+		CertificationProof: user.CertificationProof,
+		ContactEmail:       user.ContactEmail,
+		VerificationStatus: user.VerificationStatus,
+		CreatedAt:          user.CreatedAt,
+		Documents:          docs,
+		Decisions:          decisions,
+	}, nil
 }
 
 func GetPendingVerifications(c *gin.Context) {
-	// Only admins can view pending verifications
-	role, _ := c.Get("role")
-	if role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can view pending verifications"})
+	var users []models.User
+	if err := db.Where("verification_status = ? AND organization_id IS NULL", "pending").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pending verifications"})
 		return
 	}
+	pending := make([]PendingVerification, 0, len(users))
+	for i := range users {
+		entry, err := pendingVerification(&users[i])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pending verifications"})
+			return
+		}
+		pending = append(pending, entry)
+	}
 
-	var users []models.User
-	if err := db.Where("verification_status = ?", "pending").Find(&users).Error; err != nil {
+	// Brands are verified as organizations; each pending one is listed as
+	// its first owner carrying the organization's details, so verifying
+	// that user verifies the organization
+	var orgs []models.Organization
+	if err := db.Where("verification_status = ?", "pending").Find(&orgs).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pending verifications"})
 		return
 	}
+	for _, org := range orgs {
+		var owner models.User
+		if err := db.Where("organization_id = ? AND organization_role = ?", org.ID, OrgRoleOwner).
+			Order("id asc").First(&owner).Error; err != nil {
+			continue
+		}
+		owner.CompanyName = org.CompanyName
+		owner.TaxID = org.TaxID
+		owner.ContactEmail = org.ContactEmail
+		owner.OfficialDomain = org.OfficialDomain
+		owner.VerificationStatus = org.VerificationStatus
+		entry, err := pendingVerification(&owner)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pending verifications"})
+			return
+		}
+		entry.Evidence = brandEvidence(&org)
+		pending = append(pending, entry)
+	}
+
+	c.JSON(http.StatusOK, pending)
+}
+
+type PublicKeyInput struct {
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+// RegisterPublicKey stores the Ed25519 key a brand or repair shop uses to sign
+// events on its own side
+func RegisterPublicKey(c *gin.Context) {
+	var input PublicKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := utils.ParseActorPublicKey(input.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	if err := db.Model(&models.User{}).Where("id = ?", userID).Update("public_key", input.PublicKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save public key"})
+		return
+	}
 
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusOK, gin.H{"message": "Public key registered"})
 }
 
 // GetUserInfo returns basic info about the currently authenticated user
@@ -298,8 +563,11 @@ func GetUserInfo(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":       user.ID,
-		"username": user.Username,
-		"role":     user.Role,
+		"id":                 user.ID,
+		"username":           user.Username,
+		"role":               user.Role,
+		"organization_id":    user.OrganizationID,
+		"organization_role":  user.OrganizationRole,
+		"two_factor_enabled": user.TOTPEnabledAt != nil,
 	})
 }
@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"backend/models"
+	"backend/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// Largest verification document accepted
+	maxDocumentSize = 10 << 20
+	// Largest request that may carry verification documents: one of each
+	// kind, with room for the other form fields
+	maxVerificationRequestSize = 3*maxDocumentSize + 1<<20
+)
+
+// Kinds of verification documents. Each is uploaded in the multipart form
+// field "<kind>_file".
+var documentKinds = []string{"business_license", "certification", "other"}
+
+// Documents are accepted by their content, not by what the client claims
+var documentContentTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+}
+
+// uploadedDocument is a verification document read from a request, not yet
+// stored
+type uploadedDocument struct {
+	kind        string
+	fileName    string
+	contentType string
+	data        []byte
+}
+
+// verificationRequestAccepted caps the size of a request that may carry
+// verification documents and reads its form, answering a request over the
+// cap. It reports whether the request can be handled.
+func verificationRequestAccepted(c *gin.Context) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxVerificationRequestSize)
+
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	if mediaType != "multipart/form-data" {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if _, err := c.MultipartForm(); errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request is larger than %d MB", maxVerificationRequestSize>>20)})
+		return false
+	}
+	return true
+}
+
+// readVerificationDocuments reads the documents of a multipart request. A
+// request that is not multipart has none. The error is meant for the user.
+func readVerificationDocuments(c *gin.Context) ([]uploadedDocument, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	if mediaType != "multipart/form-data" {
+		return nil, nil
+	}
+
+	var docs []uploadedDocument
+	for _, kind := range documentKinds {
+		header, err := c.FormFile(kind + "_file")
+		if errors.Is(err, http.ErrMissingFile) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_file: %w", kind, err)
+		}
+		if header.Size > maxDocumentSize {
+			return nil, fmt.Errorf("%s_file is larger than %d MB", kind, maxDocumentSize>>20)
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_file: %w", kind, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxDocumentSize+1))
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_file: %w", kind, err)
+		}
+		if len(data) > maxDocumentSize {
+			return nil, fmt.Errorf("%s_file is larger than %d MB", kind, maxDocumentSize>>20)
+		}
+
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+		if _, ok := documentContentTypes[contentType]; !ok {
+			return nil, fmt.Errorf("%s_file must be a PDF, PNG or JPEG file", kind)
+		}
+
+		name := filepath.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		docs = append(docs, uploadedDocument{kind: kind, fileName: name, contentType: contentType, data: data})
+	}
+	return docs, nil
+}
+
+// hasDocument reports whether docs include one of kind
+func hasDocument(docs []uploadedDocument, kind string) bool {
+	for _, doc := range docs {
+		if doc.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// storeVerificationDocuments puts the documents in the document store and
+// returns their records, to be saved with the applicant once it exists
+func storeVerificationDocuments(docs []uploadedDocument) ([]models.VerificationDocument, error) {
+	records := make([]models.VerificationDocument, 0, len(docs))
+	for _, doc := range docs {
+		store, ref, err := utils.StoreDocument(doc.data)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(doc.data)
+		records = append(records, models.VerificationDocument{
+			Kind:        doc.kind,
+			FileName:    doc.fileName,
+			ContentType: doc.contentType,
+			Size:        int64(len(doc.data)),
+			SHA256:      hex.EncodeToString(sum[:]),
+			Store:       store,
+			Ref:         ref,
+		})
+	}
+	return records, nil
+}
+
+// saveVerificationDocuments records stored documents as uploaded by user
+func saveVerificationDocuments(tx *gorm.DB, records []models.VerificationDocument, user *models.User) error {
+	for i := range records {
+		records[i].UserID = user.ID
+		records[i].OrganizationID = user.OrganizationID
+		if err := tx.Create(&records[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verificationScope selects the documents or decisions of an applicant:
+// those of its organization for a brand, its own otherwise
+func verificationScope(tx *gorm.DB, user *models.User) *gorm.DB {
+	if user.OrganizationID != nil {
+		return tx.Where("organization_id = ?", *user.OrganizationID)
+	}
+	return tx.Where("user_id = ?", user.ID)
+}
+
+func verificationDocumentJSON(doc models.VerificationDocument) gin.H {
+	return gin.H{
+		"id":           doc.ID,
+		"kind":         doc.Kind,
+		"file_name":    doc.FileName,
+		"content_type": doc.ContentType,
+		"size":         doc.Size,
+		"sha256":       doc.SHA256,
+		"store":        doc.Store,
+		"uploaded_at":  doc.CreatedAt,
+		"url":          fmt.Sprintf("/api/admin/verification-documents/%d", doc.ID),
+	}
+}
+
+func verificationDecisionJSON(decision models.VerificationDecision) gin.H {
+	return gin.H{
+		"id":              decision.ID,
+		"user_id":         decision.UserID,
+		"organization_id": decision.OrganizationID,
+		"reviewer_id":     decision.ReviewerID,
+		"previous_status": decision.PreviousStatus,
+		"status":          decision.Status,
+		"reason":          decision.Reason,
+		"notes":           decision.Notes,
+		"decided_at":      decision.CreatedAt,
+	}
+}
+
+// verificationRecords returns an applicant's documents and decisions, both
+// oldest first, as they are shown to admins
+func verificationRecords(user *models.User) ([]gin.H, []gin.H, error) {
+	var docs []models.VerificationDocument
+	if err := verificationScope(db, user).Order("id asc").Find(&docs).Error; err != nil {
+		return nil, nil, err
+	}
+	var decisions []models.VerificationDecision
+	if err := verificationScope(db, user).Order("id asc").Find(&decisions).Error; err != nil {
+		return nil, nil, err
+	}
+
+	docList := make([]gin.H, len(docs))
+	for i, doc := range docs {
+		docList[i] = verificationDocumentJSON(doc)
+	}
+	decisionList := make([]gin.H, len(decisions))
+	for i, decision := range decisions {
+		decisionList[i] = verificationDecisionJSON(decision)
+	}
+	return docList, decisionList, nil
+}
+
+// latestRejectionReason is the reason given with an applicant's last
+// rejection, for the applicant to act on
+func latestRejectionReason(user *models.User) string {
+	var decision models.VerificationDecision
+	if err := verificationScope(db, user).Where("status = ?", "rejected").Order("id desc").First(&decision).Error; err != nil {
+		return ""
+	}
+	return decision.Reason
+}
+
+// decideVerification sets the verification status of a repair shop, or of
+// the organization of a brand member, and records the decision in its
+// history. reviewerID is nil when the applicant resubmits.
+func decideVerification(tx *gorm.DB, user *models.User, reviewerID *uint, status, reason, notes string) (*models.VerificationDecision, error) {
+	previous, err := accountVerificationStatus(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := models.VerificationDecision{
+		OrganizationID: user.OrganizationID,
+		ReviewerID:     reviewerID,
+		PreviousStatus: previous,
+		Status:         status,
+		Reason:         reason,
+		Notes:          notes,
+	}
+	if user.ID != 0 {
+		decision.UserID = &user.ID
+	}
+
+	if user.OrganizationID != nil {
+		err = tx.Model(&models.Organization{}).Where("id = ?", *user.OrganizationID).Update("verification_status", status).Error
+	} else {
+		err = tx.Model(&models.User{}).Where("id = ?", user.ID).Update("verification_status", status).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&decision).Error; err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+// UploadVerificationDocuments adds documents for a brand or repair shop
+// awaiting verification. Applicants cannot log in before they are verified,
+// so the upload carries their username and password. Uploading after a
+// rejection resubmits the application.
+func UploadVerificationDocuments(c *gin.Context) {
+	if !verificationRequestAccepted(c) {
+		return
+	}
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+	if username == "" || password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if loginThrottled(c, username) {
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, "username = ?", username).Error; err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		loginFailed(c, username, nil, "document_upload", "unknown username")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		loginFailed(c, username, &user, "document_upload", "wrong password")
+		return
+	}
+
+	// Only the applicant: a repair shop, or an owner of a brand organization
+	if !needsVerification(user.Role) || (user.OrganizationID != nil && user.OrganizationRole != OrgRoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This account does not upload verification documents"})
+		return
+	}
+	status, err := accountVerificationStatus(db, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload documents"})
+		return
+	}
+	if status == "verified" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your account is already verified"})
+		return
+	}
+
+	docs, err := readVerificationDocuments(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(docs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload at least one of business_license_file, certification_file or other_file"})
+		return
+	}
+	records, err := storeVerificationDocuments(docs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store documents"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := saveVerificationDocuments(tx, records, &user); err != nil {
+			return err
+		}
+		if status != "rejected" {
+			return nil
+		}
+		_, err := decideVerification(tx, &user, nil, "pending", "", "Resubmitted with new documents")
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload documents"})
+		return
+	}
+	if user.OrganizationID != nil {
+		forgetAccounts()
+	} else {
+		forgetAccount(user.ID)
+	}
+
+	uploaded := make([]gin.H, len(records))
+	for i, record := range records {
+		uploaded[i] = gin.H{
+			"id":        record.ID,
+			"kind":      record.Kind,
+			"file_name": record.FileName,
+			"size":      record.Size,
+		}
+	}
+	message := "Documents uploaded"
+	if status == "rejected" {
+		message = "Documents uploaded, your application is pending verification again"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "documents": uploaded})
+}
+
+// GetVerificationDocument serves an uploaded verification document to admins
+func GetVerificationDocument(c *gin.Context) {
+	var doc models.VerificationDocument
+	if err := db.First(&doc, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	}
+
+	reader, err := utils.OpenDocument(doc.Store, doc.Ref)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve document"})
+		return
+	}
+	defer reader.Close()
+
+	// Served as stored and never sniffed, so a document cannot turn into a
+	// page of this site
+	name := strings.TrimSuffix(doc.FileName, filepath.Ext(doc.FileName)) + documentContentTypes[doc.ContentType]
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.DataFromReader(http.StatusOK, doc.Size, doc.ContentType, reader, nil)
+}
+
+// GetVerificationHistory lists the documents and every verification
+// decision of a brand or repair shop
+func GetVerificationHistory(c *gin.Context) {
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !needsVerification(user.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This user type doesn't require verification"})
+		return
+	}
+
+	status, err := accountVerificationStatus(db, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load verification history"})
+		return
+	}
+	docs, decisions, err := verificationRecords(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load verification history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":             user.ID,
+		"organization_id":     user.OrganizationID,
+		"verification_status": status,
+		"documents":           docs,
+		"decisions":           decisions,
+	})
+}
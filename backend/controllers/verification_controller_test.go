@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"backend/models"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadRequest sends a document upload with a file of size bytes
+func uploadRequest(t *testing.T, size int) int {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("username", "nobody")
+	form.WriteField("password", "wrong password")
+	file, err := form.CreateFormFile("other_file", "scan.pdf")
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	file.Write(append([]byte("%PDF-1.4\n"), make([]byte, size)...))
+	form.Close()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/verification/documents", &body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+	UploadVerificationDocuments(c)
+	return recorder.Code
+}
+
+func TestUploadVerificationDocumentsBodyLimit(t *testing.T) {
+	setupTestDB(t)
+
+	if code := uploadRequest(t, maxVerificationRequestSize); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload: got %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	// A request under the cap goes on to the password check
+	if code := uploadRequest(t, 1<<10); code != http.StatusUnauthorized {
+		t.Errorf("small upload with a wrong password: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPendingVerificationsOmitSecrets(t *testing.T) {
+	database := setupTestDB(t)
+	shop := models.User{
+		Username:           "fixitpro",
+		PasswordHash:       "$2a$10$secret-password-hash",
+		Role:               "repair_shop",
+		VerificationStatus: "pending",
+		TOTPSecret:         "secret-totp",
+		TOTPLastStep:       424242,
+		OIDCSubject:        "secret-subject",
+		WebAuthnHandle:     "secret-handle",
+	}
+	if err := database.Create(&shop).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/admin/verifications/pending", nil)
+	GetPendingVerifications(c)
+
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"username":"fixitpro"`) {
+		t.Fatalf("got %d %s, want the pending shop", recorder.Code, recorder.Body.String())
+	}
+	for _, secret := range []string{"secret", "424242"} {
+		if strings.Contains(recorder.Body.String(), secret) {
+			t.Errorf("response leaks %q: %s", secret, recorder.Body.String())
+		}
+	}
+}
@@ -7,12 +7,13 @@ import (
 	"backend/utils"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
@@ -32,24 +33,157 @@ func main() {
 	}
 	utils.InitIPFSShell(ipfsNodeURL)
 
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		dbUser, dbPassword, dbHost, dbPort, dbName)
-
-	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err = utils.ConnectDatabase()
 	if err != nil {
 		panic("failed to connect database")
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Product{}, &models.Event{}, &models.PendingTransfer{}, &models.OwnerContract{})
+	if err := utils.MigrateEventSequences(db); err != nil {
+		panic(err)
+	}
+
+	db.AutoMigrate(&models.User{}, &models.Product{}, &models.Event{}, &models.PendingTransfer{}, &models.OwnerContract{},
+		&models.Checkpoint{}, &models.CheckpointEntry{}, &models.SigningKey{},
+		&models.OutboxJob{}, &models.ProductOwner{}, &models.TransferConsent{}, &models.Organization{},
+		&models.RefreshToken{}, &models.RevokedToken{}, &models.OIDCLogin{}, &models.OIDCLoginCode{},
+		&models.RecoveryCode{}, &models.LoginChallenge{}, &models.Passkey{}, &models.PasskeyCeremony{},
+		&models.LoginThrottle{}, &models.AuthEvent{}, &models.PasswordReset{},
+		&models.EmailConfirmation{}, &models.VerificationDocument{}, &models.VerificationDecision{},
+		&models.PaymentRefund{})
+
+	if err := utils.MigrateOrganizations(db); err != nil {
+		panic(err)
+	}
+
+	if err := utils.MigrateProductOwners(db); err != nil {
+		panic(err)
+	}
+
+	if err := utils.MigrateTransferStates(db, controllers.TransferOfferTTL()); err != nil {
+		panic(err)
+	}
+
+	// Load the server signing keys used for events and log checkpoints
+	signingKeysDir := os.Getenv("SIGNING_KEYS_DIR")
+	if signingKeysDir == "" {
+		signingKeysDir = "keys"
+	}
+	if err := utils.InitKeyring(db, signingKeysDir); err != nil {
+		panic(err)
+	}
+
+	// Keys that sign and verify access tokens
+	jwtKeysDir := os.Getenv("JWT_KEYS_DIR")
+	if jwtKeysDir == "" {
+		jwtKeysDir = "jwt-keys"
+	}
+	var jwtAlgorithms []string
+	if algs := os.Getenv("JWT_ALLOWED_ALGORITHMS"); algs != "" {
+		jwtAlgorithms = strings.Split(algs, ",")
+	}
+	if err := utils.InitJWTKeys(jwtKeysDir, os.Getenv("JWT_SIGNING_KEY_ID"), jwtAlgorithms); err != nil {
+		panic(err)
+	}
+
+	// Key that encrypts the TOTP secrets of two-factor authentication
+	totpKeyFile := os.Getenv("TOTP_KEY_FILE")
+	if totpKeyFile == "" {
+		totpKeyFile = "totp.key"
+	}
+	if err := utils.InitTOTPKey(totpKeyFile); err != nil {
+		panic(err)
+	}
+
+	// Corporate identity provider for brand single sign-on
+	if err := utils.InitOIDC(utils.OIDCConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}); err != nil {
+		panic(err)
+	}
+
+	// Relying party for passkey login; passkeys only work on this domain
+	webAuthnRPID := os.Getenv("WEBAUTHN_RP_ID")
+	if webAuthnRPID == "" {
+		webAuthnRPID = "localhost"
+	}
+	webAuthnOrigins := []string{"http://localhost:5173", "https://localhost:5173"}
+	if origins := os.Getenv("WEBAUTHN_RP_ORIGINS"); origins != "" {
+		webAuthnOrigins = strings.Split(origins, ",")
+	}
+	if err := utils.InitWebAuthn(utils.WebAuthnConfig{
+		RPID:          webAuthnRPID,
+		RPDisplayName: "VeriOwn",
+		RPOrigins:     webAuthnOrigins,
+	}); err != nil {
+		panic(err)
+	}
+
+	// What new passwords have to satisfy
+	passwordMinLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil || passwordMinLength <= 0 {
+		passwordMinLength = 10
+	}
+	passwordClasses, _ := strconv.Atoi(os.Getenv("PASSWORD_MIN_CHARACTER_CLASSES"))
+	if err := utils.InitPasswordPolicy(utils.PasswordPolicy{
+		MinLength:           passwordMinLength,
+		MinCharacterClasses: passwordClasses,
+		BreachedListFile:    os.Getenv("BREACHED_PASSWORDS_FILE"),
+	}); err != nil {
+		panic(err)
+	}
+
+	// Sends password reset and email confirmation links
+	if err := utils.InitMailer(os.Getenv("MAILER")); err != nil {
+		panic(err)
+	}
+
+	// DNS server brand domain checks ask, instead of the system resolver
+	utils.InitTXTResolver(os.Getenv("DNS_RESOLVER"))
+
+	// Where the documents brands and repair shops upload for verification
+	// are kept: "local" files, or a store added with RegisterDocumentStore
+	if err := utils.InitDocumentStore(os.Getenv("DOCUMENT_STORE")); err != nil {
+		panic(err)
+	}
+
+	// Periodically checkpoint every product chain into the transparency log
+	checkpointInterval, err := time.ParseDuration(os.Getenv("CHECKPOINT_INTERVAL"))
+	if err != nil || checkpointInterval <= 0 {
+		checkpointInterval = 10 * time.Minute
+	}
+	utils.StartCheckpointScheduler(db, checkpointInterval)
+
+	// Render and pin contracts queued in the outbox
+	outboxWorkers, err := strconv.Atoi(os.Getenv("OUTBOX_WORKERS"))
+	if err != nil || outboxWorkers <= 0 {
+		outboxWorkers = 4
+	}
+	utils.StartOutboxWorkers(db, outboxWorkers, 5*time.Second)
+
+	// Drop expired entries from the token revocation list
+	utils.StartTokenPruning(db, time.Hour)
+
+	// Payment provider for escrow transfers; without one, transfers cannot
+	// carry a price
+	if err := utils.InitPaymentProvider(os.Getenv("PAYMENT_PROVIDER")); err != nil {
+		panic(err)
+	}
 
 	r := gin.Default()
 
+	// Client addresses are taken from X-Forwarded-For only when the request
+	// comes through one of these proxies; login throttling relies on them
+	var trustedProxies []string
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		panic(err)
+	}
+
 	// Configure CORS middleware
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173", "https://localhost:5173"},
@@ -60,19 +194,48 @@ func main() {
 		MaxAge:           12 * time.Hour,
 	}))
 
+	middlewares.InitAuthMiddleware(db)
 	controllers.InitUserController(db)
 	controllers.InitEventController(db)
 
+	// Expire transfer offers that were never answered
+	controllers.StartTransferExpiry(time.Minute)
+
 	// Public product verification endpoint (no auth required)
 	r.GET("/api/products/public/:id", controllers.GetPublicProductInfo)
+	r.GET("/api/products/public/:id/events/:eventId/proof", controllers.GetEventInclusionProof)
+
+	// Transparency log endpoints (no auth required)
+	r.GET("/api/keys", controllers.GetSigningKeys)
+	r.GET("/.well-known/jwks.json", controllers.GetJWKS)
+	r.GET("/api/schemas/chain-verification-report.json", controllers.GetChainReportSchema)
+	r.GET("/api/log/checkpoints/:seq", controllers.GetCheckpoint)
+	r.GET("/api/log/checkpoints/:seq/products/:productId/proof", controllers.GetCheckpointProductProof)
+
+	// Payment provider callbacks, authenticated by the provider's signature
+	r.POST("/api/payments/webhook", controllers.PaymentWebhook)
 
 	// User registration endpoints - role-specific
 	r.POST("/api/users/register/regular", controllers.RegisterRegularUser)
 	r.POST("/api/users/register/brand", controllers.RegisterBrand)
 	r.POST("/api/users/register/repair-shop", controllers.RegisterRepairShop)
+	r.POST("/api/users/confirm-email", controllers.ConfirmEmail)
+	r.POST("/api/organizations/:id/verification/email", controllers.ResendEmailConfirmation)
+	r.POST("/api/organizations/:id/verification/domain", controllers.CheckDomainVerification)
+	r.POST("/api/verification/documents", controllers.UploadVerificationDocuments)
 	r.POST("/api/users/login", controllers.Login)
+	r.POST("/api/users/refresh", controllers.RefreshSession)
+	r.POST("/api/users/password/forgot", controllers.RequestPasswordReset)
+	r.POST("/api/users/password/reset", controllers.ResetPassword)
+	r.GET("/api/auth/oidc/login", controllers.OIDCLogin)
+	r.GET("/api/auth/oidc/callback", controllers.OIDCCallback)
+	r.POST("/api/auth/oidc/exchange", controllers.ExchangeOIDCCode)
+	r.POST("/api/users/login/2fa", controllers.CompleteLoginTwoFactor)
+	r.POST("/api/users/login/2fa/enroll", controllers.EnrollLoginTwoFactor)
+	r.POST("/api/users/passkeys/login/begin", controllers.BeginPasskeyLogin)
+	r.POST("/api/users/passkeys/login/finish", controllers.FinishPasskeyLogin)
 
-	authorized := r.Group("/").Use(middlewares.AuthMiddleware())
+	authorized := r.Group("/").Use(middlewares.AuthMiddleware(), controllers.ResolvePrincipal(), controllers.Authorize())
 	{
 		// Product related endpoints
 		authorized.POST("/api/products", controllers.RegisterProduct)
@@ -81,11 +244,28 @@ func main() {
 		authorized.POST("/api/products/:id/transfer", controllers.InitiateTransfer)
 		authorized.GET("/api/transfers/pending", controllers.GetPendingTransfersForUser)
 		authorized.POST("/api/products/:id/transfer/confirm", controllers.ConfirmTransfer)
+		authorized.POST("/api/products/:id/transfer/reject", controllers.RejectTransfer)
+		authorized.POST("/api/products/:id/transfer/cancel", controllers.CancelTransfer)
+		authorized.GET("/api/transfers/outgoing", controllers.GetOutgoingTransfersForUser)
+		authorized.POST("/api/products/:id/transfer/consent", controllers.ConsentToTransfer)
+		authorized.GET("/api/transfers/consents", controllers.GetTransfersAwaitingConsent)
+		authorized.GET("/api/products/:id/owners", controllers.GetProductOwners)
+		authorized.PUT("/api/products/:id/consent-rule", controllers.SetConsentRule)
 		authorized.GET("/api/products/:id/verify", controllers.VerifyProductHistory)
 
 		// Admin verification endpoints
 		authorized.GET("/api/admin/verifications/pending", controllers.GetPendingVerifications)
 		authorized.POST("/api/admin/verify-user/:id", controllers.VerifyUser)
+		authorized.POST("/api/admin/verify-organization/:id", controllers.VerifyOrganization)
+		authorized.GET("/api/admin/verification-documents/:id", controllers.GetVerificationDocument)
+		authorized.GET("/api/admin/users/:id/verification-history", controllers.GetVerificationHistory)
+		authorized.POST("/api/admin/users/:id/suspend", controllers.SuspendUser)
+		authorized.POST("/api/admin/users/:id/reinstate", controllers.ReinstateUser)
+		authorized.POST("/api/admin/users/:id/2fa/reset", controllers.ResetTwoFactor)
+		authorized.POST("/api/admin/users/:id/unlock", controllers.UnlockAccount)
+		authorized.GET("/api/admin/auth-events", controllers.GetAuthEvents)
+		authorized.POST("/api/admin/keys/rotate", controllers.RotateSigningKey)
+		authorized.POST("/api/admin/keys/:kid/retire", controllers.RetireSigningKey)
 		authorized.GET("/api/products/:id/qr", controllers.GenerateProductQR)
 		// Add this to your authorized routes in main.go
 
@@ -97,9 +277,34 @@ func main() {
 		authorized.GET("/api/contracts/:id/pdf", controllers.GetContractPDF)
 		authorized.GET("/api/contracts/:id/ipfs", controllers.GetContractIPFSLink)
 		authorized.POST("/api/contracts/:id/regenerate", controllers.RegenerateContractPDF)
+		authorized.GET("/api/contracts/:id/jobs", controllers.GetContractJobs)
+		authorized.POST("/api/admin/jobs/:id/retry", controllers.RetryJob)
 
 		// User related endpoints
 		authorized.GET("/api/user/info", controllers.GetUserInfo)
+		authorized.POST("/api/users/logout", controllers.Logout)
+		authorized.POST("/api/users/logout-all", controllers.LogoutAll)
+		authorized.PUT("/api/user/public-key", controllers.RegisterPublicKey)
+		authorized.PUT("/api/user/password", controllers.ChangePassword)
+		authorized.POST("/api/user/2fa/enroll", controllers.StartTwoFactorEnrollment)
+		authorized.POST("/api/user/2fa/confirm", controllers.ConfirmTwoFactor)
+		authorized.POST("/api/user/2fa/recovery-codes", controllers.RegenerateRecoveryCodes)
+		authorized.POST("/api/user/2fa/disable", controllers.DisableTwoFactor)
+		authorized.POST("/api/user/passkeys/register/begin", controllers.BeginPasskeyRegistration)
+		authorized.POST("/api/user/passkeys/register/finish", controllers.FinishPasskeyRegistration)
+		authorized.GET("/api/user/passkeys", controllers.GetPasskeys)
+		authorized.DELETE("/api/user/passkeys/:id", controllers.DeletePasskey)
+
+		// Organization endpoints
+		authorized.GET("/api/organization", controllers.GetOrganization)
+		authorized.POST("/api/organization/members", controllers.AddOrganizationMember)
+		authorized.PUT("/api/organization/members/:userId", controllers.UpdateOrganizationMember)
+		authorized.DELETE("/api/organization/members/:userId", controllers.RemoveOrganizationMember)
+	}
+
+	// Every route must be bound to a policy in controllers/policy.go
+	if err := controllers.CheckRoutePolicies(r.Routes()); err != nil {
+		panic(err)
 	}
 
 	r.Run(":8080")
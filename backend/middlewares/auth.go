@@ -1,13 +1,22 @@
 package middlewares
 
 import (
+	"backend/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
     "net/http"
     "strings"
+	"time"
 )
 
-var jwtSecret = []byte("dK8xP3qZ7rT2vF5yJ9cM4bN6hG1wS0aE5dR8fL3xV7tP")
+var db *gorm.DB
+
+// InitAuthMiddleware gives the middleware the database holding the token
+// revocation list
+func InitAuthMiddleware(database *gorm.DB) {
+	db = database
+}
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -25,9 +34,7 @@ func AuthMiddleware() gin.HandlerFunc {
             return
         }
 
-        token, err := jwt.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
-            return jwtSecret, nil
-        })
+        token, err := utils.ParseJWT(parts[1])
 
         if err != nil || !token.Valid {
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -42,8 +49,34 @@ func AuthMiddleware() gin.HandlerFunc {
             return
         }
 
+        // Every access token carries a jti so it can be revoked before it
+        // expires
+        jti, _ := claims["jti"].(string)
+        if jti == "" {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+            c.Abort()
+            return
+        }
+        revoked, err := utils.IsTokenRevoked(db, jti)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check token"})
+            c.Abort()
+            return
+        }
+        if revoked {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+            c.Abort()
+            return
+        }
+
         c.Set("user_id", uint(claims["user_id"].(float64)))
         c.Set("role", claims["role"].(string))
+        c.Set("jti", jti)
+        sid, _ := claims["sid"].(string)
+        c.Set("session_id", sid)
+        if exp, ok := claims["exp"].(float64); ok {
+            c.Set("token_expires_at", time.Unix(int64(exp), 0))
+        }
         c.Next()
 	}
 }
\ No newline at end of file
@@ -0,0 +1,17 @@
+package models
+
+import "gorm.io/gorm"
+
+// AuthEvent is an audit record of a login, a failed login or a change to how
+// an account signs in
+type AuthEvent struct {
+	gorm.Model
+	Event     string `gorm:"size:64;index"` // e.g. "login_succeeded", "login_failed", "account_unlocked"
+	UserID    *uint  `gorm:"index"`         // Unset when the username does not exist
+	Username  string `gorm:"size:255;index"`
+	IP        string `gorm:"size:64;index"`
+	UserAgent string
+	Method    string // "password", "totp", "recovery_code", "passkey", "oidc"
+	Detail    string
+	ActorID   *uint // The admin who acted on the account, if any
+}
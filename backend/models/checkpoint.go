@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Checkpoint is a signed snapshot of every product's chain head. Each
+// checkpoint commits to the one before it, forming an append-only log.
+type Checkpoint struct {
+	gorm.Model
+	Sequence               uint `gorm:"uniqueIndex"`
+	TreeSize               int
+	RootHash               string // Merkle root over the product head leaves
+	PreviousCheckpointHash string // Empty for the first checkpoint
+	IssuedAt               time.Time
+	CheckpointHash         string
+	Signature              string // Base64 Ed25519 signature over the checkpoint body
+	KeyID                  string
+}
+
+// CheckpointEntry records which product head sits at which leaf of a checkpoint
+type CheckpointEntry struct {
+	gorm.Model
+	CheckpointID  uint `gorm:"index"`
+	LeafIndex     int
+	ProductID     uint `gorm:"index"`
+	HeadEventHash string
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EmailConfirmation is a single-use link, sent to an organization's contact
+// email, that proves the address receives mail. Only a hash of its token is
+// stored.
+type EmailConfirmation struct {
+	gorm.Model
+	OrganizationID uint      `gorm:"index"`
+	Email          string    // The address the link was sent to
+	TokenHash      string    `gorm:"size:64;uniqueIndex"`
+	ExpiresAt      time.Time `gorm:"index"`
+	UsedAt         *time.Time
+}
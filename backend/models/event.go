@@ -3,11 +3,17 @@ package models
 import "gorm.io/gorm"
 
 type Event struct {
-    gorm.Model
-    ProductID         uint
-    EventType        string 
-    EventData        string 
-    PreviousEventHash string
-    EventHash        string
-    CreatedBy        uint 
-}
\ No newline at end of file
+	gorm.Model
+	ProductID         uint `gorm:"uniqueIndex:idx_events_product_sequence"`
+	Sequence          uint `gorm:"uniqueIndex:idx_events_product_sequence"` // Position in the product's chain, starting at 1
+	EventType         string
+	EventData         string
+	PreviousEventHash string
+	EventHash         string
+	CreatedBy         uint
+	HashVersion       int    `gorm:"default:1"` // Encoding used for EventHash, see utils.EventHashPayload
+	Signature         string // Base64 Ed25519 signature over the event hash
+	SigningKeyID      string // Server key that produced Signature
+	ActorSignature    string // Optional signature by the creator's own key over the hash payload
+	ActorPublicKey    string // The creator's public key at the time of signing
+}
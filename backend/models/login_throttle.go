@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginThrottle counts recent failed logins for one username or one client
+// IP address. The key is "account:<username>" or "ip:<address>"; usernames
+// are tracked whether or not they exist, so a lockout reveals nothing.
+type LoginThrottle struct {
+	gorm.Model
+	Key           string `gorm:"size:255;uniqueIndex"`
+	Failures      int
+	LastFailureAt time.Time
+	NextAttemptAt time.Time  // Progressive delay before the next attempt
+	LockedUntil   *time.Time // Set once there are too many failures
+}
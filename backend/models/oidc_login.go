@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OIDCLogin is a single sign-on attempt between sending the user to the
+// identity provider and the provider sending them back. It holds the PKCE
+// verifier and nonce the callback checks, and is deleted once used.
+type OIDCLogin struct {
+	gorm.Model
+	State        string    `gorm:"size:64;uniqueIndex"`
+	Nonce        string    `gorm:"size:64"`
+	CodeVerifier string    `gorm:"size:128"`
+	ExpiresAt    time.Time `gorm:"index"`
+}
+
+// OIDCLoginCode is a finished single sign-on waiting for the frontend to
+// exchange the one-time code it was handed for a session. Only the code's
+// hash is stored, and the row is deleted once exchanged.
+type OIDCLoginCode struct {
+	gorm.Model
+	CodeHash  string    `gorm:"size:64;uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Organization is a brand's company account. It holds the brand verification
+// data, and its members log in as their own users with a role in it. Products
+// the organization registers are owned by its account user, a principal with
+// no password that stands for the organization as a whole.
+type Organization struct {
+	gorm.Model
+	CompanyName        string
+	TaxID              string
+	ContactEmail       string
+	OfficialDomain     string
+	VerificationStatus string // "pending", "verified", "rejected"
+	AccountUserID      uint   `gorm:"index"`
+	// Evidence for admins that the registrant controls the contact email
+	// and the official domain
+	EmailConfirmedAt *time.Time
+	DomainChallenge  string // Token to publish in a DNS TXT record
+	DomainVerifiedAt *time.Time
+	DomainCheckedAt  *time.Time
+	DomainCheckError string // Why the last check failed
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OutboxJob is a unit of side-effecting work (such as rendering a contract
+// PDF or registering a payment with the provider) written in the same transaction as the change that needs it, and
+// carried out afterwards by the outbox workers.
+type OutboxJob struct {
+	gorm.Model
+	Kind           string `gorm:"index"` // e.g. "render_contract", "create_payment"
+	ContractID     uint   `gorm:"index"`
+	TransferID     uint   `gorm:"index"`
+	Status         string `gorm:"index"` // "pending", "running", "done", "dead"
+	Attempts       int
+	MaxAttempts    int
+	LastError      string
+	NextAttemptAt  time.Time  `gorm:"index"`
+	LeaseExpiresAt *time.Time // A running job whose lease expired is picked up again
+	CompletedAt    *time.Time
+}
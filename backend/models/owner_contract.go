@@ -18,4 +18,6 @@ type OwnerContract struct {
 	PDFPath         string // Path to stored PDF file (temporary - can be deleted after IPFS upload)
 	IPFSCID         string // IPFS Content Identifier (hash)
 	IsEncrypted     bool   // Indicates if the document is encrypted
+	PriceMinor      int64  // Sale price in minor currency units; 0 when the transfer had no price
+	Currency        string `gorm:"size:3"`
 }
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Passkey is a WebAuthn credential a user signs in with instead of a
+// password. Only its public key is stored.
+type Passkey struct {
+	gorm.Model
+	UserID          uint   `gorm:"index"`
+	Name            string // Chosen by the user to tell their devices apart
+	CredentialID    []byte `gorm:"type:varbinary(255);uniqueIndex"`
+	PublicKey       []byte // COSE encoded
+	AttestationType string
+	Transports      string // Comma-separated, e.g. "internal,hybrid"
+	AAGUID          []byte // Identifies the authenticator model
+	SignCount       uint32
+	BackupEligible  bool
+	BackupState     bool
+	LastUsedAt      *time.Time
+}
+
+// PasskeyCeremony is a passkey registration or login waiting for the
+// browser's response. It holds the challenge that response must sign.
+type PasskeyCeremony struct {
+	gorm.Model
+	TokenHash   string    `gorm:"size:64;uniqueIndex"`
+	Kind        string    // "registration", "login"
+	UserID      uint      // The registering user; 0 for a login
+	SessionData string    `gorm:"type:text"` // JSON
+	ExpiresAt   time.Time `gorm:"index"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PasswordReset is a single-use link, sent by email, that sets a new
+// password. Only a hash of its token is stored.
+type PasswordReset struct {
+	gorm.Model
+	UserID    uint      `gorm:"index"`
+	TokenHash string    `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+}
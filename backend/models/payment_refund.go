@@ -0,0 +1,20 @@
+package models
+
+import "gorm.io/gorm"
+
+// PaymentRefund is a payment the provider captured but that could not be
+// applied to its transfer, because the offer had expired or closed, or the
+// amount was wrong. The money is sent back, and the row stays for
+// reconciliation with the provider's records.
+type PaymentRefund struct {
+	gorm.Model
+	TransferID       uint   `gorm:"index"`
+	PaymentProvider  string `gorm:"size:64;uniqueIndex:idx_payment_refund"`
+	PaymentReference string `gorm:"size:128;uniqueIndex:idx_payment_refund"`
+	AmountMinor      int64
+	Currency         string `gorm:"size:3"`
+	Reason           string
+	Status           string // "pending", "refunding", "refunded", "failed"
+	RefundReference  string
+	Error            string `gorm:"type:text"`
+}
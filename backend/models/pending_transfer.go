@@ -1,9 +1,29 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// PendingTransfer is an ownership transfer offer and its outcome. Offers are
+// kept after they close so the full history of offers stays auditable.
 type PendingTransfer struct {
 	gorm.Model
-	ProductID  uint
-	NewOwnerID uint
+	ProductID   uint   `gorm:"index"`
+	NewOwnerID  uint   `gorm:"index"`
+	InitiatedBy uint   // Owner who made the offer
+	Share       int    // Basis points of the sender's holding on offer; 0 for offers made before co-ownership
+	Status      string `gorm:"index"` // "awaiting_consent", "initiated", "awaiting_payment", "paid", "accepted", "rejected", "cancelled", "expired"
+	ExpiresAt   time.Time
+	ResolvedAt  *time.Time
+	ResolvedBy  uint // User who closed the offer; 0 when it expired
+
+	// Set for escrow transfers, which cannot be accepted until the payment
+	// provider confirms payment
+	PriceMinor       int64  // Price in minor currency units; 0 for a transfer without payment
+	Currency         string `gorm:"size:3"`
+	PaymentProvider  string
+	PaymentReference string `gorm:"index;size:128"`
+	PaidAt           *time.Time
 }
@@ -7,4 +7,19 @@ type Product struct {
 	SerialNumber string `gorm:"unique"`
 	Manufacturer string
 	ProductModel string
+	// Organization that registered the product, if any
+	OrganizationID uint `gorm:"index"`
+	// Authoritative current owner, changed only by registration and the
+	// transfer flow; utils.CheckOwnership compares it against the chain.
+	// For a co-owned product it is the holder of the largest share, and the
+	// full list of shares is in ProductOwner.
+	CurrentOwnerID uint `gorm:"index"`
+	// Co-owner consent needed to transfer a share: "all" or "majority"
+	ConsentRule string `gorm:"size:16;default:all"`
+	// Merkle root over the product's event hashes, refreshed on every append
+	HistoryRoot string
+	HistorySize int
+	// Comma-separated roots of the perfect subtrees of that tree, which let
+	// an append update the root without reading the earlier events
+	HistoryFrontier string `gorm:"type:text"`
 }
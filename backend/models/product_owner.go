@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// ProductOwner is one holder's share of a product. The shares of a product
+// add up to 10000 basis points (100%); a sole owner holds all of them.
+type ProductOwner struct {
+	gorm.Model
+	ProductID uint `gorm:"uniqueIndex:idx_product_owner"`
+	UserID    uint `gorm:"uniqueIndex:idx_product_owner;index"`
+	Share     int  // Basis points
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RefreshToken is one link in a session's chain of rotating refresh tokens.
+// Only a hash of the token is stored. Each token can be exchanged once; a
+// token presented again has leaked, and its whole session is revoked.
+type RefreshToken struct {
+	gorm.Model
+	UserID          uint   `gorm:"index"`
+	SessionID       string `gorm:"size:64;index"`
+	TokenHash       string `gorm:"size:64;uniqueIndex"`
+	AccessJTI       string `gorm:"size:64"` // The access token issued alongside it
+	AccessExpiresAt time.Time
+	ExpiresAt       time.Time  `gorm:"index"`
+	UsedAt          *time.Time // Set once exchanged for a new pair
+	RevokedAt       *time.Time // Set on logout or reuse
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RevokedToken lists an access token that must no longer be accepted even
+// though it has not expired. Entries can be dropped once ExpiresAt passes.
+type RevokedToken struct {
+	gorm.Model
+	JTI       string    `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SigningKey is the public record of a server signing key. The private half
+// is kept on disk by the keyring and never stored in the database.
+type SigningKey struct {
+	gorm.Model
+	KeyID         string `gorm:"uniqueIndex;size:64"`
+	Algorithm     string // "Ed25519"
+	PublicKey     string // Base64 encoded
+	Status        string // "active", "inactive", "retired"
+	ActivatedAt   time.Time
+	DeactivatedAt *time.Time // Set when the key is rotated out
+	RetiredAt     *time.Time // Set when the private key is destroyed
+}
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// TransferConsent is a co-owner's answer to an offer of another co-owner's
+// share
+type TransferConsent struct {
+	gorm.Model
+	TransferID uint `gorm:"uniqueIndex:idx_transfer_consent"`
+	UserID     uint `gorm:"uniqueIndex:idx_transfer_consent"`
+	Approved   bool
+}
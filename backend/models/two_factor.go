@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a single-use code that signs a user in when their
+// authenticator is lost. Only a hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"size:64;index"`
+	UsedAt   *time.Time
+}
+
+// LoginChallenge is a login whose password was correct and that is waiting
+// for the second factor. Only a hash of its token is stored.
+type LoginChallenge struct {
+	gorm.Model
+	UserID    uint      `gorm:"index"`
+	TokenHash string    `gorm:"size:64;uniqueIndex"`
+	Attempts  int       // Wrong codes entered so far
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -1,11 +1,15 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	gorm.Model
 	Username     string `gorm:"unique"`
-    PasswordHash string
+    PasswordHash string `json:"-"`
     Role         string  
 	// Brand-specific fields
 	CompanyName        string
@@ -17,4 +21,29 @@ type User struct {
 	BusinessLicense    string
 	LocationAddress    string
 	CertificationProof string
+	// Ed25519 key used to sign events client-side (brands and repair shops)
+	PublicKey string
+	// Organization membership (brands). Brand verification data now lives on
+	// the organization; the fields above predate it.
+	OrganizationID   *uint  `gorm:"index"`
+	OrganizationRole string // "owner", "product_registrar", "viewer"; empty for the organization's account
+	// Set while an admin has suspended the account
+	SuspendedAt      *time.Time
+	SuspendedBy      uint
+	SuspensionReason string
+	// Identity at the corporate identity provider, for brand staff who sign
+	// in through single sign-on. GORM would name these o_id_c_*.
+	OIDCIssuer  string `gorm:"column:oidc_issuer"`
+	OIDCSubject string `gorm:"column:oidc_subject;size:255;index" json:"-"`
+	// Time-based one-time password second factor. The secret is encrypted
+	// and is kept while enrollment awaits its first code. Secrets and
+	// identifiers that sign a user in are never serialized.
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time
+	TOTPLastStep  int64      `json:"-"` // Time step of the last accepted code, against replay
+	// Random user handle passkeys are registered under, set with the first
+	// passkey
+	WebAuthnHandle string `gorm:"size:64;index" json:"-"`
+	// When the password was last changed or reset
+	PasswordChangedAt *time.Time
 }
\ No newline at end of file
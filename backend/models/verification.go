@@ -0,0 +1,33 @@
+package models
+
+import "gorm.io/gorm"
+
+// VerificationDocument is a file a brand or repair shop uploaded as evidence
+// for its verification, such as a business license. The file itself is in
+// the document store named by Store.
+type VerificationDocument struct {
+	gorm.Model
+	UserID         uint   `gorm:"index"` // The applicant who uploaded it
+	OrganizationID *uint  `gorm:"index"` // Set for brands
+	Kind           string // "business_license", "certification", "other"
+	FileName       string
+	ContentType    string
+	Size           int64
+	SHA256         string `gorm:"size:64"`
+	Store          string // "local" or "ipfs"
+	Ref            string // Reference in the store, e.g. the IPFS CID
+}
+
+// VerificationDecision is one step in the verification history of a repair
+// shop or a brand organization: an admin's decision, or the applicant
+// resubmitting after a rejection.
+type VerificationDecision struct {
+	gorm.Model
+	UserID         *uint `gorm:"index"` // Set for repair shops, and for brands decided through a member
+	OrganizationID *uint `gorm:"index"` // Set for brands
+	ReviewerID     *uint // The admin; nil when the applicant resubmitted
+	PreviousStatus string
+	Status         string // "verified", "rejected", "pending"
+	Reason         string // Why it was rejected, shown to the applicant
+	Notes          string `gorm:"type:text"` // Reviewer's notes, for admins only
+}
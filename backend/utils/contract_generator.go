@@ -24,21 +24,35 @@ type ContractData struct {
 	OwnerUsername     string    `json:"owner_username"`
 	PreviousOwnerID   uint      `json:"previous_owner_id,omitempty"`
 	PreviousOwnerName string    `json:"previous_owner_name,omitempty"`
+	Price             string    `json:"price,omitempty"`
+	OwnerShare        string    `json:"owner_share,omitempty"`
+	CoOwners          []CoOwner `json:"co_owners,omitempty"`
 	TransferDate      time.Time `json:"transfer_date"`
 	ContractNumber    string    `json:"contract_number"`
 	IssuedAt          time.Time `json:"issued_at"`
 	QRCodeURL         string    `json:"qr_code_url"`
 }
 
-func GenerateOwnerContract(db *gorm.DB, productID, ownerID, previousOwnerID uint) (*models.OwnerContract, error) {
+// CoOwner is one holder of a co-owned product as listed on its certificate
+type CoOwner struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+	Share    string `json:"share"`
+}
+
+// CreateOwnerContract records an ownership contract without rendering it. The
+// PDF and IPFS upload are done later by RenderAndPinContract, so this can run
+// inside the same transaction as the ownership change it documents. price is
+// nil unless the transfer was paid for through escrow.
+func CreateOwnerContract(tx *gorm.DB, productID, ownerID, previousOwnerID uint, price *Money) (*models.OwnerContract, error) {
 	var product models.Product
-	if err := db.First(&product, productID).Error; err != nil {
+	if err := tx.First(&product, productID).Error; err != nil {
 		return nil, fmt.Errorf("product not found: %w", err)
 	}
 
 	// get owner details
-	var owner models.User
-	if err := db.First(&owner, ownerID).Error; err != nil {
+	ownerName, err := DisplayName(tx, ownerID)
+	if err != nil {
 		return nil, fmt.Errorf("owner not found: %w", err)
 	}
 
@@ -51,13 +65,51 @@ func GenerateOwnerContract(db *gorm.DB, productID, ownerID, previousOwnerID uint
 		Manufacturer:   product.Manufacturer,
 		Model:          product.ProductModel,
 		OwnerID:        ownerID,
-		OwnerUsername:  owner.Username,
+		OwnerUsername:  ownerName,
 		TransferDate:   time.Now(),
 		ContractNumber: contractNumber,
 		IssuedAt:       time.Now(),
 		QRCodeURL:      fmt.Sprintf("https://localhost:5173/verify/%d", productID),
 	}
 
+	if previousOwnerID != 0 {
+		previousOwnerName, err := DisplayName(tx, previousOwnerID)
+		if err != nil {
+			return nil, fmt.Errorf("previous owner not found: %w", err)
+		}
+		contractData.PreviousOwnerID = previousOwnerID
+		contractData.PreviousOwnerName = previousOwnerName
+	}
+
+	if price != nil {
+		contractData.Price = price.String()
+	}
+
+	// A co-owned product's certificate lists every holder as of this contract
+	shares, err := ProductShares(tx, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load owners: %w", err)
+	}
+	if shares[ownerID] != 0 && shares[ownerID] != FullShare {
+		contractData.OwnerShare = FormatShare(shares[ownerID])
+
+		var owners []models.ProductOwner
+		if err := tx.Where("product_id = ?", productID).Order("share desc, user_id asc").Find(&owners).Error; err != nil {
+			return nil, fmt.Errorf("failed to load owners: %w", err)
+		}
+		for _, o := range owners {
+			name, err := DisplayName(tx, o.UserID)
+			if err != nil {
+				return nil, fmt.Errorf("co-owner not found: %w", err)
+			}
+			contractData.CoOwners = append(contractData.CoOwners, CoOwner{
+				UserID:   o.UserID,
+				Username: name,
+				Share:    FormatShare(o.Share),
+			})
+		}
+	}
+
 	jsonData, err := json.Marshal(contractData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal contract data: %w", err)
@@ -66,48 +118,69 @@ func GenerateOwnerContract(db *gorm.DB, productID, ownerID, previousOwnerID uint
 	hash := sha256.Sum256(jsonData)
 	contractHash := hex.EncodeToString(hash[:])
 
+	contract := &models.OwnerContract{
+		ProductID:       productID,
+		OwnerID:         ownerID,
+		ContractHash:    contractHash,
+		PreviousOwnerID: previousOwnerID,
+		TransferDate:    contractData.TransferDate,
+		DocumentData:    string(jsonData),
+		ContractNumber:  contractData.ContractNumber,
+		IsEncrypted:     false, // Not encrypted in this implementation
+	}
+	if price != nil {
+		contract.PriceMinor = price.AmountMinor
+		contract.Currency = price.Currency
+	}
+
+	// Save to database
+	if err := tx.Create(contract).Error; err != nil {
+		return nil, fmt.Errorf("failed to save contract: %w", err)
+	}
+
+	return contract, nil
+}
+
+// RenderAndPinContract renders a contract's PDF and uploads it to IPFS. It is
+// safe to run again after a failure.
+func RenderAndPinContract(db *gorm.DB, contract *models.OwnerContract) error {
+	var contractData ContractData
+	if err := json.Unmarshal([]byte(contract.DocumentData), &contractData); err != nil {
+		return fmt.Errorf("failed to parse contract data: %w", err)
+	}
+
 	pdfDir := filepath.Join(".", "contracts")
 	if err := os.MkdirAll(pdfDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create contracts directory: %w", err)
+		return fmt.Errorf("failed to create contracts directory: %w", err)
 	}
 
 	// Generate PDF filename
-	pdfPath := filepath.Join(pdfDir, contractNumber+".pdf")
+	pdfPath := filepath.Join(pdfDir, contract.ContractNumber+".pdf")
 
 	// Generate PDF
-	if err := GenerateContractPDF(pdfPath, contractData, contractHash); err != nil {
-		return nil, fmt.Errorf("failed to generate PDF: %w", err)
+	if err := GenerateContractPDF(pdfPath, contractData, contract.ContractHash); err != nil {
+		return fmt.Errorf("failed to generate PDF: %w", err)
 	}
 
 	// Upload to IPFS
 	cid, err := UploadToIPFS(pdfPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload to IPFS: %w", err)
+		return fmt.Errorf("failed to upload to IPFS: %w", err)
 	}
 
-	// Create the contract record with IPFS CID
-	contract := &models.OwnerContract{
-		ProductID:       productID,
-		OwnerID:         ownerID,
-		ContractHash:    contractHash,
-		PreviousOwnerID: previousOwnerID,
-		TransferDate:    contractData.TransferDate,
-		DocumentData:    string(jsonData),
-		ContractNumber:  contractData.ContractNumber,
-		PDFPath:         pdfPath, // Keep local path for backup
-		IPFSCID:         cid,     // Store IPFS hash
-		IsEncrypted:     false,   // Not encrypted in this implementation
-	}
-
-	// Save to database
-	if err := db.Create(contract).Error; err != nil {
-		return nil, fmt.Errorf("failed to save contract: %w", err)
+	contract.PDFPath = pdfPath // Keep local path for backup
+	contract.IPFSCID = cid     // Store IPFS hash
+	if err := db.Model(contract).Updates(map[string]interface{}{
+		"pdf_path": contract.PDFPath,
+		"ipfs_cid": contract.IPFSCID,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update contract: %w", err)
 	}
 
 	// Optionally, remove local file after successful upload
 	// os.Remove(pdfPath)
 
-	return contract, nil
+	return nil
 }
 
 func GenerateContractPDF(filePath string, data ContractData, contractHash string) error {
@@ -169,6 +242,31 @@ func GenerateContractPDF(filePath string, data ContractData, contractHash string
 		pdf.Ln(10)
 	}
 
+	if data.Price != "" {
+		pdf.Cell(50, 10, "Sale Price:")
+		pdf.Cell(140, 10, data.Price)
+		pdf.Ln(10)
+	}
+
+	// Co-owners and their shares (if applicable)
+	if len(data.CoOwners) > 0 {
+		pdf.Cell(50, 10, "Owner's Share:")
+		pdf.Cell(140, 10, data.OwnerShare+"%")
+		pdf.Ln(10)
+
+		pdf.Ln(10)
+		pdf.SetFont("Arial", "B", 12)
+		pdf.Cell(190, 10, "CO-OWNERS")
+		pdf.Ln(10)
+
+		pdf.SetFont("Arial", "", 10)
+		for _, coOwner := range data.CoOwners {
+			pdf.Cell(50, 10, coOwner.Username)
+			pdf.Cell(140, 10, coOwner.Share+"%")
+			pdf.Ln(10)
+		}
+	}
+
 	// Verification information
 	pdf.Ln(10)
 	pdf.SetFont("Arial", "B", 12)
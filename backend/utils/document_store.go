@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DocumentStore keeps the files applicants upload for verification. A
+// document is addressed by the reference Put returns.
+type DocumentStore interface {
+	Name() string
+	Put(data []byte) (string, error)
+	Get(ref string) (io.ReadCloser, error)
+}
+
+var (
+	documentStoreFactories = map[string]func() (DocumentStore, error){
+		"local": newLocalDocumentStore,
+	}
+	documentStores       = map[string]DocumentStore{}
+	documentStoresMu     sync.Mutex
+	defaultDocumentStore string
+)
+
+// RegisterDocumentStore makes a document store available to
+// InitDocumentStore
+func RegisterDocumentStore(name string, factory func() (DocumentStore, error)) {
+	documentStoreFactories[name] = factory
+}
+
+// InitDocumentStore selects the store new documents go to by name. The local
+// store is used when name is empty.
+func InitDocumentStore(name string) error {
+	if name == "" {
+		name = "local"
+	}
+	// Anyone who learns a CID can fetch the file from the network, and
+	// verification documents are personal and business records
+	if name == "ipfs" {
+		return errors.New("verification documents cannot be kept on IPFS, where they would be public; use the local document store")
+	}
+	if _, err := documentStore(name); err != nil {
+		return err
+	}
+	defaultDocumentStore = name
+	return nil
+}
+
+// documentStore returns the named store, initializing it on first use so
+// documents kept in a store that is no longer the default stay readable
+func documentStore(name string) (DocumentStore, error) {
+	documentStoresMu.Lock()
+	defer documentStoresMu.Unlock()
+	if store, ok := documentStores[name]; ok {
+		return store, nil
+	}
+	factory, ok := documentStoreFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown document store %q", name)
+	}
+	store, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize document store %q: %w", name, err)
+	}
+	documentStores[name] = store
+	return store, nil
+}
+
+// StoreDocument saves a document in the configured store and returns the
+// store's name and the document's reference in it
+func StoreDocument(data []byte) (string, string, error) {
+	if defaultDocumentStore == "" {
+		return "", "", errors.New("document store not initialized")
+	}
+	store, err := documentStore(defaultDocumentStore)
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := store.Put(data)
+	return store.Name(), ref, err
+}
+
+// OpenDocument reads a document back from the store it was saved in
+func OpenDocument(storeName, ref string) (io.ReadCloser, error) {
+	store, err := documentStore(storeName)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(ref)
+}
+
+// LocalDocumentStore keeps documents as files in DOCUMENT_DIR, named by the
+// SHA-256 of their content
+type LocalDocumentStore struct {
+	dir string
+}
+
+func newLocalDocumentStore() (DocumentStore, error) {
+	dir := os.Getenv("DOCUMENT_DIR")
+	if dir == "" {
+		dir = "documents"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalDocumentStore{dir: dir}, nil
+}
+
+func (s *LocalDocumentStore) Name() string {
+	return "local"
+}
+
+func (s *LocalDocumentStore) path(ref string) (string, error) {
+	if len(ref) != 2*sha256.Size {
+		return "", errors.New("invalid document reference")
+	}
+	if _, err := hex.DecodeString(ref); err != nil {
+		return "", errors.New("invalid document reference")
+	}
+	return filepath.Join(s.dir, ref[:2], ref), nil
+}
+
+func (s *LocalDocumentStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+	path, err := s.path(ref)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return ref, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	// Written under a temporary name first so a partial file is never read
+	tmp, err := os.CreateTemp(filepath.Dir(path), ref+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return ref, os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalDocumentStore) Get(ref string) (io.ReadCloser, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
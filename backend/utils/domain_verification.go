@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Where and how an organization proves it controls its official domain: a
+// TXT record named DomainChallengePrefix+domain whose value is
+// DomainChallengeValuePrefix followed by the organization's challenge token
+const (
+	DomainChallengePrefix      = "_veriown-challenge."
+	DomainChallengeValuePrefix = "veriown-verification="
+)
+
+// TXTResolver looks up TXT records. *net.Resolver implements it; tests stub
+// it with SetTXTResolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var txtResolver TXTResolver = net.DefaultResolver
+
+// InitTXTResolver makes domain checks ask the DNS server at addr
+// ("host:port") instead of the system resolver. An empty addr keeps the
+// system resolver.
+func InitTXTResolver(addr string) {
+	if addr == "" {
+		txtResolver = net.DefaultResolver
+		return
+	}
+	txtResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// SetTXTResolver replaces the resolver domain checks use
+func SetTXTResolver(resolver TXTResolver) {
+	txtResolver = resolver
+}
+
+// DomainChallengeName is the name of the TXT record that proves control of
+// domain
+func DomainChallengeName(domain string) string {
+	return DomainChallengePrefix + normalizeDomain(domain)
+}
+
+// DomainChallengeValue is the TXT record value for a challenge token
+func DomainChallengeValue(token string) string {
+	return DomainChallengeValuePrefix + token
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// CheckDomainChallenge reports whether domain publishes the TXT record for
+// token. A name that does not exist is a failed check, not an error.
+func CheckDomainChallenge(domain, token string) (bool, error) {
+	if token == "" {
+		return false, errors.New("no domain challenge")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records, err := txtResolver.LookupTXT(ctx, DomainChallengeName(domain))
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	want := DomainChallengeValue(token)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// stubResolver answers TXT lookups from a fixed table
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+type failingResolver struct{}
+
+func (failingResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+func TestCheckDomainChallenge(t *testing.T) {
+	const token = "c2VjcmV0LXRva2Vu"
+	defer SetTXTResolver(net.DefaultResolver)
+
+	tests := []struct {
+		name     string
+		domain   string
+		records  map[string][]string
+		verified bool
+	}{
+		{
+			name:     "matching record",
+			domain:   "example.com",
+			records:  map[string][]string{"_veriown-challenge.example.com": {"veriown-verification=" + token}},
+			verified: true,
+		},
+		{
+			name:     "matching record among others",
+			domain:   "Example.COM.",
+			records:  map[string][]string{"_veriown-challenge.example.com": {"v=spf1 -all", " veriown-verification=" + token + " "}},
+			verified: true,
+		},
+		{
+			name:     "missing record",
+			domain:   "example.com",
+			records:  map[string][]string{},
+			verified: false,
+		},
+		{
+			name:     "record on the bare domain",
+			domain:   "example.com",
+			records:  map[string][]string{"example.com": {"veriown-verification=" + token}},
+			verified: false,
+		},
+		{
+			name:     "wrong token",
+			domain:   "example.com",
+			records:  map[string][]string{"_veriown-challenge.example.com": {"veriown-verification=someone-elses-token"}},
+			verified: false,
+		},
+		{
+			name:     "token without prefix",
+			domain:   "example.com",
+			records:  map[string][]string{"_veriown-challenge.example.com": {token}},
+			verified: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetTXTResolver(stubResolver(tt.records))
+			verified, err := CheckDomainChallenge(tt.domain, token)
+			if err != nil {
+				t.Fatalf("CheckDomainChallenge: %v", err)
+			}
+			if verified != tt.verified {
+				t.Errorf("verified = %v, want %v", verified, tt.verified)
+			}
+		})
+	}
+}
+
+func TestCheckDomainChallengeErrors(t *testing.T) {
+	defer SetTXTResolver(net.DefaultResolver)
+
+	SetTXTResolver(failingResolver{})
+	verified, err := CheckDomainChallenge("example.com", "token")
+	var dnsErr *net.DNSError
+	if verified || !errors.As(err, &dnsErr) {
+		t.Errorf("lookup failure: got (%v, %v), want a DNS error", verified, err)
+	}
+
+	SetTXTResolver(stubResolver{"_veriown-challenge.example.com": {"veriown-verification="}})
+	if verified, err := CheckDomainChallenge("example.com", ""); verified || err == nil {
+		t.Errorf("empty token: got (%v, %v), want an error", verified, err)
+	}
+}
@@ -1,31 +1,160 @@
 package utils
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Event hash encodings. Version 1 hashes json.Marshal of the struct below,
+// which depends on the time zone and sub-millisecond precision of CreatedAt,
+// so it is kept only to verify old events. Version 2 is a canonical encoding.
+const (
+	EventHashVersionLegacy    = 1
+	EventHashVersionCanonical = 2
+
+	CurrentEventHashVersion = EventHashVersionCanonical
+)
+
+// EventTimestampPrecision is the precision event timestamps are stored and
+// hashed at; it matches the datetime(3) columns MySQL uses for them
+const EventTimestampPrecision = time.Millisecond
+
 type EventHashData struct {
 	ProductID         uint
-    EventType        string
-    EventData        string
-    CreatedAt        time.Time
-    CreatedBy        uint
-    PreviousEventHash string
+	EventType         string
+	EventData         string
+	CreatedAt         time.Time
+	CreatedBy         uint
+	PreviousEventHash string
+	HashVersion       int `json:"-"` // Not part of the legacy encoding
+}
+
+// EventHashPayload returns the exact bytes that are hashed for an event. Actors
+// signing their own events sign these bytes.
+func EventHashPayload(data EventHashData) ([]byte, error) {
+	switch data.HashVersion {
+	case 0, EventHashVersionLegacy:
+		return json.Marshal(data)
+	case EventHashVersionCanonical:
+		return canonicalEventPayload(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported event hash version %d", data.HashVersion)
+	}
 }
 
-func ComputeEventHash (data EventHashData) (string, error) {
+// canonicalEventPayload encodes the event as a JSON object in the style of
+// RFC 8785 (JCS): keys in sorted order, no insignificant whitespace, minimal
+// string escaping, and the timestamp in UTC at fixed millisecond precision.
+func canonicalEventPayload(data EventHashData) []byte {
+	var b strings.Builder
+	b.WriteString(`{"created_at":`)
+	writeCanonicalString(&b, data.CreatedAt.UTC().Truncate(EventTimestampPrecision).Format("2006-01-02T15:04:05.000Z"))
+	b.WriteString(`,"created_by":`)
+	b.WriteString(strconv.FormatUint(uint64(data.CreatedBy), 10))
+	b.WriteString(`,"event_data":`)
+	writeCanonicalString(&b, data.EventData)
+	b.WriteString(`,"event_type":`)
+	writeCanonicalString(&b, data.EventType)
+	b.WriteString(`,"hash_version":`)
+	b.WriteString(strconv.Itoa(data.HashVersion))
+	b.WriteString(`,"previous_event_hash":`)
+	writeCanonicalString(&b, data.PreviousEventHash)
+	b.WriteString(`,"product_id":`)
+	b.WriteString(strconv.FormatUint(uint64(data.ProductID), 10))
+	b.WriteString(`}`)
+	return []byte(b.String())
+}
+
+// writeCanonicalString writes s as a JSON string using the RFC 8785 escaping
+// rules. Invalid UTF-8 is replaced with U+FFFD.
+func writeCanonicalString(b *strings.Builder, s string) {
+	const hexDigits = "0123456789abcdef"
+
+	b.WriteByte('"')
+	for _, r := range strings.ToValidUTF8(s, "\uFFFD") {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				b.WriteString(`\u00`)
+				b.WriteByte(hexDigits[r>>4])
+				b.WriteByte(hexDigits[r&0xf])
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+func ComputeEventHash(data EventHashData) (string, error) {
 	// Convert the data to json
-	jsonData, err := json.Marshal(data)
+	jsonData, err := EventHashPayload(data)
 	if err != nil {
 		return "Cannnot marhsal event data", err
 	}
 
 	// Pass it to sha
-	hash  := sha256.Sum256(jsonData)
+	hash := sha256.Sum256(jsonData)
 
 	return hex.EncodeToString(hash[:]), nil
 }
 
+// EventSignaturePayload is what the server signs for an event. The prefix
+// keeps an event signature from being valid for any other signed object.
+func EventSignaturePayload(eventHash string) []byte {
+	return []byte("veriown-event/v1:" + eventHash)
+}
+
+// ParseActorPublicKey decodes a base64 Ed25519 public key registered by a user
+func ParseActorPublicKey(encoded string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("public key must be a base64 encoded Ed25519 key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// VerifyActorSignature checks a signature made by an actor's own key over the
+// event hash payload
+func VerifyActorSignature(publicKey string, data EventHashData, signature string) error {
+	pub, err := ParseActorPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	payload, err := EventHashPayload(data)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid actor signature encoding")
+	}
+	if !ed25519.Verify(pub, payload, sig) {
+		return errors.New("actor signature does not verify")
+	}
+	return nil
+}
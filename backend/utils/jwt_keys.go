@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Algorithms accepted for access tokens when JWT_ALLOWED_ALGORITHMS is unset.
+// HS256 has to be allowed explicitly: anyone holding an HMAC secret can mint
+// tokens, so it cannot be shared with services that only verify.
+var defaultJWTAlgorithms = []string{"EdDSA", "RS256"}
+
+// jwtKey is a key that signs or verifies access tokens, identified in the
+// token header by its kid
+type jwtKey struct {
+	keyID     string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// jwtKeyset holds every configured token key. Tokens are signed with the
+// active key and verified with whichever key their kid names, so a new key
+// can take over while tokens signed by the old one are still in use.
+type jwtKeyset struct {
+	keys        map[string]*jwtKey
+	activeKeyID string
+	allowed     []string
+}
+
+var jwtKeys *jwtKeyset
+
+// InitJWTKeys loads the access token keys from dir. Each file is one key
+// named after its kid: <kid>.pem holds an RSA (RS256) or Ed25519 (EdDSA)
+// private key, <kid>.hmac an HS256 secret. activeKeyID picks the signing key
+// and may be empty when there is only one; an empty directory gets a fresh
+// Ed25519 key. allowed lists the algorithms tokens may use.
+func InitJWTKeys(dir, activeKeyID string, allowed []string) error {
+	if len(allowed) == 0 {
+		allowed = defaultJWTAlgorithms
+	}
+	for _, alg := range allowed {
+		if alg != "EdDSA" && alg != "RS256" && alg != "HS256" {
+			return fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create JWT key directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read JWT keys: %w", err)
+	}
+
+	ks := &jwtKeyset{keys: make(map[string]*jwtKey), allowed: allowed}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".pem" && ext != ".hmac") {
+			continue
+		}
+		key, err := readJWTKey(filepath.Join(dir, entry.Name()), strings.TrimSuffix(entry.Name(), ext))
+		if err != nil {
+			return err
+		}
+		ks.keys[key.keyID] = key
+	}
+
+	if len(ks.keys) == 0 {
+		key, err := generateJWTKey(dir)
+		if err != nil {
+			return err
+		}
+		ks.keys[key.keyID] = key
+	}
+
+	if activeKeyID == "" && len(ks.keys) == 1 {
+		for keyID := range ks.keys {
+			activeKeyID = keyID
+		}
+	}
+	active, ok := ks.keys[activeKeyID]
+	if !ok {
+		return fmt.Errorf("JWT signing key %q not found in %s", activeKeyID, dir)
+	}
+	if !containsAlgorithm(allowed, active.method.Alg()) {
+		return fmt.Errorf("JWT signing key %s uses %s, which is not an allowed algorithm", active.keyID, active.method.Alg())
+	}
+	ks.activeKeyID = activeKeyID
+
+	jwtKeys = ks
+	return nil
+}
+
+func readJWTKey(path, keyID string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key %s: %w", keyID, err)
+	}
+
+	if filepath.Ext(path) == ".hmac" {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("JWT key %s: HMAC secrets must be at least 32 bytes", keyID)
+		}
+		return &jwtKey{keyID: keyID, method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT key %s is not PEM encoded", keyID)
+	}
+	var priv interface{}
+	if priv, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("JWT key %s is not a PKCS#8 or PKCS#1 private key", keyID)
+		}
+	}
+
+	switch key := priv.(type) {
+	case ed25519.PrivateKey:
+		return &jwtKey{keyID: keyID, method: jwt.SigningMethodEdDSA, signKey: key, verifyKey: key.Public()}, nil
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("JWT key %s: RSA keys must be at least 2048 bits", keyID)
+		}
+		return &jwtKey{keyID: keyID, method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}, nil
+	default:
+		return nil, fmt.Errorf("JWT key %s has an unsupported key type", keyID)
+	}
+}
+
+// generateJWTKey creates the first Ed25519 token key in an empty directory
+func generateJWTKey(dir string) (*jwtKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := KeyIDFor(pub)
+	path := filepath.Join(dir, keyID+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write JWT key: %w", err)
+	}
+	return &jwtKey{keyID: keyID, method: jwt.SigningMethodEdDSA, signKey: priv, verifyKey: pub}, nil
+}
+
+func containsAlgorithm(allowed []string, alg string) bool {
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// SignJWT signs claims with the active key, naming it in the kid header
+func SignJWT(claims jwt.Claims) (string, error) {
+	if jwtKeys == nil {
+		return "", errors.New("JWT keys not initialized")
+	}
+	key := jwtKeys.keys[jwtKeys.activeKeyID]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.keyID
+	return token.SignedString(key.signKey)
+}
+
+// ParseJWT verifies a token. Its algorithm must be on the allowed list and
+// match the key its kid names, so a token cannot pick how it is checked.
+func ParseJWT(tokenString string) (*jwt.Token, error) {
+	if jwtKeys == nil {
+		return nil, errors.New("JWT keys not initialized")
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods(jwtKeys.allowed))
+	return parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key, ok := jwtKeys.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", keyID)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("key %s does not sign %s tokens", keyID, token.Method.Alg())
+		}
+		return key.verifyKey, nil
+	})
+}
+
+// JWK is a public token key in JSON Web Key form (RFC 7517, RFC 8037)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS returns the public keys that verify access tokens. HMAC keys are
+// secret and never published.
+func JWKS() []JWK {
+	if jwtKeys == nil {
+		return nil
+	}
+	keys := make([]JWK, 0, len(jwtKeys.keys))
+	for _, key := range jwtKeys.keys {
+		if !containsAlgorithm(jwtKeys.allowed, key.method.Alg()) {
+			continue
+		}
+		jwk := JWK{KeyID: key.keyID, Use: "sig", Algorithm: key.method.Alg()}
+		switch pub := key.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+	return keys
+}
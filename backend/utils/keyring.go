@@ -0,0 +1,437 @@
+package utils
+
+import (
+	"backend/models"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	KeyStatusActive   = "active"
+	KeyStatusInactive = "inactive"
+	KeyStatusRetired  = "retired"
+)
+
+// Keyring holds the server's Ed25519 signing keys. Private keys live in a
+// directory on disk, next to a pinned copy of each key's public half and
+// activation window. Signatures are only checked against those pins; the
+// database records the keys for publishing, so database access alone is
+// not enough to forge a signature.
+type Keyring struct {
+	mu          sync.RWMutex
+	dir         string
+	keys        map[string]pinnedKey
+	privateKeys map[string]ed25519.PrivateKey
+	activeKeyID string
+	// Events up to this ID were written before events were signed
+	lastUnsignedEventID uint
+}
+
+// pinnedKey is what the keyring trusts about a signing key. It is kept in
+// <key_id>.pub and outlives the private key when the key is retired.
+type pinnedKey struct {
+	KeyID         string     `json:"key_id"`
+	PublicKey     string     `json:"public_key"` // Base64 encoded
+	ActivatedAt   time.Time  `json:"activated_at"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+}
+
+// legacyEvents records, once, the newest event that predates signing. It is
+// kept in legacy_events.json next to the pins.
+type legacyEvents struct {
+	LastUnsignedEventID uint      `json:"last_unsigned_event_id"`
+	PinnedAt            time.Time `json:"pinned_at"`
+}
+
+var keyring *Keyring
+
+// KeyIDFor derives a short stable identifier from a public key
+func KeyIDFor(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// InitKeyring loads the signing keys from dir, creating the first active key
+// when none exists yet. A key directory from before keys were pinned is
+// pinned once from the database.
+func InitKeyring(db *gorm.DB, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	kr := &Keyring{
+		dir:         dir,
+		keys:        make(map[string]pinnedKey),
+		privateKeys: make(map[string]ed25519.PrivateKey),
+	}
+
+	if err := kr.readPins(); err != nil {
+		return err
+	}
+	if len(kr.keys) == 0 {
+		if err := kr.pinFromDatabase(db); err != nil {
+			return err
+		}
+	}
+
+	if err := kr.pinLegacyEvents(db); err != nil {
+		return err
+	}
+
+	for keyID, pin := range kr.keys {
+		priv, err := kr.readPrivateKey(keyID)
+		if errors.Is(err, fs.ErrNotExist) && pin.DeactivatedAt != nil {
+			continue // retired
+		}
+		if err != nil {
+			return err
+		}
+		if base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)) != pin.PublicKey {
+			return fmt.Errorf("private key on disk does not match signing key %s", keyID)
+		}
+		kr.privateKeys[keyID] = priv
+		if pin.DeactivatedAt == nil {
+			if kr.activeKeyID != "" {
+				return fmt.Errorf("signing keys %s and %s are both active", kr.activeKeyID, keyID)
+			}
+			kr.activeKeyID = keyID
+		}
+	}
+
+	keyring = kr
+	if kr.activeKeyID == "" {
+		if _, err := RotateSigningKey(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kr *Keyring) keyPath(keyID string) string {
+	return filepath.Join(kr.dir, keyID+".key")
+}
+
+func (kr *Keyring) pinPath(keyID string) string {
+	return filepath.Join(kr.dir, keyID+".pub")
+}
+
+func (kr *Keyring) readPrivateKey(keyID string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(kr.keyPath(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %w", keyID, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key %s has invalid length", keyID)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// readPins loads every pinned key in the directory
+func (kr *Keyring) readPins() error {
+	paths, err := filepath.Glob(filepath.Join(kr.dir, "*.pub"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read pinned key: %w", err)
+		}
+		var pin pinnedKey
+		if err := json.Unmarshal(data, &pin); err != nil {
+			return fmt.Errorf("pinned key %s is malformed: %w", filepath.Base(path), err)
+		}
+		if _, err := pin.publicKey(); err != nil || kr.pinPath(pin.KeyID) != path {
+			return fmt.Errorf("pinned key %s does not match its key ID", filepath.Base(path))
+		}
+		kr.keys[pin.KeyID] = pin
+	}
+	return nil
+}
+
+// pinFromDatabase pins the keys recorded in the database, once, for a key
+// directory written before keys were pinned. Keys whose private half is on
+// disk are pinned to it rather than to the recorded public key.
+func (kr *Keyring) pinFromDatabase(db *gorm.DB) error {
+	var keys []models.SigningKey
+	if err := db.Order("activated_at asc").Find(&keys).Error; err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	for _, key := range keys {
+		pin := pinnedKey{KeyID: key.KeyID, PublicKey: key.PublicKey, ActivatedAt: key.ActivatedAt, DeactivatedAt: key.DeactivatedAt}
+		if priv, err := kr.readPrivateKey(key.KeyID); err == nil {
+			pin.PublicKey = base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if _, err := pin.publicKey(); err != nil {
+			return err
+		}
+		if err := kr.writePin(pin); err != nil {
+			return err
+		}
+		kr.keys[pin.KeyID] = pin
+	}
+	if len(keys) > 0 {
+		fmt.Printf("Warning: pinned %d signing keys from the database in %s; check them against your records\n", len(keys), kr.dir)
+	}
+	return nil
+}
+
+// pinLegacyEvents reads the legacy event cutoff, pinning the newest unsigned
+// event the first time the keyring starts
+func (kr *Keyring) pinLegacyEvents(db *gorm.DB) error {
+	path := filepath.Join(kr.dir, "legacy_events.json")
+	var legacy legacyEvents
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return fmt.Errorf("legacy_events.json is malformed: %w", err)
+		}
+		kr.lastUnsignedEventID = legacy.LastUnsignedEventID
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read legacy_events.json: %w", err)
+	}
+
+	if db.Migrator().HasTable(&models.Event{}) {
+		if err := db.Unscoped().Model(&models.Event{}).Where("signature = ''").
+			Select("COALESCE(MAX(id), 0)").Scan(&legacy.LastUnsignedEventID).Error; err != nil {
+			return fmt.Errorf("failed to find unsigned events: %w", err)
+		}
+	}
+	legacy.PinnedAt = time.Now().UTC()
+	if data, err = json.MarshalIndent(legacy, "", "  "); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write legacy_events.json: %w", err)
+	}
+	kr.lastUnsignedEventID = legacy.LastUnsignedEventID
+	return nil
+}
+
+// IsLegacyEvent reports whether the event with this ID was written before
+// the server signed events, going by the cutoff pinned with the keys
+func IsLegacyEvent(eventID uint) bool {
+	return keyring != nil && eventID <= keyring.lastUnsignedEventID
+}
+
+// writePin replaces the pinned copy of a key
+func (kr *Keyring) writePin(pin pinnedKey) error {
+	data, err := json.MarshalIndent(pin, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := kr.pinPath(pin.KeyID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write pinned key: %w", err)
+	}
+	if err := os.Rename(tmp, kr.pinPath(pin.KeyID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write pinned key: %w", err)
+	}
+	return nil
+}
+
+// publicKey decodes the pinned public key and checks it against the key ID
+func (pin *pinnedKey) publicKey() (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(pin.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize || KeyIDFor(pub) != pin.KeyID {
+		return nil, fmt.Errorf("signing key %s has an invalid public key", pin.KeyID)
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// ErrNoSigningKey is returned by SignAt when no key it can sign with was
+// active at the requested time
+var ErrNoSigningKey = errors.New("no signing key active")
+
+// SignAt signs payload with the key that is active at the given time and
+// returns the key ID and base64 signature. Choosing by time rather than taking
+// whatever key is current keeps a rotation that lands between an event's
+// creation and its signing from producing an unverifiable signature.
+func SignAt(at time.Time, payload []byte) (string, string, error) {
+	if keyring == nil {
+		return "", "", errors.New("keyring not initialized")
+	}
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+
+	for keyID, pin := range keyring.keys {
+		if !keyActiveAt(&pin, at) {
+			continue
+		}
+		priv, ok := keyring.privateKeys[keyID]
+		if !ok {
+			break
+		}
+		return keyID, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload)), nil
+	}
+	return "", "", fmt.Errorf("%w at %s", ErrNoSigningKey, at.Format(time.RFC3339))
+}
+
+func keyActiveAt(pin *pinnedKey, at time.Time) bool {
+	return !at.Before(pin.ActivatedAt) && (pin.DeactivatedAt == nil || at.Before(*pin.DeactivatedAt))
+}
+
+// VerifySignature checks a signature against the pinned key identified by
+// keyID and requires that the key was active at signedAt.
+func VerifySignature(keyID string, signedAt time.Time, payload []byte, signature string) error {
+	if keyring == nil {
+		return errors.New("keyring not initialized")
+	}
+	keyring.mu.RLock()
+	pin, ok := keyring.keys[keyID]
+	keyring.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown signing key %s", keyID)
+	}
+	pub, err := pin.publicKey()
+	if err != nil {
+		return err
+	}
+
+	if !keyActiveAt(&pin, signedAt) {
+		return fmt.Errorf("signing key %s was not active at %s", keyID, signedAt.Format(time.RFC3339))
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(pub, payload, sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// RotateSigningKey creates a new active key and deactivates the previous one.
+// The old key stays available for verifying what it signed while active.
+func RotateSigningKey(db *gorm.DB) (*models.SigningKey, error) {
+	if keyring == nil {
+		return nil, errors.New("keyring not initialized")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	keyID := KeyIDFor(pub)
+	if err := os.WriteFile(keyring.keyPath(keyID), priv.Seed(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write private key: %w", err)
+	}
+
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	// Put the activation boundary on a whole second so it survives whatever
+	// timestamp precision the database applies. Until then the previous key
+	// keeps signing.
+	now := time.Now().UTC().Truncate(time.Second)
+	if keyring.activeKeyID != "" {
+		now = now.Add(time.Second)
+	}
+	pin := pinnedKey{KeyID: keyID, PublicKey: base64.StdEncoding.EncodeToString(pub), ActivatedAt: now}
+	previous, hadPrevious := keyring.keys[keyring.activeKeyID]
+	retiredPrevious := previous
+	retiredPrevious.DeactivatedAt = &now
+
+	// Pin first, so a key the database knows about is always pinned
+	undo := func() {
+		os.Remove(keyring.keyPath(keyID))
+		os.Remove(keyring.pinPath(keyID))
+		if hadPrevious {
+			keyring.writePin(previous)
+		}
+	}
+	err = keyring.writePin(pin)
+	if err == nil && hadPrevious {
+		err = keyring.writePin(retiredPrevious)
+	}
+	if err != nil {
+		undo()
+		return nil, err
+	}
+
+	key := &models.SigningKey{
+		KeyID:       keyID,
+		Algorithm:   "Ed25519",
+		PublicKey:   pin.PublicKey,
+		Status:      KeyStatusActive,
+		ActivatedAt: now,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SigningKey{}).Where("status = ?", KeyStatusActive).
+			Updates(map[string]interface{}{"status": KeyStatusInactive, "deactivated_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+	if err != nil {
+		undo()
+		return nil, fmt.Errorf("failed to save signing key: %w", err)
+	}
+
+	if hadPrevious {
+		keyring.keys[previous.KeyID] = retiredPrevious
+	}
+	keyring.keys[keyID] = pin
+	keyring.privateKeys[keyID] = priv
+	keyring.activeKeyID = keyID
+	return key, nil
+}
+
+// RetireSigningKey destroys the private half of an inactive key. Signatures it
+// made while active still verify against its pin, but it can never sign again.
+func RetireSigningKey(db *gorm.DB, keyID string) (*models.SigningKey, error) {
+	if keyring == nil {
+		return nil, errors.New("keyring not initialized")
+	}
+
+	var key models.SigningKey
+	if err := db.Where("key_id = ?", keyID).First(&key).Error; err != nil {
+		return nil, err
+	}
+
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	pin, ok := keyring.keys[keyID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if pin.DeactivatedAt == nil {
+		return nil, errors.New("the active key must be rotated out before it can be retired")
+	}
+	if key.Status == KeyStatusRetired {
+		return &key, nil
+	}
+
+	now := time.Now().UTC()
+	key.Status = KeyStatusRetired
+	key.RetiredAt = &now
+	if err := db.Save(&key).Error; err != nil {
+		return nil, err
+	}
+
+	delete(keyring.privateKeys, keyID)
+	if err := os.Remove(keyring.keyPath(keyID)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove private key: %w", err)
+	}
+	return &key, nil
+}
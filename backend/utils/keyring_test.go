@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"backend/models"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openKeyringDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.SigningKey{}, &models.Event{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func setupKeyring(t *testing.T) (*gorm.DB, string) {
+	t.Helper()
+	return startKeyring(t, openKeyringDB(t))
+}
+
+func startKeyring(t *testing.T, db *gorm.DB) (*gorm.DB, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "keys")
+	if err := InitKeyring(db, dir); err != nil {
+		t.Fatalf("init keyring: %v", err)
+	}
+	t.Cleanup(func() { keyring = nil })
+	return db, dir
+}
+
+func TestVerifySignatureIgnoresDatabaseKeys(t *testing.T) {
+	db, _ := setupKeyring(t)
+	payload := []byte("payload")
+
+	// A key planted in the database, with an ID that matches it
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	planted := models.SigningKey{
+		KeyID:       KeyIDFor(pub),
+		Algorithm:   "Ed25519",
+		PublicKey:   base64.StdEncoding.EncodeToString(pub),
+		Status:      KeyStatusActive,
+		ActivatedAt: time.Now().Add(-time.Hour),
+	}
+	if err := db.Create(&planted).Error; err != nil {
+		t.Fatalf("plant key: %v", err)
+	}
+	forged := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload))
+	if err := VerifySignature(planted.KeyID, time.Now(), payload, forged); err == nil {
+		t.Error("signature from a key only the database knows verified")
+	}
+
+	// Moving the real key's activation window in the database changes nothing
+	keyID, signature, err := SignAt(time.Now(), payload)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := db.Model(&models.SigningKey{}).Where("key_id = ?", keyID).
+		Update("activated_at", time.Now().Add(-48*time.Hour)).Error; err != nil {
+		t.Fatalf("move activation: %v", err)
+	}
+	if err := VerifySignature(keyID, time.Now().Add(-24*time.Hour), payload, signature); err == nil {
+		t.Error("signature verified outside the pinned activation window")
+	}
+	if err := VerifySignature(keyID, time.Now(), payload, signature); err != nil {
+		t.Errorf("signature from the active key: %v", err)
+	}
+}
+
+func TestPinsOutliveRetirement(t *testing.T) {
+	db, dir := setupKeyring(t)
+	payload := []byte("payload")
+
+	signedAt := time.Now()
+	keyID, signature, err := SignAt(signedAt, payload)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := RotateSigningKey(db); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, err := RetireSigningKey(db, keyID); err != nil {
+		t.Fatalf("retire: %v", err)
+	}
+
+	// After a restart the retired key is known from its pin alone
+	if err := db.Where("key_id = ?", keyID).Delete(&models.SigningKey{}).Error; err != nil {
+		t.Fatalf("delete key record: %v", err)
+	}
+	if err := InitKeyring(db, dir); err != nil {
+		t.Fatalf("reload keyring: %v", err)
+	}
+	if err := VerifySignature(keyID, signedAt, payload, signature); err != nil {
+		t.Errorf("signature from the retired key: %v", err)
+	}
+	if _, _, err := SignAt(signedAt, payload); err == nil {
+		t.Error("signed with a retired key")
+	}
+}
+
+// chainEvent creates the next event of a product's chain, signed when sign
+// is set
+func chainEvent(t *testing.T, db *gorm.DB, previous string, sign bool) models.Event {
+	t.Helper()
+	event := models.Event{ProductID: 1, EventType: "repair", EventData: "{}", CreatedBy: 1,
+		PreviousEventHash: previous, HashVersion: CurrentEventHashVersion}
+	var count int64
+	if err := db.Model(&models.Event{}).Where("product_id = ?", event.ProductID).Count(&count).Error; err != nil {
+		t.Fatalf("count events: %v", err)
+	}
+	event.Sequence = uint(count) + 1
+	event.CreatedAt = time.Now().Truncate(EventTimestampPrecision)
+	hash, err := ComputeEventHash(HashDataForEvent(&event))
+	if err != nil {
+		t.Fatalf("hash event: %v", err)
+	}
+	event.EventHash = hash
+	if sign {
+		if event.SigningKeyID, event.Signature, err = SignAt(event.CreatedAt, EventSignaturePayload(hash)); err != nil {
+			t.Fatalf("sign event: %v", err)
+		}
+	}
+	if err := db.Create(&event).Error; err != nil {
+		t.Fatalf("create event: %v", err)
+	}
+	return event
+}
+
+func TestUnsignedEventsAfterCutoffFail(t *testing.T) {
+	db := openKeyringDB(t)
+	legacy := chainEvent(t, db, "", false)
+	_, dir := startKeyring(t, db)
+
+	signed := chainEvent(t, db, legacy.EventHash, true)
+	forged := chainEvent(t, db, signed.EventHash, false)
+
+	// The cutoff is read from the key directory, not worked out again
+	if err := InitKeyring(db, dir); err != nil {
+		t.Fatalf("reload keyring: %v", err)
+	}
+	report := BuildChainReport(1, []models.Event{legacy, signed, forged})
+	var statuses []string
+	for _, event := range report.Events {
+		statuses = append(statuses, event.Status)
+	}
+	want := []string{EventStatusUnsignedLegacy, EventStatusOK, EventStatusSignatureInvalid}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if report.Valid || report.Totals.UnsignedLegacy != 1 {
+		t.Errorf("valid = %v, unsigned_legacy = %d; want false, 1", report.Valid, report.Totals.UnsignedLegacy)
+	}
+}
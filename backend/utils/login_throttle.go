@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"backend/models"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How long failed logins are kept after the last one, unless a lockout lasts
+// longer. It exceeds any sensible LoginThrottlePolicy.Window.
+const loginThrottleRetention = 24 * time.Hour
+
+// LoginThrottlePolicy says how many failed logins are tolerated for one key.
+// After FreeFailures each failure doubles the wait before the next attempt,
+// from one second up to MaxDelay; LockoutFailures failures lock the key for
+// Lockout. Failures are forgotten after Window without one.
+type LoginThrottlePolicy struct {
+	FreeFailures    int
+	LockoutFailures int
+	MaxDelay        time.Duration
+	Lockout         time.Duration
+	Window          time.Duration
+}
+
+// AccountThrottleKey is the throttle key of a username
+func AccountThrottleKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+// IPThrottleKey is the throttle key of a client IP address
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginWait returns how long a key has to wait before its next login
+// attempt, because it is locked or delayed
+func LoginWait(db *gorm.DB, key string) (time.Duration, error) {
+	var throttle models.LoginThrottle
+	err := db.Where("`key` = ?", key).First(&throttle).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if throttle.LockedUntil != nil && throttle.LockedUntil.After(now) {
+		return throttle.LockedUntil.Sub(now), nil
+	}
+	if throttle.NextAttemptAt.After(now) {
+		return throttle.NextAttemptAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// RecordLoginFailure counts a failed login against a key and reports
+// whether this failure locked it
+func RecordLoginFailure(db *gorm.DB, key string, policy LoginThrottlePolicy) (bool, error) {
+	locked := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.LoginThrottle{Key: key, LastFailureAt: now, NextAttemptAt: now}).Error; err != nil {
+			return err
+		}
+		var throttle models.LoginThrottle
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("`key` = ?", key).First(&throttle).Error; err != nil {
+			return err
+		}
+
+		stillLocked := throttle.LockedUntil != nil && throttle.LockedUntil.After(now)
+		if !stillLocked && now.Sub(throttle.LastFailureAt) > policy.Window {
+			throttle.Failures = 0
+		}
+		throttle.Failures++
+		throttle.LastFailureAt = now
+
+		if extra := throttle.Failures - policy.FreeFailures; extra > 0 {
+			delay := policy.MaxDelay
+			if extra <= 30 && time.Duration(1<<(extra-1))*time.Second < policy.MaxDelay {
+				delay = time.Duration(1<<(extra-1)) * time.Second
+			}
+			throttle.NextAttemptAt = now.Add(delay)
+		}
+		if throttle.Failures >= policy.LockoutFailures && !stillLocked {
+			lockedUntil := now.Add(policy.Lockout)
+			throttle.LockedUntil = &lockedUntil
+			locked = true
+		}
+		return tx.Save(&throttle).Error
+	})
+	return locked, err
+}
+
+// ClearLoginThrottle forgets the failed logins of a key, after a successful
+// login or when an admin unlocks an account
+func ClearLoginThrottle(db *gorm.DB, key string) error {
+	return db.Unscoped().Where("`key` = ?", key).Delete(&models.LoginThrottle{}).Error
+}
+
+// pruneLoginThrottles drops the failed login counts of keys that are not
+// locked and have not failed for loginThrottleRetention
+func pruneLoginThrottles(db *gorm.DB) error {
+	now := time.Now()
+	return db.Unscoped().Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-loginThrottleRetention), now).
+		Delete(&models.LoginThrottle{}).Error
+}
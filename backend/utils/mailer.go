@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MailMessage is a plain text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. The built-in mailers do not send anything: they
+// print messages or write them to files, for development and tests.
+type Mailer interface {
+	Name() string
+	Send(msg MailMessage) error
+}
+
+var (
+	mailers = map[string]func() (Mailer, error){
+		"console": newConsoleMailer,
+		"file":    newFileMailer,
+	}
+	mailer Mailer
+)
+
+// RegisterMailer makes a mailer available to InitMailer
+func RegisterMailer(name string, factory func() (Mailer, error)) {
+	mailers[name] = factory
+}
+
+// InitMailer selects the mailer by name. The console mailer is used when
+// name is empty.
+func InitMailer(name string) error {
+	if name == "" {
+		name = "console"
+	}
+	factory, ok := mailers[name]
+	if !ok {
+		return fmt.Errorf("unknown mailer %q", name)
+	}
+	m, err := factory()
+	if err != nil {
+		return fmt.Errorf("failed to initialize mailer %q: %w", name, err)
+	}
+	mailer = m
+	return nil
+}
+
+// Mail returns the configured mailer
+func Mail() (Mailer, error) {
+	if mailer == nil {
+		return nil, errors.New("mailer not initialized")
+	}
+	return mailer, nil
+}
+
+// mailFrom is the sender of every message
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "VeriOwn <no-reply@localhost>"
+}
+
+// formatMail renders a message in Internet Message Format
+func formatMail(msg MailMessage, at time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", mailFrom())
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", at.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.String()
+}
+
+// ConsoleMailer prints messages to standard output
+type ConsoleMailer struct{}
+
+func newConsoleMailer() (Mailer, error) {
+	return ConsoleMailer{}, nil
+}
+
+func (ConsoleMailer) Name() string {
+	return "console"
+}
+
+func (ConsoleMailer) Send(msg MailMessage) error {
+	fmt.Printf("----- mail -----\n%s\n----- end of mail -----\n",
+		strings.ReplaceAll(formatMail(msg, time.Now()), "\r\n", "\n"))
+	return nil
+}
+
+// FileMailer writes each message to its own .eml file in MAIL_DIR
+type FileMailer struct {
+	dir string
+}
+
+func newFileMailer() (Mailer, error) {
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "mail"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Name() string {
+	return "file"
+}
+
+func (m *FileMailer) Send(msg MailMessage) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(formatMail(msg, now)), 0600)
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// The tree layout follows RFC 6962: leaves and interior nodes are hashed with
+// distinct prefixes so a leaf can never be passed off as a subtree.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof is an inclusion proof for a single leaf of a Merkle tree.
+type MerkleProof struct {
+	LeafIndex int      `json:"leaf_index"`
+	TreeSize  int      `json:"tree_size"`
+	LeafHash  string   `json:"leaf_hash"`
+	AuditPath []string `json:"audit_path"`
+	RootHash  string   `json:"root_hash"`
+}
+
+// MerkleLeafHash hashes an event hash (hex) into a leaf of the tree.
+func MerkleLeafHash(eventHash string) []byte {
+	data, err := hex.DecodeString(eventHash)
+	if err != nil {
+		data = []byte(eventHash)
+	}
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// largest power of two strictly smaller than n (n > 1)
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleTreeHash(leaves[:k]), merkleTreeHash(leaves[k:]))
+}
+
+func merkleAuditPath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merkleAuditPath(index, leaves[:k]), merkleTreeHash(leaves[k:]))
+	}
+	return append(merkleAuditPath(index-k, leaves[k:]), merkleTreeHash(leaves[:k]))
+}
+
+func merkleLeaves(eventHashes []string) [][]byte {
+	leaves := make([][]byte, len(eventHashes))
+	for i, eventHash := range eventHashes {
+		leaves[i] = MerkleLeafHash(eventHash)
+	}
+	return leaves
+}
+
+// ComputeMerkleRoot returns the hex root of the tree built over the given
+// event hashes, in order.
+func ComputeMerkleRoot(eventHashes []string) string {
+	return hex.EncodeToString(merkleTreeHash(merkleLeaves(eventHashes)))
+}
+
+// A Merkle frontier is the roots of the perfect subtrees a tree of n leaves
+// splits into, one per set bit of n, largest first. It is all that is needed
+// to append a leaf and get the new root without reading the earlier leaves.
+
+// MerkleFrontier returns the frontier of the tree built over the given event
+// hashes, in order
+func MerkleFrontier(eventHashes []string) []string {
+	var frontier []string
+	for size, eventHash := range eventHashes {
+		frontier, _ = AppendMerkleFrontier(frontier, size, eventHash)
+	}
+	return frontier
+}
+
+// AppendMerkleFrontier adds an event hash to the frontier of a tree of size
+// leaves and returns the frontier of the tree one leaf larger
+func AppendMerkleFrontier(frontier []string, size int, eventHash string) ([]string, error) {
+	if size < 0 || len(frontier) != bits.OnesCount(uint(size)) {
+		return nil, fmt.Errorf("frontier of %d subtrees does not fit a tree of size %d", len(frontier), size)
+	}
+
+	// Each low set bit of size is a subtree as large as the one being built,
+	// so the two merge into the next size up
+	node := MerkleLeafHash(eventHash)
+	for ; size&1 == 1; size >>= 1 {
+		last := len(frontier) - 1
+		left, err := hex.DecodeString(frontier[last])
+		if err != nil {
+			return nil, fmt.Errorf("invalid frontier entry: %w", err)
+		}
+		node = merkleNodeHash(left, node)
+		frontier = frontier[:last]
+	}
+	return append(frontier, hex.EncodeToString(node)), nil
+}
+
+// MerkleFrontierRoot returns the hex root of the tree a frontier describes,
+// the same root ComputeMerkleRoot returns for its leaves
+func MerkleFrontierRoot(frontier []string) (string, error) {
+	if len(frontier) == 0 {
+		return ComputeMerkleRoot(nil), nil
+	}
+	root, err := hex.DecodeString(frontier[len(frontier)-1])
+	if err != nil {
+		return "", fmt.Errorf("invalid frontier entry: %w", err)
+	}
+	for i := len(frontier) - 2; i >= 0; i-- {
+		left, err := hex.DecodeString(frontier[i])
+		if err != nil {
+			return "", fmt.Errorf("invalid frontier entry: %w", err)
+		}
+		root = merkleNodeHash(left, root)
+	}
+	return hex.EncodeToString(root), nil
+}
+
+// BuildMerkleProof returns the inclusion proof for the event hash at index.
+func BuildMerkleProof(eventHashes []string, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(eventHashes) {
+		return nil, fmt.Errorf("leaf index %d out of range for tree of size %d", index, len(eventHashes))
+	}
+
+	leaves := merkleLeaves(eventHashes)
+	path := merkleAuditPath(index, leaves)
+
+	auditPath := make([]string, len(path))
+	for i, node := range path {
+		auditPath[i] = hex.EncodeToString(node)
+	}
+
+	return &MerkleProof{
+		LeafIndex: index,
+		TreeSize:  len(eventHashes),
+		LeafHash:  hex.EncodeToString(leaves[index]),
+		AuditPath: auditPath,
+		RootHash:  hex.EncodeToString(merkleTreeHash(leaves)),
+	}, nil
+}
+
+// VerifyMerkleProof checks offline that eventHash is included in the tree
+// described by proof. It needs nothing but the proof itself, so a buyer can
+// run it against a root they obtained independently.
+func VerifyMerkleProof(eventHash string, proof MerkleProof) error {
+	if proof.LeafIndex < 0 || proof.LeafIndex >= proof.TreeSize {
+		return errors.New("leaf index out of range")
+	}
+
+	root, err := hex.DecodeString(proof.RootHash)
+	if err != nil {
+		return fmt.Errorf("invalid root hash: %w", err)
+	}
+
+	leaf := MerkleLeafHash(eventHash)
+	if proof.LeafHash != "" && proof.LeafHash != hex.EncodeToString(leaf) {
+		return errors.New("leaf hash does not match event hash")
+	}
+
+	// RFC 9162 section 2.1.3.2
+	fn, sn := proof.LeafIndex, proof.TreeSize-1
+	r := leaf
+	for _, encoded := range proof.AuditPath {
+		p, err := hex.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid audit path entry: %w", err)
+		}
+		if sn == 0 {
+			return errors.New("audit path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("audit path is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("computed root does not match proof root")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleFrontierMatchesFullRoot(t *testing.T) {
+	var hashes, frontier []string
+	for size := 0; size <= 70; size++ {
+		root, err := MerkleFrontierRoot(frontier)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if want := ComputeMerkleRoot(hashes); root != want {
+			t.Fatalf("size %d: frontier root %s, want %s", size, root, want)
+		}
+		if got := MerkleFrontier(hashes); fmt.Sprint(got) != fmt.Sprint(frontier) {
+			t.Fatalf("size %d: rebuilt frontier %v, want %v", size, got, frontier)
+		}
+
+		sum := sha256.Sum256([]byte(fmt.Sprint(size)))
+		eventHash := hex.EncodeToString(sum[:])
+		frontier, err = AppendMerkleFrontier(frontier, size, eventHash)
+		if err != nil {
+			t.Fatalf("append to size %d: %v", size, err)
+		}
+		hashes = append(hashes, eventHash)
+	}
+}
+
+func TestAppendMerkleFrontierRejectsMismatchedSize(t *testing.T) {
+	frontier := MerkleFrontier([]string{"aa", "bb", "cc"})
+	if _, err := AppendMerkleFrontier(frontier, 4, "dd"); err == nil {
+		t.Error("appending to a frontier of 3 leaves as if it had 4: no error")
+	}
+	if _, err := AppendMerkleFrontier(nil, 2, "dd"); err == nil {
+		t.Error("appending to an empty frontier of a tree of 2 leaves: no error")
+	}
+}
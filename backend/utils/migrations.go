@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"backend/models"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MigrateEventSequences adds the events.sequence column and numbers existing
+// events, soft-deleted ones included, in their old created_at order. It has to run before AutoMigrate,
+// which would otherwise fail to build the unique (product_id, sequence)
+// index over rows that all have sequence 0.
+func MigrateEventSequences(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.Event{}) {
+		return nil
+	}
+	if !migrator.HasColumn(&models.Event{}, "Sequence") {
+		if err := migrator.AddColumn(&models.Event{}, "Sequence"); err != nil {
+			return fmt.Errorf("failed to add events.sequence: %w", err)
+		}
+	}
+
+	var productIDs []uint
+	if err := db.Unscoped().Model(&models.Event{}).Where("sequence = 0").Distinct().Pluck("product_id", &productIDs).Error; err != nil {
+		return err
+	}
+
+	for _, productID := range productIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var events []models.Event
+			if err := tx.Unscoped().Select("id").Where("product_id = ?", productID).
+				Order("created_at asc, id asc").Find(&events).Error; err != nil {
+				return err
+			}
+			for i, event := range events {
+				if err := tx.Unscoped().Model(&models.Event{}).Where("id = ?", event.ID).
+					Update("sequence", i+1).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to number events of product %d: %w", productID, err)
+		}
+	}
+	return nil
+}
+
+// MigrateTransferStates gives offers made before transfers had states an
+// explicit one: open offers become "initiated" with a fresh deadline, and
+// offers that were confirmed (and soft-deleted back then) become "accepted".
+func MigrateTransferStates(db *gorm.DB, offerTTL time.Duration) error {
+	now := time.Now()
+	if err := db.Model(&models.PendingTransfer{}).
+		Where("status IS NULL OR status = ''").
+		Updates(map[string]interface{}{"status": "initiated", "expires_at": now.Add(offerTTL)}).Error; err != nil {
+		return fmt.Errorf("failed to migrate open transfers: %w", err)
+	}
+
+	if err := db.Unscoped().Model(&models.PendingTransfer{}).
+		Where("deleted_at IS NOT NULL AND (status IS NULL OR status = '')").
+		Updates(map[string]interface{}{"status": "accepted", "resolved_at": gorm.Expr("deleted_at"), "deleted_at": nil}).Error; err != nil {
+		return fmt.Errorf("failed to migrate confirmed transfers: %w", err)
+	}
+	return nil
+}
+
+// MigrateProductOwners gives products registered before co-ownership existed
+// their owner rows and Product.CurrentOwnerID, from their event chains
+func MigrateProductOwners(db *gorm.DB) error {
+	var productIDs []uint
+	if err := db.Model(&models.Product{}).
+		Where("NOT EXISTS (SELECT 1 FROM product_owners WHERE product_owners.product_id = products.id)").
+		Pluck("id", &productIDs).Error; err != nil {
+		return err
+	}
+
+	for _, productID := range productIDs {
+		shares, err := ChainShares(db, productID)
+		if err != nil {
+			fmt.Printf("Warning: Cannot resolve owners of product %d: %v\n", productID, err)
+			continue
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return SetProductShares(tx, productID, shares)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set owners of product %d: %w", productID, err)
+		}
+	}
+	return nil
+}
+
+// MigrateOrganizations moves brands registered before organizations existed
+// into one. The old brand login becomes the organization's account, so the
+// products it owns now belong to the organization, and stays usable as an
+// owner of it.
+func MigrateOrganizations(db *gorm.DB) error {
+	var brands []models.User
+	if err := db.Where("role = ? AND organization_id IS NULL", "brand").Find(&brands).Error; err != nil {
+		return err
+	}
+
+	for _, brand := range brands {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			org := models.Organization{
+				CompanyName:        brand.CompanyName,
+				TaxID:              brand.TaxID,
+				ContactEmail:       brand.ContactEmail,
+				OfficialDomain:     brand.OfficialDomain,
+				VerificationStatus: brand.VerificationStatus,
+				AccountUserID:      brand.ID,
+			}
+			if err := tx.Create(&org).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&brand).Updates(map[string]interface{}{
+				"organization_id":   org.ID,
+				"organization_role": "owner",
+			}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&models.Product{}).
+				Where("organization_id = 0 AND id IN (?)", tx.Model(&models.Event{}).Select("product_id").
+					Where("event_type = ? AND created_by = ?", "registration", brand.ID)).
+				Update("organization_id", org.ID).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create organization for brand %d: %w", brand.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrOIDCDisabled is returned when no identity provider is configured
+var ErrOIDCDisabled = errors.New("OpenID Connect login is not configured")
+
+// OIDCConfig describes the corporate identity provider brand staff sign in
+// with. An empty Issuer disables OpenID Connect login.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// OIDCIdentity is what a verified ID token says about the user
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OIDCClient runs the authorization code flow against the provider. The
+// provider's discovery document is fetched on first use, so the server
+// starts even while the provider is unreachable.
+type OIDCClient struct {
+	config   OIDCConfig
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var oidcClient *OIDCClient
+
+// InitOIDC configures OpenID Connect login
+func InitOIDC(config OIDCConfig) error {
+	if config.Issuer == "" {
+		oidcClient = nil
+		return nil
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	oidcClient = &OIDCClient{config: config}
+	return nil
+}
+
+// CallbackIsHTTPS reports whether the provider sends users back over HTTPS,
+// so that cookies set for the callback can be marked Secure
+func (c *OIDCClient) CallbackIsHTTPS() bool {
+	return strings.HasPrefix(strings.ToLower(c.config.RedirectURL), "https://")
+}
+
+// OIDC returns the configured client
+func OIDC() (*OIDCClient, error) {
+	if oidcClient == nil {
+		return nil, ErrOIDCDisabled
+	}
+	return oidcClient, nil
+}
+
+func (c *OIDCClient) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.oauth != nil {
+		return c.oauth, c.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, c.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover identity provider: %w", err)
+	}
+	c.oauth = &oauth2.Config{
+		ClientID:     c.config.ClientID,
+		ClientSecret: c.config.ClientSecret,
+		RedirectURL:  c.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+	c.verifier = provider.Verifier(&oidc.Config{
+		ClientID:             c.config.ClientID,
+		SupportedSigningAlgs: []string{oidc.RS256, oidc.ES256, oidc.EdDSA},
+	})
+	return c.oauth, c.verifier, nil
+}
+
+// AuthCodeURL is where the user's browser is sent to sign in. The PKCE
+// challenge is derived from verifier, which stays on the server until the
+// code is exchanged.
+func (c *OIDCClient) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	config, _, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange trades the authorization code for an ID token and verifies it:
+// signature, issuer, audience, expiry and that it carries the nonce the
+// login started with
+func (c *OIDCClient) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCIdentity, error) {
+	config, idVerifier, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %w", err)
+	}
+	return &OIDCIdentity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.EmailVerified,
+	}, nil
+}
+
+// NewPKCEVerifier returns a random PKCE code verifier (RFC 7636)
+func NewPKCEVerifier() string {
+	return oauth2.GenerateVerifier()
+}
+
+// EmailInDomain reports whether an email address belongs to domain. It is
+// how a brand's contact email is checked against its official domain, and
+// how single sign-on users are matched to their organization.
+func EmailInDomain(email, domain string) bool {
+	at := strings.LastIndex(email, "@")
+	return at > 0 && domain != "" && strings.EqualFold(email[at+1:], domain)
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"backend/models"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OutboxKindRenderContract = "render_contract"
+	OutboxKindCreatePayment  = "create_payment"
+
+	OutboxStatusPending = "pending"
+	OutboxStatusRunning = "running"
+	OutboxStatusDone    = "done"
+	OutboxStatusDead    = "dead" // Gave up after MaxAttempts; needs a manual retry
+)
+
+const (
+	outboxMaxAttempts = 10
+	outboxBaseDelay   = 10 * time.Second
+	outboxMaxDelay    = time.Hour
+	// How long a worker may hold a job before another worker may take it over
+	outboxLease = 5 * time.Minute
+)
+
+// EnqueueContractRender schedules a contract's PDF rendering and IPFS upload.
+// Call it with the transaction that created the contract so the job exists
+// exactly when the contract does.
+func EnqueueContractRender(tx *gorm.DB, contractID uint) (*models.OutboxJob, error) {
+	job := &models.OutboxJob{
+		Kind:          OutboxKindRenderContract,
+		ContractID:    contractID,
+		Status:        OutboxStatusPending,
+		MaxAttempts:   outboxMaxAttempts,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to enqueue contract rendering: %w", err)
+	}
+	return job, nil
+}
+
+// EnqueuePaymentRequest schedules registering a priced offer with the
+// payment provider. Call it with the transaction that moves the offer to
+// awaiting payment, so the provider only hears of offers that were committed.
+func EnqueuePaymentRequest(tx *gorm.DB, transferID uint) (*models.OutboxJob, error) {
+	job := &models.OutboxJob{
+		Kind:          OutboxKindCreatePayment,
+		TransferID:    transferID,
+		Status:        OutboxStatusPending,
+		MaxAttempts:   outboxMaxAttempts,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to enqueue payment request: %w", err)
+	}
+	return job, nil
+}
+
+// RetryOutboxJob puts a dead or failed job back in the queue with a fresh
+// attempt budget
+func RetryOutboxJob(db *gorm.DB, job *models.OutboxJob) error {
+	job.Status = OutboxStatusPending
+	job.Attempts = 0
+	job.NextAttemptAt = time.Now()
+	job.LeaseExpiresAt = nil
+	return db.Save(job).Error
+}
+
+// outboxBackoff returns the delay before the next attempt: exponential in the
+// number of attempts so far, capped, with up to 20% jitter so that jobs that
+// failed together do not all retry together
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 20 {
+		if d := outboxBaseDelay << (attempts - 1); d < outboxMaxDelay {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func runOutboxJob(db *gorm.DB, job *models.OutboxJob) error {
+	switch job.Kind {
+	case OutboxKindRenderContract:
+		var contract models.OwnerContract
+		if err := db.First(&contract, job.ContractID).Error; err != nil {
+			return fmt.Errorf("contract not found: %w", err)
+		}
+		return RenderAndPinContract(db, &contract)
+	case OutboxKindCreatePayment:
+		return createTransferPayment(db, job.TransferID)
+	default:
+		return fmt.Errorf("unknown outbox job kind %q", job.Kind)
+	}
+}
+
+// claimOutboxJob marks a job as running for this worker. It returns false if
+// another worker got there first.
+func claimOutboxJob(db *gorm.DB, job *models.OutboxJob) bool {
+	now := time.Now()
+	// The lease identifies this claim when the job is finished, so keep it
+	// at a precision the database stores exactly
+	lease := now.Add(outboxLease).Truncate(time.Millisecond)
+
+	result := db.Model(&models.OutboxJob{}).
+		Where("id = ? AND ((status = ? AND next_attempt_at <= ?) OR (status = ? AND lease_expires_at <= ?))",
+			job.ID, OutboxStatusPending, now, OutboxStatusRunning, now).
+		Updates(map[string]interface{}{
+			"status":           OutboxStatusRunning,
+			"lease_expires_at": lease,
+			"attempts":         gorm.Expr("attempts + 1"),
+		})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+
+	job.Status = OutboxStatusRunning
+	job.LeaseExpiresAt = &lease
+	job.Attempts++
+	return true
+}
+
+func handleOutboxJob(db *gorm.DB, job *models.OutboxJob) {
+	if !claimOutboxJob(db, job) {
+		return
+	}
+	finishOutboxJob(db, job, runOutboxJob(db, job))
+}
+
+// finishOutboxJob records the outcome of a run. If the lease ran out during
+// the run and another worker took the job over, the outcome is dropped so
+// it cannot overwrite theirs.
+func finishOutboxJob(db *gorm.DB, job *models.OutboxJob, err error) {
+	updates := map[string]interface{}{"lease_expires_at": nil}
+	if err == nil {
+		updates["status"] = OutboxStatusDone
+		updates["last_error"] = ""
+		updates["completed_at"] = time.Now()
+	} else {
+		updates["last_error"] = err.Error()
+		if job.MaxAttempts > 0 && job.Attempts >= job.MaxAttempts {
+			updates["status"] = OutboxStatusDead
+		} else {
+			updates["status"] = OutboxStatusPending
+			updates["next_attempt_at"] = time.Now().Add(outboxBackoff(job.Attempts))
+		}
+	}
+
+	result := db.Model(&models.OutboxJob{}).
+		Where("id = ? AND status = ? AND lease_expires_at = ?", job.ID, OutboxStatusRunning, job.LeaseExpiresAt).
+		Updates(updates)
+	switch {
+	case result.Error != nil:
+		fmt.Printf("Warning: Failed to update outbox job %d: %v\n", job.ID, result.Error)
+		return
+	case result.RowsAffected == 0:
+		fmt.Printf("Warning: Outbox job %d (%s) lost its lease while running, dropping the result\n", job.ID, job.Kind)
+		return
+	}
+
+	switch updates["status"] {
+	case OutboxStatusDead:
+		fmt.Printf("Error: Outbox job %d (%s) failed %d times, moved to dead letter: %v\n", job.ID, job.Kind, job.Attempts, err)
+	case OutboxStatusPending:
+		fmt.Printf("Warning: Outbox job %d (%s) failed, retrying at %s: %v\n", job.ID, job.Kind, updates["next_attempt_at"].(time.Time).Format(time.RFC3339), err)
+	}
+}
+
+// dueOutboxJobs returns pending jobs whose next attempt is due, and running
+// jobs whose worker went away without finishing them
+func dueOutboxJobs(db *gorm.DB, limit int) ([]models.OutboxJob, error) {
+	now := time.Now()
+	var jobs []models.OutboxJob
+	err := db.Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND lease_expires_at <= ?)",
+		OutboxStatusPending, now, OutboxStatusRunning, now).
+		Order("next_attempt_at asc").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// StartOutboxWorkers runs a pool of workers fed by a single poller
+func StartOutboxWorkers(db *gorm.DB, workers int, pollInterval time.Duration) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan models.OutboxJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range queue {
+				handleOutboxJob(db, &job)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			jobs, err := dueOutboxJobs(db, workers*10)
+			if err != nil {
+				fmt.Printf("Warning: Failed to read outbox: %v\n", err)
+			}
+			for _, job := range jobs {
+				queue <- job
+			}
+			<-ticker.C
+		}
+	}()
+}
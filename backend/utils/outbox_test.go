@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"backend/models"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestOutboxResultDroppedAfterTakeover(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.OutboxJob{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	job, err := EnqueueContractRender(db, 1)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	// The first worker's lease runs out mid-run and a second worker takes
+	// the job over
+	first := *job
+	if !claimOutboxJob(db, &first) {
+		t.Fatal("first claim failed")
+	}
+	if err := db.Model(&models.OutboxJob{}).Where("id = ?", job.ID).
+		Update("lease_expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatalf("expire lease: %v", err)
+	}
+	second := *job
+	if !claimOutboxJob(db, &second) {
+		t.Fatal("takeover failed")
+	}
+
+	finishOutboxJob(db, &first, nil)
+	var stored models.OutboxJob
+	if err := db.First(&stored, job.ID).Error; err != nil {
+		t.Fatalf("load job: %v", err)
+	}
+	if stored.Status != OutboxStatusRunning || stored.Attempts != 2 {
+		t.Fatalf("after the late finish: status %s, attempts %d; want running, 2", stored.Status, stored.Attempts)
+	}
+
+	finishOutboxJob(db, &second, errors.New("render failed"))
+	stored = models.OutboxJob{}
+	if err := db.First(&stored, job.ID).Error; err != nil {
+		t.Fatalf("load job: %v", err)
+	}
+	if stored.Status != OutboxStatusPending || stored.LastError != "render failed" || stored.LeaseExpiresAt != nil {
+		t.Errorf("after the current finish: status %s, last error %q, lease %v; want pending, render failed, none",
+			stored.Status, stored.LastError, stored.LeaseExpiresAt)
+	}
+}
@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"backend/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// FullShare is a whole product, in basis points
+const FullShare = 10000
+
+// Consent rules for transferring a share of a co-owned product
+const (
+	ConsentAll      = "all"      // every other co-owner must approve
+	ConsentMajority = "majority" // owners of more than half the product must approve
+)
+
+var sharePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+// ParseShare parses a percentage such as "33.33" into basis points
+func ParseShare(percent string) (int, error) {
+	percent = strings.TrimSpace(percent)
+	if !sharePattern.MatchString(percent) {
+		return 0, errors.New("share must be a percentage with at most two decimal places")
+	}
+	whole, fraction, _ := strings.Cut(percent, ".")
+	share, err := strconv.Atoi(whole + (fraction + "00")[:2])
+	if err != nil || share <= 0 || share > FullShare {
+		return 0, errors.New("share must be greater than 0 and at most 100")
+	}
+	return share, nil
+}
+
+// FormatShare renders basis points as a percentage, e.g. "33.33"
+func FormatShare(share int) string {
+	return fmt.Sprintf("%d.%02d", share/100, share%100)
+}
+
+// PrimaryOwner returns the holder of the largest share, the lowest user ID
+// winning a tie. It is what Product.CurrentOwnerID holds.
+func PrimaryOwner(shares map[uint]int) uint {
+	var primary uint
+	for userID, share := range shares {
+		if primary == 0 || share > shares[primary] || (share == shares[primary] && userID < primary) {
+			primary = userID
+		}
+	}
+	return primary
+}
+
+// SharesFromChain replays a product's history (in sequence order) and returns
+// the shares it ends with. Registration gives the owner it names (or, for
+// events that predate organizations, the registering user) the whole product; an
+// ownership transfer moves share_bp from from_owner_id to new_owner_id, or the
+// whole product when the event predates co-ownership.
+func SharesFromChain(events []models.Event) (map[uint]int, error) {
+	var shares map[uint]int
+	for _, event := range events {
+		switch event.EventType {
+		case "registration":
+			var data struct {
+				OwnerID uint `json:"owner_id"`
+			}
+			json.Unmarshal([]byte(event.EventData), &data)
+			if data.OwnerID == 0 {
+				data.OwnerID = event.CreatedBy
+			}
+			shares = map[uint]int{data.OwnerID: FullShare}
+		case "ownership_transfer":
+			var data struct {
+				NewOwnerID  *uint `json:"new_owner_id"`
+				FromOwnerID uint  `json:"from_owner_id"`
+				ShareBP     int   `json:"share_bp"`
+			}
+			if err := json.Unmarshal([]byte(event.EventData), &data); err != nil || data.NewOwnerID == nil {
+				return nil, fmt.Errorf("event %d has no new_owner_id", event.ID)
+			}
+			if data.ShareBP == 0 {
+				shares = map[uint]int{*data.NewOwnerID: FullShare}
+				continue
+			}
+			if shares[data.FromOwnerID] < data.ShareBP {
+				return nil, fmt.Errorf("event %d moves more than owner %d holds", event.ID, data.FromOwnerID)
+			}
+			shares[data.FromOwnerID] -= data.ShareBP
+			if shares[data.FromOwnerID] == 0 {
+				delete(shares, data.FromOwnerID)
+			}
+			shares[*data.NewOwnerID] += data.ShareBP
+		}
+	}
+	if shares == nil {
+		return nil, errors.New("product has no registration event")
+	}
+	return shares, nil
+}
+
+// OwnerFromChain returns the primary owner a product's history ends with. It
+// is the reference that Product.CurrentOwnerID is checked against.
+func OwnerFromChain(events []models.Event) (uint, error) {
+	shares, err := SharesFromChain(events)
+	if err != nil {
+		return 0, err
+	}
+	return PrimaryOwner(shares), nil
+}
+
+// ChainShares loads a product's history and returns the shares it ends with
+func ChainShares(db *gorm.DB, productID uint) (map[uint]int, error) {
+	var events []models.Event
+	if err := db.Where("product_id = ?", productID).Order("sequence asc").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return SharesFromChain(events)
+}
+
+// DisplayName is how a user is named on certificates: an organization's
+// account by the organization's company name, anyone else by username
+func DisplayName(db *gorm.DB, userID uint) (string, error) {
+	var user models.User
+	if err := db.Select("id", "username", "organization_id").First(&user, userID).Error; err != nil {
+		return "", err
+	}
+	if user.OrganizationID != nil {
+		var org models.Organization
+		if err := db.Select("id", "company_name", "account_user_id").First(&org, *user.OrganizationID).Error; err == nil && org.AccountUserID == user.ID {
+			return org.CompanyName, nil
+		}
+	}
+	return user.Username, nil
+}
+
+// ProductShares returns the stored shares of a product by user ID
+func ProductShares(db *gorm.DB, productID uint) (map[uint]int, error) {
+	var owners []models.ProductOwner
+	if err := db.Where("product_id = ?", productID).Find(&owners).Error; err != nil {
+		return nil, err
+	}
+	shares := make(map[uint]int, len(owners))
+	for _, owner := range owners {
+		shares[owner.UserID] = owner.Share
+	}
+	return shares, nil
+}
+
+// SetProductShares replaces a product's owners and points CurrentOwnerID at
+// the primary one. Only registration and the transfer flow call it, inside
+// the transaction that logs the change.
+func SetProductShares(tx *gorm.DB, productID uint, shares map[uint]int) error {
+	total := 0
+	for _, share := range shares {
+		if share <= 0 {
+			return errors.New("shares must be positive")
+		}
+		total += share
+	}
+	if total != FullShare {
+		return fmt.Errorf("shares add up to %s%%, not 100%%", FormatShare(total))
+	}
+
+	if err := tx.Unscoped().Where("product_id = ?", productID).Delete(&models.ProductOwner{}).Error; err != nil {
+		return err
+	}
+	for userID, share := range shares {
+		if err := tx.Create(&models.ProductOwner{ProductID: productID, UserID: userID, Share: share}).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&models.Product{}).Where("id = ?", productID).Update("current_owner_id", PrimaryOwner(shares)).Error
+}
+
+// OwnershipMismatch describes a product whose stored owners disagree with its chain
+type OwnershipMismatch struct {
+	ProductID    uint
+	StoredOwner  uint
+	ChainOwner   uint
+	StoredShares map[uint]int
+	ChainShares  map[uint]int
+	Err          error // Set when the chain itself could not be resolved
+}
+
+func sameShares(a, b map[uint]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for userID, share := range a {
+		if b[userID] != share {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckOwnership compares every product's stored owner and shares with those
+// derived from its chain. With fix set, the stored ones are overwritten with
+// the chain's.
+func CheckOwnership(db *gorm.DB, fix bool) ([]OwnershipMismatch, error) {
+	var products []models.Product
+	if err := db.Select("id", "current_owner_id").Order("id asc").Find(&products).Error; err != nil {
+		return nil, err
+	}
+
+	var mismatches []OwnershipMismatch
+	for _, product := range products {
+		stored, err := ProductShares(db, product.ID)
+		if err != nil {
+			return mismatches, err
+		}
+
+		chain, err := ChainShares(db, product.ID)
+		if err != nil {
+			mismatches = append(mismatches, OwnershipMismatch{ProductID: product.ID, StoredOwner: product.CurrentOwnerID, StoredShares: stored, Err: err})
+			continue
+		}
+		owner := PrimaryOwner(chain)
+		if owner == product.CurrentOwnerID && sameShares(stored, chain) {
+			continue
+		}
+
+		mismatches = append(mismatches, OwnershipMismatch{
+			ProductID:    product.ID,
+			StoredOwner:  product.CurrentOwnerID,
+			ChainOwner:   owner,
+			StoredShares: stored,
+			ChainShares:  chain,
+		})
+		if fix {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return SetProductShares(tx, product.ID, chain)
+			})
+			if err != nil {
+				return mismatches, fmt.Errorf("failed to fix owners of product %d: %w", product.ID, err)
+			}
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcrypt only looks at the first 72 bytes of a password
+const maxPasswordBytes = 72
+
+// PasswordPolicy is what a new password has to satisfy
+type PasswordPolicy struct {
+	MinLength int // In characters
+	// How many of lowercase letters, uppercase letters, digits and other
+	// characters it must mix; 0 for any
+	MinCharacterClasses int
+	// Optional file of breached passwords, checked besides the built-in list
+	BreachedListFile string
+}
+
+//go:embed passwords/common.txt
+var commonPasswords string
+
+var (
+	passwordPolicy = PasswordPolicy{MinLength: 10}
+	// SHA-1 hashes, upper-case hex, of passwords known from breaches
+	breachedPasswords = map[string]struct{}{}
+)
+
+// InitPasswordPolicy sets the policy passwords are checked against and loads
+// the breached password lists
+func InitPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength < 1 || policy.MinLength > maxPasswordBytes {
+		return fmt.Errorf("password minimum length must be between 1 and %d", maxPasswordBytes)
+	}
+	if policy.MinCharacterClasses < 0 || policy.MinCharacterClasses > 4 {
+		return errors.New("password character classes must be between 0 and 4")
+	}
+
+	breached := map[string]struct{}{}
+	if err := loadBreachedPasswords(strings.NewReader(commonPasswords), breached); err != nil {
+		return err
+	}
+	if policy.BreachedListFile != "" {
+		file, err := os.Open(policy.BreachedListFile)
+		if err != nil {
+			return fmt.Errorf("failed to open breached password list: %w", err)
+		}
+		defer file.Close()
+		if err := loadBreachedPasswords(file, breached); err != nil {
+			return fmt.Errorf("failed to read breached password list: %w", err)
+		}
+	}
+
+	passwordPolicy = policy
+	breachedPasswords = breached
+	return nil
+}
+
+// loadBreachedPasswords adds each line of r to set. A line is a password or,
+// as in the Pwned Passwords download, its SHA-1 hash with an optional
+// ":count".
+func loadBreachedPasswords(r io.Reader, set map[string]struct{}) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			set[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		set[passwordSHA1(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// IsBreachedPassword reports whether a password is on a breached list
+func IsBreachedPassword(password string) bool {
+	_, ok := breachedPasswords[passwordSHA1(password)]
+	return ok
+}
+
+// CheckPassword returns why a password may not be used by username, or nil.
+// The error is meant for the user.
+func CheckPassword(password, username string) error {
+	policy := passwordPolicy
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if policy.MinCharacterClasses > 0 && characterClasses(password) < policy.MinCharacterClasses {
+		return fmt.Errorf("password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinCharacterClasses)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	if IsBreachedPassword(password) {
+		return errors.New("password appears in a list of breached passwords, choose another")
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
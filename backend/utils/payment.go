@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"backend/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Money is an amount in minor currency units (cents). Every supported
+// currency is assumed to have two decimal places.
+type Money struct {
+	AmountMinor int64
+	Currency    string
+}
+
+var (
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	amountPattern   = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+)
+
+// ParseMoney parses a decimal amount such as "1299.99" and an ISO 4217
+// currency code. Amounts are taken as strings so no precision is lost to
+// floating point.
+func ParseMoney(amount, currency string) (Money, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if !currencyPattern.MatchString(currency) {
+		return Money{}, errors.New("currency must be a three-letter ISO 4217 code")
+	}
+	amount = strings.TrimSpace(amount)
+	if !amountPattern.MatchString(amount) {
+		return Money{}, errors.New("price must be a decimal amount with at most two decimal places")
+	}
+
+	whole, fraction, _ := strings.Cut(amount, ".")
+	fraction = (fraction + "00")[:2]
+	units, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, errors.New("price is too large")
+	}
+	if units <= 0 {
+		return Money{}, errors.New("price must be greater than zero")
+	}
+	return Money{AmountMinor: units, Currency: currency}, nil
+}
+
+// Decimal formats the amount without its currency, e.g. "1299.99"
+func (m Money) Decimal() string {
+	return fmt.Sprintf("%d.%02d", m.AmountMinor/100, m.AmountMinor%100)
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// Payment notification outcomes
+const (
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+)
+
+// PaymentRequest asks a provider to collect payment for a transfer offer
+type PaymentRequest struct {
+	TransferID uint
+	Price      Money
+}
+
+// PaymentNotification is a verified callback from a payment provider
+type PaymentNotification struct {
+	Reference string
+	Price     Money
+	Status    string // PaymentSucceeded or PaymentFailed
+}
+
+// PaymentProvider collects payment for escrow transfers off-platform and
+// reports the outcome through a signed webhook.
+type PaymentProvider interface {
+	Name() string
+	// CreatePayment registers the amount due and returns the provider's
+	// reference for it
+	CreatePayment(req PaymentRequest) (string, error)
+	// ParseWebhook authenticates a callback and decodes it. It must reject
+	// anything not signed by the provider.
+	ParseWebhook(header http.Header, body []byte) (*PaymentNotification, error)
+	// Refund returns a captured payment to the payer and returns the
+	// provider's reference for the refund
+	Refund(reference string, amount Money) (string, error)
+}
+
+var (
+	paymentProviders = map[string]func() (PaymentProvider, error){
+		"fake": newFakePaymentProvider,
+	}
+	paymentProvider PaymentProvider
+)
+
+// RegisterPaymentProvider makes a provider available to InitPaymentProvider
+func RegisterPaymentProvider(name string, factory func() (PaymentProvider, error)) {
+	paymentProviders[name] = factory
+}
+
+// InitPaymentProvider selects the payment provider by name. An empty name
+// leaves payments disabled; the fake provider moves no money, so it has to
+// be asked for.
+func InitPaymentProvider(name string) error {
+	paymentProvider = nil
+	if name == "" {
+		return nil
+	}
+	factory, ok := paymentProviders[name]
+	if !ok {
+		return fmt.Errorf("unknown payment provider %q", name)
+	}
+	provider, err := factory()
+	if err != nil {
+		return fmt.Errorf("failed to initialize payment provider %q: %w", name, err)
+	}
+	paymentProvider = provider
+	return nil
+}
+
+// ErrPaymentsDisabled is returned by Payments when no provider is configured
+var ErrPaymentsDisabled = errors.New("payments are not enabled")
+
+// Payments returns the configured payment provider
+func Payments() (PaymentProvider, error) {
+	if paymentProvider == nil {
+		return nil, ErrPaymentsDisabled
+	}
+	return paymentProvider, nil
+}
+
+// createTransferPayment registers a priced offer with the payment provider.
+// It runs from the outbox once the offer awaits payment, so an offer that
+// was rolled back never reaches the provider and a slow provider holds no
+// locks. A retry after a crash may register the offer again; providers
+// should deduplicate on the transfer ID.
+func createTransferPayment(db *gorm.DB, transferID uint) error {
+	provider, err := Payments()
+	if err != nil {
+		return err
+	}
+
+	var transfer models.PendingTransfer
+	if err := db.First(&transfer, transferID).Error; err != nil {
+		return fmt.Errorf("transfer not found: %w", err)
+	}
+	// Already registered, or closed before its turn came
+	if transfer.PaymentReference != "" || transfer.ResolvedAt != nil {
+		return nil
+	}
+
+	reference, err := provider.CreatePayment(PaymentRequest{
+		TransferID: transfer.ID,
+		Price:      Money{AmountMinor: transfer.PriceMinor, Currency: transfer.Currency},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create payment: %w", err)
+	}
+
+	// Stored even if the offer closed meanwhile, so that a payment made
+	// against it is still found and refunded
+	return db.Model(&models.PendingTransfer{}).
+		Where("id = ? AND payment_reference = ''", transfer.ID).
+		Updates(map[string]interface{}{"payment_provider": provider.Name(), "payment_reference": reference}).Error
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"backend/models"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestCreateTransferPayment(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.PendingTransfer{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "test secret")
+	if err := InitPaymentProvider("fake"); err != nil {
+		t.Fatalf("init payments: %v", err)
+	}
+	t.Cleanup(func() { InitPaymentProvider("") })
+
+	now := time.Now()
+	open := models.PendingTransfer{Status: "awaiting_payment", PriceMinor: 10000, Currency: "EUR", PaymentProvider: "fake"}
+	closed := models.PendingTransfer{Status: "cancelled", PriceMinor: 10000, Currency: "EUR", PaymentProvider: "fake", ResolvedAt: &now}
+	for _, transfer := range []*models.PendingTransfer{&open, &closed} {
+		if err := db.Create(transfer).Error; err != nil {
+			t.Fatalf("create transfer: %v", err)
+		}
+	}
+
+	for _, transfer := range []*models.PendingTransfer{&open, &closed} {
+		if err := createTransferPayment(db, transfer.ID); err != nil {
+			t.Fatalf("create payment for %s offer: %v", transfer.Status, err)
+		}
+	}
+
+	var stored models.PendingTransfer
+	if err := db.First(&stored, open.ID).Error; err != nil {
+		t.Fatalf("load transfer: %v", err)
+	}
+	reference := stored.PaymentReference
+	if !strings.HasPrefix(reference, "fake_") {
+		t.Fatalf("open offer reference = %q, want one from the fake provider", reference)
+	}
+
+	// A retried job keeps the first registration
+	if err := createTransferPayment(db, open.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	stored = models.PendingTransfer{}
+	if err := db.First(&stored, open.ID).Error; err != nil || stored.PaymentReference != reference {
+		t.Errorf("reference after retry = %q, want %q (%v)", stored.PaymentReference, reference, err)
+	}
+
+	stored = models.PendingTransfer{}
+	if err := db.First(&stored, closed.ID).Error; err != nil || stored.PaymentReference != "" {
+		t.Errorf("closed offer reference = %q, want none (%v)", stored.PaymentReference, err)
+	}
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"backend/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NewTokenID returns a random identifier for a token or session
+func NewTokenID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// HashRefreshToken is how a refresh token is looked up without storing it
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeAccessToken adds an access token to the revocation list until it
+// would have expired anyway
+func RevokeAccessToken(tx *gorm.DB, jti string, expiresAt time.Time) error {
+	if jti == "" || !expiresAt.After(time.Now()) {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+// IsTokenRevoked reports whether an access token is on the revocation list
+func IsTokenRevoked(db *gorm.DB, jti string) (bool, error) {
+	var revoked models.RevokedToken
+	err := db.Select("id").Where("jti = ?", jti).First(&revoked).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RevokeSessions ends sessions: their refresh tokens stop working and the
+// access tokens issued with them are revoked. query selects the refresh
+// tokens, e.g. by session or by user.
+func RevokeSessions(tx *gorm.DB, query string, args ...interface{}) error {
+	var tokens []models.RefreshToken
+	if err := tx.Where(query, args...).Where("access_expires_at > ?", time.Now()).Find(&tokens).Error; err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := RevokeAccessToken(tx, token.AccessJTI, token.AccessExpiresAt); err != nil {
+			return err
+		}
+	}
+	return tx.Model(&models.RefreshToken{}).Where(query, args...).Where("revoked_at IS NULL").
+		Update("revoked_at", time.Now()).Error
+}
+
+// pruneTokens drops revocation entries and refresh tokens that have expired
+func pruneTokens(db *gorm.DB) error {
+	now := time.Now()
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&models.RevokedToken{}).Error; err != nil {
+		return err
+	}
+	return db.Unscoped().Where("expires_at < ?", now).Delete(&models.RefreshToken{}).Error
+}
+
+// StartTokenPruning periodically clears expired tokens out of the
+// revocation list and the refresh token table, and stale failed login counts
+// out of the login throttle
+func StartTokenPruning(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := pruneTokens(db); err != nil {
+				fmt.Printf("Warning: Failed to prune expired tokens: %v\n", err)
+			}
+			if err := pruneLoginThrottles(db); err != nil {
+				fmt.Printf("Warning: Failed to prune failed logins: %v\n", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). They are the defaults every authenticator app
+// supports, so they are not configurable.
+const (
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+	totpSkew   = 1 // steps accepted either side of now, for clock drift
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpKey encrypts TOTP secrets in the database. It is kept on disk like the
+// signing keys, so a copy of the database alone does not reveal them.
+var totpKey []byte
+
+// InitTOTPKey loads the key that encrypts TOTP secrets from path, creating
+// it on first start
+func InitTOTPKey(path string) error {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create TOTP key directory: %w", err)
+		}
+		if err := os.WriteFile(path, key, 0600); err != nil {
+			return fmt.Errorf("failed to write TOTP key: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read TOTP key: %w", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("TOTP key %s must be 32 bytes", path)
+	}
+	totpKey = key
+	return nil
+}
+
+func totpCipher() (cipher.AEAD, error) {
+	if totpKey == nil {
+		return nil, errors.New("TOTP key not initialized")
+	}
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealTOTPSecret encrypts a secret for storage
+func SealTOTPSecret(secret string) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// OpenTOTPSecret decrypts a secret sealed by SealTOTPSecret
+func OpenTOTPSecret(sealed string) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed TOTP secret")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("TOTP secret cannot be decrypted with the configured key")
+	}
+	return string(secret), nil
+}
+
+// NewTOTPSecret returns a random base32 secret for an authenticator app
+func NewTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// TOTPProvisioningURI is the otpauth:// URI an authenticator app scans to
+// add the account
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the code for one time step
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
+
+// ValidateTOTP checks a code against secret at now, allowing one step of
+// clock drift. Codes of steps up to lastStep were already used and are
+// refused, so an observed code cannot be replayed. It returns the step the
+// code matched.
+func ValidateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(TOTPPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n single-use codes that stand in for a TOTP code
+// when the authenticator is lost, formatted as xxxxx-xxxxx
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode is how a recovery code is stored and looked up. Case,
+// spaces and dashes are ignored so the code can be typed loosely.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
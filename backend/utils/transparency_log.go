@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"backend/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var checkpointMu sync.Mutex
+
+// ProductHeadLeaf binds a product ID to its chain head so that a head hash
+// cannot be replayed under a different product.
+func ProductHeadLeaf(productID uint, headEventHash string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", productID, headEventHash)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckpointBody is the exact byte string that is hashed and signed
+func CheckpointBody(cp *models.Checkpoint) []byte {
+	return []byte(fmt.Sprintf("veriown-checkpoint/v1\n%d\n%d\n%s\n%s\n%d\n",
+		cp.Sequence, cp.TreeSize, cp.RootHash, cp.PreviousCheckpointHash, cp.IssuedAt.Unix()))
+}
+
+// VerifyCheckpointSignature checks a checkpoint's hash and its signature
+// against the key that was active when it was issued
+func VerifyCheckpointSignature(cp *models.Checkpoint) error {
+	body := CheckpointBody(cp)
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != cp.CheckpointHash {
+		return errors.New("checkpoint hash does not match its contents")
+	}
+	return VerifySignature(cp.KeyID, cp.IssuedAt, body, cp.Signature)
+}
+
+type productHead struct {
+	ProductID uint
+	EventHash string
+}
+
+// latestProductHeads returns the newest event hash of every product, ordered
+// by product ID. Only each product's last event is read.
+func latestProductHeads(db *gorm.DB) ([]productHead, error) {
+	last := db.Model(&models.Event{}).Select("product_id, MAX(sequence) AS sequence").Group("product_id")
+
+	heads := make([]productHead, 0)
+	if err := db.Model(&models.Event{}).Select("events.product_id, events.event_hash").
+		Joins("JOIN (?) AS heads ON heads.product_id = events.product_id AND heads.sequence = events.sequence", last).
+		Order("events.product_id asc").Scan(&heads).Error; err != nil {
+		return nil, err
+	}
+	return heads, nil
+}
+
+// CreateCheckpoint rolls the current head of every product chain into a new
+// signed checkpoint. It returns nil without error when nothing has changed
+// since the previous checkpoint.
+func CreateCheckpoint(db *gorm.DB) (*models.Checkpoint, error) {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+
+	heads, err := latestProductHeads(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product heads: %w", err)
+	}
+
+	leaves := make([]string, len(heads))
+	for i, head := range heads {
+		leaves[i] = ProductHeadLeaf(head.ProductID, head.EventHash)
+	}
+	root := ComputeMerkleRoot(leaves)
+
+	var previous models.Checkpoint
+	err = db.Order("sequence desc").First(&previous).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if previous.ID != 0 && previous.RootHash == root && previous.TreeSize == len(leaves) {
+		return nil, nil
+	}
+
+	cp := &models.Checkpoint{
+		Sequence:               previous.Sequence + 1,
+		TreeSize:               len(leaves),
+		RootHash:               root,
+		PreviousCheckpointHash: previous.CheckpointHash,
+		IssuedAt:               time.Now().UTC().Truncate(time.Second),
+	}
+	body := CheckpointBody(cp)
+	sum := sha256.Sum256(body)
+	cp.CheckpointHash = hex.EncodeToString(sum[:])
+	cp.KeyID, cp.Signature, err = SignAt(cp.IssuedAt, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign checkpoint: %w", err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(cp).Error; err != nil {
+			return err
+		}
+		entries := make([]models.CheckpointEntry, len(heads))
+		for i, head := range heads {
+			entries[i] = models.CheckpointEntry{
+				CheckpointID:  cp.ID,
+				LeafIndex:     i,
+				ProductID:     head.ProductID,
+				HeadEventHash: head.EventHash,
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(entries, 500).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	return cp, nil
+}
+
+// BuildCheckpointProof returns the inclusion proof for a product's head in a checkpoint
+func BuildCheckpointProof(db *gorm.DB, cp *models.Checkpoint, productID uint) (*models.CheckpointEntry, *MerkleProof, error) {
+	var entries []models.CheckpointEntry
+	if err := db.Where("checkpoint_id = ?", cp.ID).Order("leaf_index asc").Find(&entries).Error; err != nil {
+		return nil, nil, err
+	}
+
+	leaves := make([]string, len(entries))
+	var entry *models.CheckpointEntry
+	for i := range entries {
+		leaves[i] = ProductHeadLeaf(entries[i].ProductID, entries[i].HeadEventHash)
+		if entries[i].ProductID == productID {
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		return nil, nil, gorm.ErrRecordNotFound
+	}
+
+	proof, err := BuildMerkleProof(leaves, entry.LeafIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proof.RootHash != cp.RootHash {
+		return nil, nil, errors.New("checkpoint entries do not match the signed root")
+	}
+	return entry, proof, nil
+}
+
+// StartCheckpointScheduler issues a checkpoint every interval in the background
+func StartCheckpointScheduler(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := CreateCheckpoint(db); err != nil {
+				fmt.Printf("Warning: Failed to create log checkpoint: %v\n", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"backend/models"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestLatestProductHeads(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.Event{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	// Products 2 and 1 have chains of different lengths, inserted out of
+	// order; product 3's newest event was deleted
+	for _, event := range []models.Event{
+		{ProductID: 2, Sequence: 1}, {ProductID: 1, Sequence: 1}, {ProductID: 2, Sequence: 3},
+		{ProductID: 2, Sequence: 2}, {ProductID: 1, Sequence: 2}, {ProductID: 3, Sequence: 1},
+		{ProductID: 3, Sequence: 2},
+	} {
+		event.EventHash = fmt.Sprintf("p%d-s%d", event.ProductID, event.Sequence)
+		if err := db.Create(&event).Error; err != nil {
+			t.Fatalf("create event: %v", err)
+		}
+	}
+	if err := db.Where("product_id = ? AND sequence = ?", 3, 2).Delete(&models.Event{}).Error; err != nil {
+		t.Fatalf("delete event: %v", err)
+	}
+
+	heads, err := latestProductHeads(db)
+	if err != nil {
+		t.Fatalf("latestProductHeads: %v", err)
+	}
+	want := []productHead{{1, "p1-s2"}, {2, "p2-s3"}, {3, "p3-s1"}}
+	if fmt.Sprint(heads) != fmt.Sprint(want) {
+		t.Errorf("heads = %v, want %v", heads, want)
+	}
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"backend/models"
+	_ "embed"
+	"errors"
+	"time"
+)
+
+// Per-event verification outcomes
+const (
+	EventStatusOK                 = "ok"
+	EventStatusHashMismatch       = "hash_mismatch"
+	EventStatusLinkMismatch       = "link_mismatch"
+	EventStatusMissingPredecessor = "missing_predecessor"
+	EventStatusSignatureInvalid   = "signature_invalid"
+	// Not a failure: the event predates signing and is checked on its
+	// hash alone
+	EventStatusUnsignedLegacy = "unsigned_legacy"
+)
+
+// ErrUnsignedLegacy is returned for an unsigned event from before the
+// server signed events
+var ErrUnsignedLegacy = errors.New("event predates event signing")
+
+// ChainReportSchemaVersion is bumped whenever the report format changes
+const ChainReportSchemaVersion = "1.1"
+
+// ChainReportSchemaURL is where the JSON schema for the report is served
+const ChainReportSchemaURL = "/api/schemas/chain-verification-report.json"
+
+//go:embed schemas/chain_verification_report.schema.json
+var ChainReportSchema []byte
+
+// EventVerification is the outcome of checking a single event. Status is the
+// first failed check; Issues lists every check that failed.
+type EventVerification struct {
+	Index                int       `json:"index"`
+	EventID              uint      `json:"event_id"`
+	EventType            string    `json:"event_type"`
+	CreatedAt            time.Time `json:"created_at"`
+	HashVersion          int       `json:"hash_version"`
+	Status               string    `json:"status"`
+	Issues               []string  `json:"issues"`
+	Details              []string  `json:"details,omitempty"`
+	StoredHash           string    `json:"stored_hash"`
+	ComputedHash         string    `json:"computed_hash"`
+	PreviousEventHash    string    `json:"previous_event_hash"`
+	ExpectedPreviousHash string    `json:"expected_previous_hash"`
+	SigningKeyID         string    `json:"signing_key_id,omitempty"`
+	ActorSigned          bool      `json:"actor_signed"`
+}
+
+// ChainReportTotals counts events by status
+type ChainReportTotals struct {
+	Events             int `json:"events"`
+	OK                 int `json:"ok"`
+	HashMismatch       int `json:"hash_mismatch"`
+	LinkMismatch       int `json:"link_mismatch"`
+	MissingPredecessor int `json:"missing_predecessor"`
+	SignatureInvalid   int `json:"signature_invalid"`
+	UnsignedLegacy     int `json:"unsigned_legacy"`
+}
+
+// ChainVerificationReport is the archivable result of verifying a product's history
+type ChainVerificationReport struct {
+	Schema               string              `json:"$schema"`
+	SchemaVersion        string              `json:"schema_version"`
+	ProductID            uint                `json:"product_id"`
+	GeneratedAt          time.Time           `json:"generated_at"`
+	Valid                bool                `json:"valid"`
+	FirstDivergenceIndex *int                `json:"first_divergence_index"`
+	HistoryRoot          string              `json:"history_root"`
+	Totals               ChainReportTotals   `json:"totals"`
+	Events               []EventVerification `json:"events"`
+}
+
+// HashDataForEvent collects the fields of an event that its hash commits to
+func HashDataForEvent(event *models.Event) EventHashData {
+	return EventHashData{
+		ProductID:         event.ProductID,
+		EventType:         event.EventType,
+		EventData:         event.EventData,
+		CreatedAt:         event.CreatedAt,
+		CreatedBy:         event.CreatedBy,
+		PreviousEventHash: event.PreviousEventHash,
+		HashVersion:       event.HashVersion,
+	}
+}
+
+// VerifyEventSignatures checks an event's server signature against the key
+// that was active when the event was created, and its actor signature if it
+// has one. Events from before the server signed events carry no server
+// signature; for them it returns ErrUnsignedLegacy once any actor signature
+// checks out.
+func VerifyEventSignatures(event *models.Event) error {
+	var legacy error
+	if event.Signature == "" {
+		if !IsLegacyEvent(event.ID) {
+			return errors.New("event is not signed")
+		}
+		legacy = ErrUnsignedLegacy
+	} else if err := VerifySignature(event.SigningKeyID, event.CreatedAt, EventSignaturePayload(event.EventHash), event.Signature); err != nil {
+		return err
+	}
+
+	if event.ActorSignature != "" {
+		if err := VerifyActorSignature(event.ActorPublicKey, HashDataForEvent(event), event.ActorSignature); err != nil {
+			return err
+		}
+	}
+	return legacy
+}
+
+// BuildChainReport checks every event of a product's history, in chain order,
+// without stopping at the first failure.
+func BuildChainReport(productID uint, events []models.Event) ChainVerificationReport {
+	report := ChainVerificationReport{
+		Schema:        ChainReportSchemaURL,
+		SchemaVersion: ChainReportSchemaVersion,
+		ProductID:     productID,
+		GeneratedAt:   time.Now().UTC(),
+		Events:        make([]EventVerification, 0, len(events)),
+	}
+
+	known := make(map[string]bool, len(events))
+	hashes := make([]string, len(events))
+	for i, event := range events {
+		known[event.EventHash] = true
+		hashes[i] = event.EventHash
+	}
+	report.HistoryRoot = ComputeMerkleRoot(hashes)
+
+	for i := range events {
+		event := &events[i]
+		result := EventVerification{
+			Index:             i,
+			EventID:           event.ID,
+			EventType:         event.EventType,
+			CreatedAt:         event.CreatedAt,
+			HashVersion:       event.HashVersion,
+			Issues:            []string{},
+			StoredHash:        event.EventHash,
+			PreviousEventHash: event.PreviousEventHash,
+			SigningKeyID:      event.SigningKeyID,
+			ActorSigned:       event.ActorSignature != "",
+		}
+		fail := func(status, detail string) {
+			result.Issues = append(result.Issues, status)
+			result.Details = append(result.Details, detail)
+		}
+
+		if i > 0 {
+			result.ExpectedPreviousHash = events[i-1].EventHash
+		}
+		if event.PreviousEventHash != result.ExpectedPreviousHash {
+			// A link to a hash that appears nowhere in the history means the
+			// predecessor was removed; otherwise the chain was reordered or
+			// spliced
+			if event.PreviousEventHash != "" && !known[event.PreviousEventHash] {
+				fail(EventStatusMissingPredecessor, "previous_event_hash does not match any event in the history")
+			} else {
+				fail(EventStatusLinkMismatch, "previous_event_hash does not match the preceding event")
+			}
+		}
+
+		computed, err := ComputeEventHash(HashDataForEvent(event))
+		if err != nil {
+			fail(EventStatusHashMismatch, err.Error())
+		} else {
+			result.ComputedHash = computed
+			if computed != event.EventHash {
+				fail(EventStatusHashMismatch, "stored event_hash does not match the event contents")
+			}
+		}
+
+		legacy := false
+		if err := VerifyEventSignatures(event); errors.Is(err, ErrUnsignedLegacy) {
+			legacy = true
+		} else if err != nil {
+			fail(EventStatusSignatureInvalid, err.Error())
+		}
+
+		result.Status = EventStatusOK
+		if legacy {
+			result.Status = EventStatusUnsignedLegacy
+		}
+		if len(result.Issues) > 0 {
+			result.Status = result.Issues[0]
+			if report.FirstDivergenceIndex == nil {
+				index := i
+				report.FirstDivergenceIndex = &index
+			}
+		}
+
+		report.Totals.Events++
+		switch result.Status {
+		case EventStatusOK:
+			report.Totals.OK++
+		case EventStatusHashMismatch:
+			report.Totals.HashMismatch++
+		case EventStatusLinkMismatch:
+			report.Totals.LinkMismatch++
+		case EventStatusMissingPredecessor:
+			report.Totals.MissingPredecessor++
+		case EventStatusSignatureInvalid:
+			report.Totals.SignatureInvalid++
+		case EventStatusUnsignedLegacy:
+			report.Totals.UnsignedLegacy++
+		}
+
+		report.Events = append(report.Events, result)
+	}
+
+	report.Valid = report.FirstDivergenceIndex == nil
+	return report
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnConfig names the relying party passkeys are bound to. RPID is the
+// site's domain and RPOrigins the exact origins of the frontend; a passkey
+// only works on the domain it was created for.
+type WebAuthnConfig struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigins     []string
+}
+
+// How long the browser has to answer a registration or login challenge
+const webAuthnCeremonyTimeout = 5 * time.Minute
+
+var relyingParty *webauthn.WebAuthn
+
+// InitWebAuthn configures passkey registration and login
+func InitWebAuthn(config WebAuthnConfig) error {
+	rp, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: config.RPDisplayName,
+		RPOrigins:     config.RPOrigins,
+		// Enforced timeouts give each ceremony the expiry it is stored with
+		Timeouts: webauthn.TimeoutsConfig{
+			Login: webauthn.TimeoutConfig{
+				Enforce:    true,
+				Timeout:    webAuthnCeremonyTimeout,
+				TimeoutUVD: webAuthnCeremonyTimeout,
+			},
+			Registration: webauthn.TimeoutConfig{
+				Enforce:    true,
+				Timeout:    webAuthnCeremonyTimeout,
+				TimeoutUVD: webAuthnCeremonyTimeout,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	relyingParty = rp
+	return nil
+}
+
+// WebAuthn returns the configured relying party
+func WebAuthn() (*webauthn.WebAuthn, error) {
+	if relyingParty == nil {
+		return nil, errors.New("WebAuthn not initialized")
+	}
+	return relyingParty, nil
+}
@@ -4,6 +4,8 @@ import Compiler from './components/Compiler'
 import Home from './pages/landing/Home'
 import Signup from "./pages/auth/Signup"
 import Login from "./pages/auth/Login"
+import ResetPassword from "./pages/auth/ResetPassword"
+import ConfirmEmail from "./pages/auth/ConfirmEmail"
 import ViewAdminRequests from "./pages/auth/ViewAdminRequests"
 import About from './pages/landing/About'
 import Contact from "./pages/landing/Contact"
@@ -32,6 +34,8 @@ function App() {
           <Route path="Home" element={<Home/>}></Route>
           <Route path="signup" element={<Signup/>}></Route>
           <Route path="login" element={<Login/>}></Route>
+          <Route path="reset-password" element={<ResetPassword/>}></Route>
+          <Route path="confirm-email" element={<ConfirmEmail/>}></Route>
           <Route path="about" element={<About/>}></Route>
           <Route path="contact" element={<Contact/>}></Route>
           <Route path="view-requests" element={<ViewAdminRequests/>}></Route>
@@ -1,5 +1,5 @@
 import React, { useEffect, useState } from 'react';
-import { getUserProducts } from '../../utils/ApiServices';
+import { getUserProducts, logout } from '../../utils/ApiServices';
 import { Link, useNavigate, useLocation } from 'react-router-dom';
 import { FaBoxOpen, FaSignOutAlt, FaCube, FaSearch, FaChevronDown } from 'react-icons/fa';
 import { motion, AnimatePresence } from 'framer-motion';
@@ -26,8 +26,8 @@ const SideBar = () => {
     fetchData();
   }, []);
 
-  const handleLogout = () => {
-    localStorage.removeItem('token');
+  const handleLogout = async () => {
+    await logout();
     localStorage.removeItem('username');
     navigate('/login');
   };
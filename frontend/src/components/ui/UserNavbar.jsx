@@ -1,7 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import { Link, useLocation, useNavigate } from 'react-router-dom';
 import { FaTachometerAlt, FaExchangeAlt, FaBell, FaSignOutAlt, FaPlus, FaUser } from 'react-icons/fa';
-import { getUserInfo, getPendingTransfers } from '../../utils/ApiServices';
+import { getUserInfo, getPendingTransfers, logout } from '../../utils/ApiServices';
 
 // User Info Dropdown
 const UserInfo = () => {
@@ -22,8 +22,8 @@ const UserInfo = () => {
     return () => { mounted = false; };
   }, []);
 
-  const handleLogout = () => {
-    localStorage.removeItem('token');
+  const handleLogout = async () => {
+    await logout();
     localStorage.removeItem('username');
     navigate('/login');
   };
@@ -0,0 +1,41 @@
+import React, { useEffect, useState } from 'react';
+import { useSearchParams } from 'react-router-dom';
+import axios from 'axios';
+
+// Opened from the confirmation link emailed to a brand's contact address
+function ConfirmEmail() {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token');
+  const [message, setMessage] = useState('Confirming your email...');
+  const [failed, setFailed] = useState(false);
+
+  useEffect(() => {
+    if (!token) {
+      setFailed(true);
+      setMessage('This confirmation link is incomplete.');
+      return;
+    }
+    axios.post('/api/users/confirm-email', { token })
+      .then(() => setMessage('Email confirmed! An admin will review your registration.'))
+      .catch((err) => {
+        setFailed(true);
+        setMessage(err.response?.data?.error || 'Confirmation failed. Please try again.');
+      });
+  }, [token]);
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-[#18181b] via-[#232136] to-[#0f0f13]">
+      <div className="w-full max-w-md rounded-2xl shadow-2xl bg-[#18181b] bg-opacity-95 border border-[#232136] p-10 text-center">
+        <h1 className="text-3xl font-extrabold mb-6 text-white tracking-tight">Confirm your email</h1>
+        <p className={`font-semibold ${failed ? 'text-red-400' : 'text-green-400'}`}>{message}</p>
+        <div className="mt-8 text-gray-400 text-sm">
+          <a href="/login" className="text-green-400 hover:underline font-semibold">
+            Back to sign in
+          </a>
+        </div>
+      </div>
+    </div>
+  );
+}
+
+export default ConfirmEmail;
@@ -10,6 +10,13 @@ function Login() {
   });
   const [message, setMessage] = useState('');
   const [loading, setLoading] = useState(false);
+  // Second factor step: the challenge from the password login, the QR code
+  // while setting up an authenticator, and the recovery codes to write down
+  const [challenge, setChallenge] = useState(null);
+  const [enrollment, setEnrollment] = useState(null);
+  const [code, setCode] = useState('');
+  const [useRecovery, setUseRecovery] = useState(false);
+  const [recoveryCodes, setRecoveryCodes] = useState(null);
   const navigate = useNavigate();
 
   const handleChange = (e) => {
@@ -23,14 +30,57 @@ function Login() {
 
     try {
       const response = await axios.post('/api/users/login', form);
-      localStorage.setItem('token', response.data.token);
-      setMessage('Login successful!');
-      console.log('Login successful:', response.data);
-      // Navigate to dashboard or home after successful login
-      setTimeout(() => navigate('/dashboard'), 1000);
+      if (response.data.mfa_required) {
+        setChallenge(response.data);
+        if (response.data.mfa_enrollment_required) {
+          const enroll = await axios.post('/api/users/login/2fa/enroll', {
+            challenge_token: response.data.challenge_token
+          });
+          setEnrollment(enroll.data);
+        }
+        return;
+      }
+      finishLogin(response.data);
     } catch (err) {
+      const reason = err.response?.data?.rejection_reason;
+      setMessage((err.response?.data?.error || 'Login failed. Please try again.') + (reason ? `: ${reason}` : ''));
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const finishLogin = (data) => {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refresh_token', data.refresh_token);
+    setMessage('Login successful!');
+    if (data.recovery_codes) {
+      // Shown once; the user continues after saving them
+      setRecoveryCodes(data.recovery_codes);
+      return;
+    }
+    // Navigate to dashboard or home after successful login
+    setTimeout(() => navigate('/dashboard'), 1000);
+  };
+
+  const handleSecondFactor = async (e) => {
+    e.preventDefault();
+    setMessage('');
+    setLoading(true);
+
+    try {
+      const response = await axios.post('/api/users/login/2fa', {
+        challenge_token: challenge.challenge_token,
+        ...(useRecovery ? { recovery_code: code } : { code })
+      });
+      finishLogin(response.data);
+    } catch (err) {
+      if (err.response?.status === 401 && err.response?.data?.error?.includes('challenge')) {
+        setChallenge(null);
+        setEnrollment(null);
+      }
       setMessage(err.response?.data?.error || 'Login failed. Please try again.');
     } finally {
+      setCode('');
       setLoading(false);
     }
   };
@@ -48,6 +98,71 @@ function Login() {
           <h1 className="text-3xl font-extrabold mb-2 text-white tracking-tight">Welcome back</h1>
           <p className="mb-8 text-gray-400">Sign in to your VeriOwn account</p>
 
+          {recoveryCodes ? (
+            <div className="flex flex-col gap-5">
+              <p className="text-gray-300">
+                Two-factor authentication is set up. Save these recovery codes somewhere safe: each one signs you in once if you lose your authenticator.
+              </p>
+              <ul className="grid grid-cols-2 gap-2 font-mono text-white">
+                {recoveryCodes.map((recoveryCode) => <li key={recoveryCode}>{recoveryCode}</li>)}
+              </ul>
+              <button
+                type="button"
+                onClick={() => navigate('/dashboard')}
+                className="bg-gradient-to-r from-purple-600 to-indigo-500 text-white p-3 rounded-lg font-bold mt-4 shadow-lg hover:scale-105 hover:shadow-purple-800/40 transition-all duration-200"
+              >
+                I saved them, continue
+              </button>
+            </div>
+          ) : challenge ? (
+            <form className="flex flex-col gap-5" onSubmit={handleSecondFactor}>
+              {enrollment && (
+                <div className="flex flex-col items-center gap-3">
+                  <p className="text-gray-300">
+                    Your account requires two-factor authentication. Scan this code with an authenticator app, then enter the code it shows.
+                  </p>
+                  <img src={enrollment.qr_code} alt="Authenticator QR code" className="w-48 h-48 rounded-lg bg-white p-2" />
+                  <p className="text-gray-500 text-xs break-all">Or enter this key: {enrollment.secret}</p>
+                </div>
+              )}
+
+              <div className="flex flex-col gap-1">
+                <label className="text-gray-300 font-semibold">
+                  {useRecovery ? 'Recovery code' : 'Authentication code'}
+                </label>
+                <input
+                  type="text"
+                  name="code"
+                  autoComplete="one-time-code"
+                  placeholder={useRecovery ? 'xxxxx-xxxxx' : '123456'}
+                  className="p-3 rounded-lg bg-[#232136] border border-[#393552] text-white focus:outline-none focus:ring-2 focus:ring-indigo-600 transition placeholder-gray-500"
+                  value={code}
+                  onChange={(e) => setCode(e.target.value)}
+                  required
+                />
+              </div>
+
+              {!enrollment && (
+                <button type="button" onClick={() => setUseRecovery(!useRecovery)} className="text-green-400 hover:underline text-sm text-left">
+                  {useRecovery ? 'Use your authenticator app' : 'Use a recovery code'}
+                </button>
+              )}
+
+              <button
+                type="submit"
+                className={`bg-gradient-to-r from-purple-600 to-indigo-500 text-white p-3 rounded-lg font-bold mt-4 shadow-lg hover:scale-105 hover:shadow-purple-800/40 transition-all duration-200 ${loading ? 'opacity-70 cursor-not-allowed' : ''}`}
+                disabled={loading}
+              >
+                {loading ? 'Verifying...' : 'Verify'}
+              </button>
+
+              {message && (
+                <div className={`text-center mt-2 font-semibold ${message.includes('successful') ? 'text-green-400' : 'text-red-400'}`}>
+                  {message}
+                </div>
+              )}
+            </form>
+          ) : (
           <form className="flex flex-col gap-5" onSubmit={handleLogin}>
             <div className="flex flex-col gap-1">
               <label className="text-gray-300 font-semibold">Username</label>
@@ -84,7 +199,7 @@ function Login() {
                 />
                 <label htmlFor="remember" className="text-gray-400">Remember me</label>
               </div>
-              <a href="#" className="text-green-400 hover:underline">Forgot password?</a>
+              <a href="/reset-password" className="text-green-400 hover:underline">Forgot password?</a>
             </div>
 
             <button
@@ -101,6 +216,7 @@ function Login() {
               </div>
             )}
           </form>
+          )}
 
           <div className="mt-8 text-gray-400 text-sm text-center">
             Don't have an account?{' '}
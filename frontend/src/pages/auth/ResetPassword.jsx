@@ -0,0 +1,133 @@
+import React, { useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import axios from 'axios';
+
+// Asks for a reset link by username, or, when opened from the link in the
+// email, sets the new password with its token
+function ResetPassword() {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token');
+  const [username, setUsername] = useState('');
+  const [password, setPassword] = useState('');
+  const [confirm, setConfirm] = useState('');
+  const [message, setMessage] = useState('');
+  const [failed, setFailed] = useState(false);
+  const [loading, setLoading] = useState(false);
+  const navigate = useNavigate();
+
+  const handleRequest = async (e) => {
+    e.preventDefault();
+    setMessage('');
+    setLoading(true);
+
+    try {
+      const response = await axios.post('/api/users/password/forgot', { username });
+      setFailed(false);
+      setMessage(response.data.message);
+    } catch (err) {
+      setFailed(true);
+      setMessage(err.response?.data?.error || 'Request failed. Please try again.');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const handleReset = async (e) => {
+    e.preventDefault();
+    if (password !== confirm) {
+      setFailed(true);
+      setMessage('Passwords do not match');
+      return;
+    }
+    setMessage('');
+    setLoading(true);
+
+    try {
+      const response = await axios.post('/api/users/password/reset', { token, new_password: password });
+      setFailed(false);
+      setMessage(response.data.message);
+      setTimeout(() => navigate('/login'), 1500);
+    } catch (err) {
+      setFailed(true);
+      setMessage(err.response?.data?.error || 'Reset failed. Please try again.');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const inputClass = "p-3 rounded-lg bg-[#232136] border border-[#393552] text-white focus:outline-none focus:ring-2 focus:ring-indigo-600 transition placeholder-gray-500";
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-[#18181b] via-[#232136] to-[#0f0f13]">
+      <div className="w-full max-w-md rounded-2xl shadow-2xl bg-[#18181b] bg-opacity-95 border border-[#232136] p-10">
+        <h1 className="text-3xl font-extrabold mb-2 text-white tracking-tight">Reset your password</h1>
+        <p className="mb-8 text-gray-400">
+          {token ? 'Choose a new password. You will be logged out everywhere.' : 'We will email a reset link to the address on your account.'}
+        </p>
+
+        <form className="flex flex-col gap-5" onSubmit={token ? handleReset : handleRequest}>
+          {token ? (
+            <>
+              <div className="flex flex-col gap-1">
+                <label className="text-gray-300 font-semibold">New password</label>
+                <input
+                  type="password"
+                  placeholder="********"
+                  className={inputClass}
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                  required
+                />
+              </div>
+              <div className="flex flex-col gap-1">
+                <label className="text-gray-300 font-semibold">Confirm new password</label>
+                <input
+                  type="password"
+                  placeholder="********"
+                  className={inputClass}
+                  value={confirm}
+                  onChange={(e) => setConfirm(e.target.value)}
+                  required
+                />
+              </div>
+            </>
+          ) : (
+            <div className="flex flex-col gap-1">
+              <label className="text-gray-300 font-semibold">Username</label>
+              <input
+                type="text"
+                placeholder="johndoe123"
+                className={inputClass}
+                value={username}
+                onChange={(e) => setUsername(e.target.value)}
+                required
+              />
+            </div>
+          )}
+
+          <button
+            type="submit"
+            className={`bg-gradient-to-r from-purple-600 to-indigo-500 text-white p-3 rounded-lg font-bold mt-4 shadow-lg hover:scale-105 hover:shadow-purple-800/40 transition-all duration-200 ${loading ? 'opacity-70 cursor-not-allowed' : ''}`}
+            disabled={loading}
+          >
+            {loading ? 'Sending...' : token ? 'Set new password' : 'Send reset link'}
+          </button>
+
+          {message && (
+            <div className={`text-center mt-2 font-semibold ${failed ? 'text-red-400' : 'text-green-400'}`}>
+              {message}
+            </div>
+          )}
+        </form>
+
+        <div className="mt-8 text-gray-400 text-sm text-center">
+          <a href="/login" className="text-green-400 hover:underline font-semibold">
+            Back to sign in
+          </a>
+        </div>
+      </div>
+    </div>
+  );
+}
+
+export default ResetPassword;
@@ -2,7 +2,7 @@ import React, { useState } from 'react';
 import axios from 'axios';
 
 const initialForms = {
-  regular: { username: '', password: '' },
+  regular: { username: '', password: '', email: '' },
   brand: {
     username: '', password: '', company_name: '', tax_id: '',
     contact_email: '', official_domain: ''
@@ -17,17 +17,27 @@ const Signup = () => {
   const [userType, setUserType] = useState('regular');
   const [form, setForm] = useState(initialForms['regular']);
   const [message, setMessage] = useState('');
+  // DNS record a new brand publishes to prove it owns its domain
+  const [domainVerification, setDomainVerification] = useState(null);
+  // Verification documents, sent with the registration as a multipart form
+  const [files, setFiles] = useState({});
 
   const handleTypeChange = (e) => {
     setUserType(e.target.value);
     setForm(initialForms[e.target.value]);
     setMessage('');
+    setDomainVerification(null);
+    setFiles({});
   };
 
   const handleChange = (e) => {
     setForm({ ...form, [e.target.name]: e.target.value });
   };
 
+  const handleFileChange = (e) => {
+    setFiles({ ...files, [e.target.name]: e.target.files[0] });
+  };
+
   const handleSignup = async (e) => {
     e.preventDefault();
     setMessage('');
@@ -57,14 +67,36 @@ const Signup = () => {
       };
     }
 
+    const attached = Object.entries(files).filter(([, file]) => file);
+    if (userType !== 'regular' && attached.length > 0) {
+      const formData = new FormData();
+      Object.entries(data).forEach(([key, value]) => formData.append(key, value));
+      attached.forEach(([key, file]) => formData.append(key, file));
+      data = formData;
+    }
+
     try {
       const res = await axios.post(url, data);
       setMessage(res.data.message || 'Signup successful!');
+      if (res.data.domain_verification) {
+        setDomainVerification({ ...res.data.domain_verification, organization_id: res.data.organization_id });
+      }
     } catch (err) {
       setMessage(err.response?.data?.error || 'Signup failed');
     }
   };
 
+  const handleDomainCheck = async () => {
+    try {
+      const res = await axios.post(`/api/organizations/${domainVerification.organization_id}/verification/domain`);
+      setMessage(res.data.domain_verified
+        ? 'Domain verified! An admin will review your registration.'
+        : `Domain not verified yet: ${res.data.domain_check_error}`);
+    } catch (err) {
+      setMessage(err.response?.data?.error || 'Domain check failed');
+    }
+  };
+
   return (
     <div className="min-h-screen flex items-center pt-20 justify-center bg-gradient-to-br from-[#18181b] via-[#232136] to-[#0f0f13]">
       <div className="flex w-full max-w-4xl rounded-2xl overflow-hidden shadow-2xl bg-[#18181b] bg-opacity-95 border border-[#232136]">
@@ -118,6 +150,20 @@ const Signup = () => {
               />
             </div>
 
+            {userType === 'regular' && (
+              <div className="flex flex-col gap-1">
+                <label className="text-gray-300 font-semibold">Email (optional, to reset your password)</label>
+                <input
+                  type="email"
+                  name="email"
+                  placeholder="john@example.com"
+                  className="p-3 rounded-lg bg-[#232136] border border-[#393552] text-white"
+                  value={form.email}
+                  onChange={handleChange}
+                />
+              </div>
+            )}
+
             {/* Brand Fields */}
             {userType === 'brand' && (
               <>
@@ -212,7 +258,7 @@ const Signup = () => {
                   />
                 </div>
                 <div className="flex flex-col gap-1">
-                  <label className="text-gray-300 font-semibold">Certification Proof (URL)</label>
+                  <label className="text-gray-300 font-semibold">Certification Proof (URL, or upload the document below)</label>
                   <input
                     type="text"
                     name="certification_proof"
@@ -220,7 +266,17 @@ const Signup = () => {
                     className="p-3 rounded-lg bg-[#232136] border border-[#393552] text-white"
                     value={form.certification_proof}
                     onChange={handleChange}
-                    required
+                    required={!files.certification_file}
+                  />
+                </div>
+                <div className="flex flex-col gap-1">
+                  <label className="text-gray-300 font-semibold">Certification Document (PDF, PNG or JPEG)</label>
+                  <input
+                    type="file"
+                    name="certification_file"
+                    accept="application/pdf,image/png,image/jpeg"
+                    className="p-3 rounded-lg bg-[#232136] border border-[#393552] text-white"
+                    onChange={handleFileChange}
                   />
                 </div>
                 <div className="flex flex-col gap-1">
@@ -245,9 +301,39 @@ const Signup = () => {
               Sign Up
             </button>
 
+            {userType !== 'regular' && (
+              <div className="flex flex-col gap-1">
+                <label className="text-gray-300 font-semibold">
+                  {userType === 'brand' ? 'Business Registration Document' : 'Business License Document'} (PDF, PNG or JPEG)
+                </label>
+                <input
+                  type="file"
+                  name="business_license_file"
+                  accept="application/pdf,image/png,image/jpeg"
+                  className="p-3 rounded-lg bg-[#232136] border border-[#393552] text-white"
+                  onChange={handleFileChange}
+                />
+              </div>
+            )}
+
             {message && (
               <div className="text-center text-purple-400 mt-2 font-semibold">{message}</div>
             )}
+            {domainVerification && (
+              <div className="p-4 rounded-lg bg-[#232136] border border-[#393552] text-gray-300 text-sm flex flex-col gap-2">
+                <p>Add this DNS record to your domain, then check it:</p>
+                <p><span className="text-gray-500">Type:</span> {domainVerification.record_type}</p>
+                <p className="break-all"><span className="text-gray-500">Name:</span> {domainVerification.record_name}</p>
+                <p className="break-all font-mono"><span className="text-gray-500">Value:</span> {domainVerification.record_value}</p>
+                <button
+                  type="button"
+                  onClick={handleDomainCheck}
+                  className="mt-2 p-2 rounded-lg border border-indigo-500 text-indigo-300 hover:bg-indigo-500/20 font-semibold"
+                >
+                  Check DNS record
+                </button>
+              </div>
+            )}
           </form>
 
           <div className="mt-8 text-gray-400 text-sm text-center">
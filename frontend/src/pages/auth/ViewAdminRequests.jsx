@@ -36,12 +36,38 @@ function ViewAdminRequests() {
     }
   };
 
+  // Documents need the admin's token, so they are fetched and opened as blobs
+  const openDocument = async (doc) => {
+    try {
+      const token = localStorage.getItem('token');
+      const response = await axios.get(doc.url, {
+        headers: {
+          Authorization: `Bearer ${token}`
+        },
+        responseType: 'blob'
+      });
+      window.open(window.URL.createObjectURL(response.data), '_blank');
+    } catch (err) {
+      setError(err.response?.data?.error || 'Failed to open document');
+    }
+  };
+
   const handleVerification = async (userId, status) => {
+    // A rejection needs a reason for the applicant; notes stay with admins
+    let reason = '';
+    if (status === 'rejected') {
+      reason = window.prompt('Reason for rejection (shown to the applicant):');
+      if (!reason) {
+        return;
+      }
+    }
+    const notes = window.prompt('Notes for other admins (optional):') || '';
+
     try {
       setProcessingId(userId);
       const token = localStorage.getItem('token');
       await axios.post(`/api/admin/verify-user/${userId}`, 
-        { status },
+        { status, reason, notes },
         {
           headers: {
             Authorization: `Bearer ${token}`
@@ -49,7 +75,7 @@ function ViewAdminRequests() {
         }
       );
       // Remove the processed request from the list
-      setPendingRequests(pendingRequests.filter(request => request.ID !== userId));
+      setPendingRequests(pendingRequests.filter(request => request.id !== userId));
       setProcessingId(null);
     } catch (err) {
       console.error("Error processing verification:", err);
@@ -113,7 +139,7 @@ function ViewAdminRequests() {
         ) : (
           <div className="grid grid-cols-1 gap-6">
             {pendingRequests.map((request) => (
-              <div key={request.ID} className="bg-[#232136] rounded-xl overflow-hidden border border-[#393552]">
+              <div key={request.id} className="bg-[#232136] rounded-xl overflow-hidden border border-[#393552]">
                 <div className="p-6">
                   <div className="flex justify-between items-start">
                     <div>
@@ -121,7 +147,7 @@ function ViewAdminRequests() {
                         {request.role === "brand" ? "Brand" : "Repair Shop"}
                       </span>
                       <h2 className="text-2xl font-bold mb-1 text-white">{request.username}</h2>
-                      <p className="text-gray-300 font-medium">{request.CompanyName}</p>
+                      <p className="text-gray-300 font-medium">{request.company_name}</p>
                     </div>
                     <span className="inline-block px-3 py-1 text-xs rounded-full bg-amber-500/20 text-amber-300 border border-amber-400/30">
                       Pending Verification
@@ -134,30 +160,30 @@ function ViewAdminRequests() {
                         <>
                           <div>
                             <p className="text-sm text-gray-500">Company Name</p>
-                            <p className="font-medium text-gray-200">{request.CompanyName}</p>
+                            <p className="font-medium text-gray-200">{request.company_name}</p>
                           </div>
                           <div>
                             <p className="text-sm text-gray-500">Tax ID</p>
-                            <p className="font-medium text-gray-200">{request.TaxID}</p>
+                            <p className="font-medium text-gray-200">{request.tax_id}</p>
                           </div>
                           <div>
                             <p className="text-sm text-gray-500">Official Domain</p>
-                            <p className="font-medium text-gray-200">{request.OfficialDomain}</p>
+                            <p className="font-medium text-gray-200">{request.official_domain}</p>
                           </div>
                         </>
                       ) : (
                         <>
                           <div>
                             <p className="text-sm text-gray-500">Business Name</p>
-                            <p className="font-medium text-gray-200">{request.CompanyName}</p>
+                            <p className="font-medium text-gray-200">{request.company_name}</p>
                           </div>
                           <div>
                             <p className="text-sm text-gray-500">Business License</p>
-                            <p className="font-medium text-gray-200">{request.BusinessLicense}</p>
+                            <p className="font-medium text-gray-200">{request.business_license}</p>
                           </div>
                           <div>
                             <p className="text-sm text-gray-500">Address</p>
-                            <p className="font-medium text-gray-200">{request.LocationAddress}</p>
+                            <p className="font-medium text-gray-200">{request.location_address}</p>
                           </div>
                         </>
                       )}
@@ -165,13 +191,13 @@ function ViewAdminRequests() {
                     <div className="space-y-4">
                       <div>
                         <p className="text-sm text-gray-500">Contact Email</p>
-                        <p className="font-medium text-gray-200">{request.ContactEmail}</p>
+                        <p className="font-medium text-gray-200">{request.contact_email}</p>
                       </div>
                       {request.role === "repair_shop" && (
                         <div>
                           <p className="text-sm text-gray-500">Certification</p>
                           <a 
-                            href={request.CertificationProof} 
+                            href={request.certification_proof} 
                             target="_blank" 
                             rel="noopener noreferrer"
                             className="text-indigo-400 hover:text-indigo-300 hover:underline font-medium flex items-center"
@@ -183,10 +209,50 @@ function ViewAdminRequests() {
                           </a>
                         </div>
                       )}
+                      {request.documents?.length > 0 && (
+                        <div>
+                          <p className="text-sm text-gray-500">Documents</p>
+                          {request.documents.map((doc) => (
+                            <button
+                              key={doc.id}
+                              type="button"
+                              onClick={() => openDocument(doc)}
+                              className="block text-indigo-400 hover:text-indigo-300 hover:underline font-medium text-left"
+                            >
+                              {doc.kind.replace('_', ' ')}: {doc.file_name}
+                            </button>
+                          ))}
+                        </div>
+                      )}
+                      {request.decisions?.length > 0 && (
+                        <div>
+                          <p className="text-sm text-gray-500">History</p>
+                          {request.decisions.map((decision) => (
+                            <p key={decision.id} className="text-gray-300 text-sm">
+                              {new Date(decision.decided_at).toLocaleDateString()}: {decision.status}
+                              {decision.reason && ` (${decision.reason})`}
+                              {decision.notes && ` - ${decision.notes}`}
+                            </p>
+                          ))}
+                        </div>
+                      )}
+                      {request.evidence && (
+                        <div>
+                          <p className="text-sm text-gray-500">Ownership Evidence</p>
+                          <p className={`font-medium ${request.evidence.email_confirmed ? 'text-emerald-400' : 'text-red-400'}`}>
+                            {request.evidence.email_confirmed ? 'Contact email confirmed' : 'Contact email not confirmed'}
+                          </p>
+                          <p className={`font-medium ${request.evidence.domain_verified ? 'text-emerald-400' : 'text-red-400'}`}>
+                            {request.evidence.domain_verified
+                              ? `DNS record found at ${request.evidence.domain_record_name}`
+                              : `No DNS record at ${request.evidence.domain_record_name}${request.evidence.domain_check_error ? ` (${request.evidence.domain_check_error})` : ''}`}
+                          </p>
+                        </div>
+                      )}
                       <div>
                         <p className="text-sm text-gray-500">Registration Date</p>
                         <p className="font-medium text-gray-200">
-                          {new Date(request.CreatedAt).toLocaleDateString()}
+                          {new Date(request.created_at).toLocaleDateString()}
                         </p>
                       </div>
                     </div>
@@ -196,23 +262,23 @@ function ViewAdminRequests() {
                 {/* Actions */}
                 <div className="p-5 bg-[#18181b] flex justify-end gap-3">
                   <button
-                    onClick={() => handleVerification(request.ID, "rejected")}
-                    disabled={processingId === request.ID}
+                    onClick={() => handleVerification(request.id, "rejected")}
+                    disabled={processingId === request.id}
                     className={`px-5 py-2 rounded-lg border border-red-500 text-red-400 hover:bg-red-500/20 font-medium ${
-                      processingId === request.ID ? 'opacity-50 cursor-not-allowed' : ''
+                      processingId === request.id ? 'opacity-50 cursor-not-allowed' : ''
                     }`}
                   >
                     Reject
                   </button>
                   <button
-                    onClick={() => handleVerification(request.ID, "verified")}
-                    disabled={processingId === request.ID}
+                    onClick={() => handleVerification(request.id, "verified")}
+                    disabled={processingId === request.id}
                     className={`px-5 py-2 rounded-lg bg-gradient-to-r from-emerald-500 to-teal-500 text-white font-medium 
                       hover:shadow-lg hover:shadow-emerald-500/25 ${
-                        processingId === request.ID ? 'opacity-70 cursor-not-allowed' : ''
+                        processingId === request.id ? 'opacity-70 cursor-not-allowed' : ''
                       }`}
                   >
-                    {processingId === request.ID ? (
+                    {processingId === request.id ? (
                       <span className="flex items-center">
                         <svg className="animate-spin -ml-1 mr-2 h-4 w-4 text-white" xmlns="http://www.w3.org/2000/svg" fill="none" viewBox="0 0 24 24">
                           <circle className="opacity-25" cx="12" cy="12" r="10" stroke="currentColor" strokeWidth="4"></circle>
@@ -22,6 +22,43 @@ api.interceptors.request.use(
   (error) => Promise.reject(error)
 );
 
+// Access tokens are short-lived: on a 401, trade the refresh token for a new
+// pair once and retry the request
+api.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const original = error.config;
+    const refreshToken = localStorage.getItem('refresh_token');
+    if (error.response?.status !== 401 || original._retried || !refreshToken) {
+      return Promise.reject(error);
+    }
+    original._retried = true;
+    try {
+      const response = await axios.post(`${API_URL}/api/users/refresh`, { refresh_token: refreshToken });
+      localStorage.setItem('token', response.data.token);
+      localStorage.setItem('refresh_token', response.data.refresh_token);
+      original.headers.Authorization = `Bearer ${response.data.token}`;
+      return api(original);
+    } catch {
+      localStorage.removeItem('token');
+      localStorage.removeItem('refresh_token');
+      return Promise.reject(error);
+    }
+  }
+);
+
+// Ends the session on the server; the local tokens are dropped either way
+export const logout = async () => {
+  try {
+    await api.post('/api/users/logout');
+  } catch {
+    // The session may already be gone
+  } finally {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+  }
+};
+
 export const registerProduct = async (productData) => {
   try {
     const response = await api.post('/api/products', productData);